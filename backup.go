@@ -0,0 +1,172 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// 备份流由若干个 | len(4B) | pb.KVList | 组成, 每个KVList最多包含backupBatchSize个kv
+const backupBatchSize = 1000
+
+// Backup 将版本大于since的数据写入w, 值指针会被解析为真实的value, 删除的key以带有BitDelete的KV写入
+// 返回备份开始时的提交版本, 作为下一次增量备份的since
+func (db *DB) Backup(w io.Writer, since uint64) (uint64, error) {
+	bw := bufio.NewWriter(w)
+	list := &pb.KVList{}
+
+	readTs := atomic.LoadUint64(&db.version)
+	iter := db.newIterator(&utils.Options{IsAsc: true}, readTs, true)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		if utils.ParseTs(e.Key) <= since {
+			continue
+		}
+		list.Kv = append(list.Kv, entryToKV(e))
+		if len(list.Kv) >= backupBatchSize {
+			if err := writeKVList(bw, list); err != nil {
+				return 0, err
+			}
+			list.Kv = list.Kv[:0]
+		}
+	}
+	// 读不到的value不能被跳过, 否则备份会静默地缺少数据
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if err := writeKVList(bw, list); err != nil {
+		return 0, err
+	}
+	return readTs, bw.Flush()
+}
+
+// Load 读取Backup生成的备份流, 通过批量写入的路径恢复数据
+func (db *DB) Load(r io.Reader) error {
+	if db.isReplica() {
+		return utils.ErrReplicaReadOnly
+	}
+	br := bufio.NewReader(r)
+	for {
+		list, err := readKVList(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entries := make([]*utils.Entry, 0, len(list.Kv))
+		for _, kv := range list.Kv {
+			entries = append(entries, kvToEntry(kv))
+		}
+		if err := db.writeEntries(entries); err != nil {
+			return err
+		}
+	}
+}
+
+// entryToKV 将迭代器返回的entry转换为KV, value已经是解析过值指针的真实数据
+func entryToKV(e *utils.Entry) *pb.KV {
+	return &pb.KV{
+		Key:       utils.SafeCopy(nil, utils.ParseKey(e.Key)),
+		Value:     utils.SafeCopy(nil, e.Value),
+		Meta:      []byte{e.Meta &^ utils.BitValuePointer},
+		Version:   utils.ParseTs(e.Key),
+		ExpiresAt: e.ExpiresAt,
+	}
+}
+
+// kvToEntry 将KV还原为可以写入的entry, 带有BitDelete的KV还原为墓碑
+// KV中的版本来自其他db, 这里不保留, 写入时会分配新的提交版本
+func kvToEntry(kv *pb.KV) *utils.Entry {
+	e := &utils.Entry{
+		Key:       utils.KeyWithTs(kv.Key, 0),
+		Value:     kv.Value,
+		ExpiresAt: kv.ExpiresAt,
+	}
+	if len(kv.Meta) > 0 {
+		e.Meta = kv.Meta[0] &^ utils.BitValuePointer
+		if e.IsTombstone() {
+			e.Value = nil
+		}
+	}
+	return e
+}
+
+// writeEntries 通过批量写入的路径写入entries, 按批量写入的限制切分成多批
+func (db *DB) writeEntries(entries []*utils.Entry) error {
+	var (
+		batch []*utils.Entry
+		size  int64
+	)
+	for _, e := range entries {
+		sz := int64(e.EstimateSize(int(db.opt.ValueThreshold)))
+		// 保证每一批都不超过批量写入的限制
+		if len(batch) > 0 && (int64(len(batch))+1 >= db.opt.MaxBatchCount || size+sz >= db.opt.MaxBatchSize) {
+			if err := db.batchSet(batch); err != nil {
+				return err
+			}
+			batch, size = nil, 0
+		}
+		batch = append(batch, e)
+		size += sz
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return db.batchSet(batch)
+}
+
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	if len(list.Kv) == 0 {
+		return nil
+	}
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(buf)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func readKVList(r io.Reader) (*pb.KVList, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(lenBuf[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	list := &pb.KVList{}
+	if err := list.Unmarshal(buf); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
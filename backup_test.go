@@ -0,0 +1,92 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupAndLoad(t *testing.T) {
+	clearDir()
+	bopt := *opt
+	bopt.ValueLogMaxEntries = 1000
+	db := Open(&bopt)
+	n := 100
+	for i := 0; i < n; i++ {
+		e := utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+		if i%10 == 0 {
+			e.WithTTL(time.Hour)
+		}
+		require.NoError(t, db.Set(e))
+	}
+	require.NoError(t, db.Del([]byte("key001")))
+
+	var buf bytes.Buffer
+	version, err := db.Backup(&buf, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(n+1), version)
+
+	// 没有更新的数据时增量备份为空
+	var inc bytes.Buffer
+	v, err := db.Backup(&inc, version)
+	require.NoError(t, err)
+	require.Equal(t, version, v)
+	require.Zero(t, inc.Len())
+
+	// 增量备份只包含全量备份之后的写入与删除
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key002"), []byte("updated"))))
+	require.NoError(t, db.Del([]byte("key003")))
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key100"), []byte("value100"))))
+	v, err = db.Backup(&inc, version)
+	require.NoError(t, err)
+	require.Equal(t, version+3, v)
+	list, err := readKVList(bufio.NewReader(bytes.NewReader(inc.Bytes())))
+	require.NoError(t, err)
+	require.Len(t, list.Kv, 3)
+	require.Equal(t, "key002", string(list.Kv[0].Key))
+	require.Equal(t, "updated", string(list.Kv[0].Value))
+	require.Equal(t, "key003", string(list.Kv[1].Key))
+	require.NotZero(t, list.Kv[1].Meta[0]&utils.BitDelete)
+	require.Equal(t, "key100", string(list.Kv[2].Key))
+	require.NoError(t, db.Close())
+
+	ropt := bopt
+	ropt.WorkDir = t.TempDir()
+	rdb := Open(&ropt)
+	defer rdb.Close()
+	require.NoError(t, rdb.Load(&buf))
+	require.NoError(t, rdb.Load(&inc))
+	for i := 0; i <= n; i++ {
+		e, err := rdb.Get([]byte(fmt.Sprintf("key%03d", i)))
+		switch i {
+		case 1, 3:
+			require.Equal(t, utils.ErrKeyNotFound, err)
+			continue
+		case 2:
+			require.NoError(t, err)
+			require.Equal(t, "updated", string(e.Value))
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%d", i), string(e.Value))
+		require.Equal(t, i%10 == 0 && i < n, e.ExpiresAt > 0)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// WriteBatch 一组一起提交的写入, 可以编码后在节点之间传输
+type WriteBatch struct {
+	list pb.KVList
+}
+
+// NewWriteBatch _
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// NewWriteBatchFromKVList 直接使用list作为批次内容, 带有BitDelete标记的KV表示删除
+func NewWriteBatchFromKVList(list *pb.KVList) *WriteBatch {
+	return &WriteBatch{list: pb.KVList{Kv: list.Kv}}
+}
+
+// Set 写入key, key和value会被拷贝
+func (wb *WriteBatch) Set(key, value []byte) {
+	wb.SetEntry(utils.NewEntry(key, value))
+}
+
+// SetEntry 写入一个entry, 保留其ExpiresAt与Meta, entry的key为用户key
+func (wb *WriteBatch) SetEntry(e *utils.Entry) {
+	wb.list.Kv = append(wb.list.Kv, &pb.KV{
+		Key:       utils.SafeCopy(nil, e.Key),
+		Value:     utils.SafeCopy(nil, e.Value),
+		Meta:      []byte{e.Meta &^ (utils.BitValuePointer | utils.BitDelete)},
+		ExpiresAt: e.ExpiresAt,
+	})
+}
+
+// Delete 删除key
+func (wb *WriteBatch) Delete(key []byte) {
+	wb.list.Kv = append(wb.list.Kv, &pb.KV{
+		Key:  utils.SafeCopy(nil, key),
+		Meta: []byte{utils.BitDelete},
+	})
+}
+
+// Len 返回批次中的写入个数
+func (wb *WriteBatch) Len() int {
+	return len(wb.list.Kv)
+}
+
+// KVList 返回批次内容, 修改返回值会影响批次
+func (wb *WriteBatch) KVList() *pb.KVList {
+	return &wb.list
+}
+
+// Marshal 编码为pb.KVList
+func (wb *WriteBatch) Marshal() ([]byte, error) {
+	return wb.list.Marshal()
+}
+
+// UnmarshalWriteBatch 解码Marshal的结果
+func UnmarshalWriteBatch(data []byte) (*WriteBatch, error) {
+	wb := &WriteBatch{}
+	if err := wb.list.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return wb, nil
+}
+
+// Write 通过批量写入的路径原子地提交wb, 整个批次使用同一个版本, 要么全部可见要么都不可见.
+// 超过MaxBatchCount或MaxBatchSize时返回utils.ErrTxnTooBig, 不写入任何数据
+func (db *DB) Write(wb *WriteBatch) error {
+	if db.isReplica() {
+		return utils.ErrReplicaReadOnly
+	}
+	entries := make([]*utils.Entry, 0, len(wb.list.Kv))
+	for _, kv := range wb.list.Kv {
+		if len(kv.Key) == 0 {
+			return utils.ErrEmptyKey
+		}
+		entries = append(entries, kvToEntry(kv))
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return db.batchSet(entries)
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatch(t *testing.T) {
+	clearDir()
+	wopt := *opt
+	wopt.ValueLogMaxEntries = 1000
+	wopt.MaxBatchCount = 100
+	db := Open(&wopt)
+	defer db.Close()
+
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key000"), []byte("old"))))
+	wb := NewWriteBatch()
+	for i := 1; i < 25; i++ {
+		wb.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	wb.Delete([]byte("key000"))
+	require.Equal(t, 25, wb.Len())
+
+	// 编码后在另一端还原
+	data, err := wb.Marshal()
+	require.NoError(t, err)
+	decoded, err := UnmarshalWriteBatch(data)
+	require.NoError(t, err)
+	require.NoError(t, db.Write(decoded))
+
+	_, err = db.Get([]byte("key000"))
+	require.Error(t, err)
+	for i := 1; i < 25; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%d", i), string(e.Value))
+	}
+
+	empty := NewWriteBatch()
+	empty.Set(nil, []byte("v"))
+	require.Equal(t, utils.ErrEmptyKey, db.Write(empty))
+}
+
+// TestWriteBatchTooBig 超过批量写入限制的批次整体被拒绝, 不会只写入一部分
+func TestWriteBatchTooBig(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	defer db.Close()
+
+	wb := NewWriteBatch()
+	for i := 0; i < int(opt.MaxBatchCount); i++ {
+		wb.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+	}
+	require.Equal(t, utils.ErrTxnTooBig, db.Write(wb))
+	for i := 0; i < int(opt.MaxBatchCount); i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+	}
+}
+
+func TestCloseWithoutWrites(t *testing.T) {
+	copt := *opt
+	copt.WorkDir = t.TempDir()
+	db := Open(&copt)
+	require.NoError(t, db.Close())
+	db = Open(&copt)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("value"))))
+	require.NoError(t, db.Close())
+}
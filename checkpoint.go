@@ -0,0 +1,80 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// Checkpoint 在dir下生成一份可以直接Open的数据库快照, dir必须不存在或为空
+// sst和写满的vlog文件使用硬链接, 快照时正在写入的vlog文件只拷贝到快照时的写入位置
+// 生成lsm快照期间会阻塞写入
+func (db *DB) Checkpoint(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(infos) > 0 {
+		return errors.Errorf("checkpoint dir %s is not empty", dir)
+	}
+	// 占住GC的令牌, 避免vlog文件在链接过程中被重写删除
+	// 必须先于writeLock获取, GC重写时会在持有令牌的情况下写入
+	db.vlog.garbageCh <- struct{}{}
+	defer func() { <-db.vlog.garbageCh }()
+
+	// lsm的快照与vlog的写入位置在writeLock内确定, 两者对应同一时刻, 之后的写入都不会出现在快照中
+	db.writeLock.Lock()
+	if err := db.lsm.Checkpoint(dir); err != nil {
+		db.writeLock.Unlock()
+		return err
+	}
+	db.vlog.filesLock.RLock()
+	maxFid, woffset := db.vlog.maxFid, db.vlog.woffset()
+	db.vlog.filesLock.RUnlock()
+	// 快照中的lsm包含head之前的全部数据, 打开快照时从head之后重放
+	db.RLock()
+	vhead := db.vhead
+	db.RUnlock()
+	db.writeLock.Unlock()
+	if vhead != nil && !vhead.IsZero() {
+		if err := writeHeadFile(dir, vhead); err != nil {
+			return err
+		}
+	}
+
+	// vlog在锁外链接或拷贝, 只保留记录的写入位置之前的数据
+	db.vlog.filesLock.RLock()
+	defer db.vlog.filesLock.RUnlock()
+	for _, fid := range db.vlog.sortedFids() {
+		if fid > maxFid {
+			break
+		}
+		size := int64(-1)
+		if fid == maxFid {
+			size = int64(woffset)
+		}
+		if err := utils.LinkOrCopy(db.vlog.fpath(fid), utils.VlogFilePath(dir, fid), size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
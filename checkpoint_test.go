@@ -0,0 +1,123 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	db := Open(&copt)
+	n := 200
+	for i := 0; i < n; i++ {
+		// 一半的value足够大, 会写入vlog
+		value := fmt.Sprintf("value%d", i)
+		if i%2 == 0 {
+			value = fmt.Sprintf("%0100d", i)
+		}
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte(value))))
+	}
+	require.NoError(t, db.Del([]byte("key001")))
+
+	dir := filepath.Join(t.TempDir(), "cp")
+	require.NoError(t, db.Checkpoint(dir))
+	ssts, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, ssts)
+	// 非空目录不能作为checkpoint目标
+	require.Error(t, db.Checkpoint(dir))
+	// checkpoint之后的写入不会出现在快照中
+	require.NoError(t, db.Set(utils.NewEntry([]byte("after"), []byte("x"))))
+	require.NoError(t, db.Close())
+
+	popt := copt
+	popt.WorkDir = dir
+	cp := Open(&popt)
+	defer cp.Close()
+	for i := 0; i < n; i++ {
+		e, err := cp.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if i == 1 {
+			require.Equal(t, utils.ErrKeyNotFound, err)
+			continue
+		}
+		require.NoError(t, err)
+		want := fmt.Sprintf("value%d", i)
+		if i%2 == 0 {
+			want = fmt.Sprintf("%0100d", i)
+		}
+		require.Equal(t, want, string(e.Value))
+	}
+	_, err = cp.Get([]byte("after"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+}
+
+// TestCheckpointConcurrentWrites checkpoint期间持续写入, 快照中的数据是写入顺序的一个前缀
+func TestCheckpointConcurrentWrites(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	db := Open(&copt)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%05d", i)) }
+	value := func(i int) []byte { return []byte(fmt.Sprintf("%0100d", i)) }
+
+	stop, done := make(chan struct{}), make(chan int)
+	go func() {
+		i := 0
+		for ; ; i++ {
+			select {
+			case <-stop:
+				done <- i
+				return
+			default:
+			}
+			if err := db.Set(utils.NewEntry(key(i), value(i))); err != nil {
+				t.Error(err)
+				<-stop
+				done <- i
+				return
+			}
+		}
+	}()
+	dir := filepath.Join(t.TempDir(), "cp")
+	require.NoError(t, db.Checkpoint(dir))
+	close(stop)
+	n := <-done
+	require.NoError(t, db.Close())
+
+	popt := copt
+	popt.WorkDir = dir
+	cp := Open(&popt)
+	defer cp.Close()
+	var found int
+	for ; found < n; found++ {
+		e, err := cp.Get(key(found))
+		if err == utils.ErrKeyNotFound {
+			break
+		}
+		require.NoError(t, err)
+		require.Equal(t, value(found), e.Value)
+	}
+	for i := found; i < n; i++ {
+		_, err := cp.Get(key(i))
+		require.Equal(t, utils.ErrKeyNotFound, err, "key %d", i)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// command 一条RESP命令, 参数个数不含命令名, maxArgs为-1表示不限制
+type command struct {
+	minArgs int
+	maxArgs int
+	pairs   bool // 参数必须成对出现, 如MSET
+	run     func(s *server, w respWriter, args [][]byte)
+}
+
+var commands = map[string]*command{
+	"ping":    {minArgs: 0, maxArgs: 1, run: cmdPing},
+	"echo":    {minArgs: 1, maxArgs: 1, run: cmdEcho},
+	"command": {minArgs: 0, maxArgs: -1, run: cmdCommand},
+	"select":  {minArgs: 1, maxArgs: 1, run: cmdSelect},
+	"get":     {minArgs: 1, maxArgs: 1, run: cmdGet},
+	"set":     {minArgs: 2, maxArgs: 4, run: cmdSet},
+	"del":     {minArgs: 1, maxArgs: -1, run: cmdDel},
+	"exists":  {minArgs: 1, maxArgs: -1, run: cmdExists},
+	"mget":    {minArgs: 1, maxArgs: -1, run: cmdMGet},
+	"mset":    {minArgs: 2, maxArgs: -1, pairs: true, run: cmdMSet},
+	"ttl":     {minArgs: 1, maxArgs: 1, run: cmdTTL},
+	"expire":  {minArgs: 2, maxArgs: 2, run: cmdExpire},
+	"scan":    {minArgs: 1, maxArgs: 5, run: cmdScan},
+	"info":    {minArgs: 0, maxArgs: 1, run: cmdInfo},
+}
+
+const scanDefaultCount = 10
+
+func cmdPing(s *server, w respWriter, args [][]byte) {
+	if len(args) == 1 {
+		w.bulk(args[0])
+		return
+	}
+	w.simple("PONG")
+}
+
+func cmdEcho(s *server, w respWriter, args [][]byte) {
+	w.bulk(args[0])
+}
+
+// cmdCommand redis-cli连接时会发送COMMAND DOCS, 返回空列表即可
+func cmdCommand(s *server, w respWriter, args [][]byte) {
+	w.array(0)
+}
+
+// cmdSelect corekv只有一个库
+func cmdSelect(s *server, w respWriter, args [][]byte) {
+	if string(args[0]) != "0" {
+		w.err("ERR DB index is out of range")
+		return
+	}
+	w.simple("OK")
+}
+
+// checkKeys 内部前缀的key只能由引擎写入, 回复错误并返回false
+func checkKeys(w respWriter, keys ...[]byte) bool {
+	for _, key := range keys {
+		if corekv.IsInternalKey(key) {
+			w.err("ERR " + utils.ErrInternalKey.Error())
+			return false
+		}
+	}
+	return true
+}
+
+// get 读取key, 不存在时返回nil且不报错
+func (s *server) get(key []byte) (*utils.Entry, error) {
+	e, err := s.db.Get(key)
+	if err == utils.ErrKeyNotFound {
+		return nil, nil
+	}
+	return e, err
+}
+
+func cmdGet(s *server, w respWriter, args [][]byte) {
+	e, err := s.get(args[0])
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	if e == nil {
+		w.bulk(nil)
+		return
+	}
+	w.bulk(e.Value)
+}
+
+// cmdSet SET key value [EX seconds | PX milliseconds]
+// 过期时间的精度为秒, PX向上取整
+func cmdSet(s *server, w respWriter, args [][]byte) {
+	if !checkKeys(w, args[0]) {
+		return
+	}
+	e := utils.NewEntry(args[0], args[1])
+	if len(args) > 2 {
+		if len(args) != 4 {
+			w.err("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(string(args[3]), 10, 64)
+		if err != nil || n <= 0 {
+			w.err("ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToLower(string(args[2])) {
+		case "ex":
+			e.WithTTL(time.Duration(n) * time.Second)
+		case "px":
+			e.WithTTL(time.Duration((n+999)/1000) * time.Second)
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+	}
+	s.rmw.Lock()
+	defer s.rmw.Unlock()
+	if err := s.db.Set(e); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// cmdDel 返回实际删除的key的个数
+func cmdDel(s *server, w respWriter, args [][]byte) {
+	if !checkKeys(w, args...) {
+		return
+	}
+	s.rmw.Lock()
+	defer s.rmw.Unlock()
+	var n int64
+	for _, key := range args {
+		e, err := s.get(key)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if e == nil {
+			continue
+		}
+		if err := s.db.Del(key); err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		n++
+	}
+	w.int(n)
+}
+
+func cmdExists(s *server, w respWriter, args [][]byte) {
+	var n int64
+	for _, key := range args {
+		e, err := s.get(key)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if e != nil {
+			n++
+		}
+	}
+	w.int(n)
+}
+
+func cmdMGet(s *server, w respWriter, args [][]byte) {
+	values := make([][]byte, 0, len(args))
+	for _, key := range args {
+		e, err := s.get(key)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if e == nil {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, e.Value)
+	}
+	w.array(len(values))
+	for _, v := range values {
+		w.bulk(v)
+	}
+}
+
+// cmdMSet 所有kv作为一个WriteBatch写入
+func cmdMSet(s *server, w respWriter, args [][]byte) {
+	wb := corekv.NewWriteBatch()
+	for i := 0; i < len(args); i += 2 {
+		if !checkKeys(w, args[i]) {
+			return
+		}
+		wb.Set(args[i], args[i+1])
+	}
+	s.rmw.Lock()
+	defer s.rmw.Unlock()
+	if err := s.db.Write(wb); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// cmdTTL key不存在返回-2, 没有过期时间返回-1
+func cmdTTL(s *server, w respWriter, args [][]byte) {
+	e, err := s.get(args[0])
+	switch {
+	case err != nil:
+		w.err("ERR " + err.Error())
+	case e == nil:
+		w.int(-2)
+	case e.ExpiresAt == 0:
+		w.int(-1)
+	default:
+		ttl := int64(e.ExpiresAt) - time.Now().Unix()
+		if ttl < 0 {
+			ttl = 0
+		}
+		w.int(ttl)
+	}
+}
+
+// cmdExpire 重新写入value来修改过期时间, 不大于0的时间直接删除key
+func cmdExpire(s *server, w respWriter, args [][]byte) {
+	if !checkKeys(w, args[0]) {
+		return
+	}
+	seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		w.err("ERR value is not an integer or out of range")
+		return
+	}
+	s.rmw.Lock()
+	defer s.rmw.Unlock()
+	e, err := s.get(args[0])
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	if e == nil {
+		w.int(0)
+		return
+	}
+	if seconds <= 0 {
+		err = s.db.Del(args[0])
+	} else {
+		err = s.db.Set(utils.NewEntry(args[0], e.Value).WithTTL(time.Duration(seconds) * time.Second))
+	}
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	w.int(1)
+}
+
+// cmdScan SCAN cursor [MATCH pattern] [COUNT count]
+// 游标是下一个key的16进制编码, "0"表示开始或结束; MATCH只支持"prefix*"形式的前缀匹配
+func cmdScan(s *server, w respWriter, args [][]byte) {
+	var start []byte
+	if cursor := string(args[0]); cursor != "0" {
+		var err error
+		if start, err = hex.DecodeString(cursor); err != nil || len(start) == 0 {
+			w.err("ERR invalid cursor")
+			return
+		}
+	}
+	var (
+		prefix []byte
+		exact  bool
+		count  = scanDefaultCount
+	)
+	opts := args[1:]
+	if len(opts)%2 != 0 {
+		w.err("ERR syntax error")
+		return
+	}
+	for i := 0; i < len(opts); i += 2 {
+		switch strings.ToLower(string(opts[i])) {
+		case "match":
+			pattern := opts[i+1]
+			if bytes.HasSuffix(pattern, []byte("*")) {
+				pattern = pattern[:len(pattern)-1]
+			} else {
+				exact = true
+			}
+			if bytes.ContainsAny(pattern, "*?[\\") {
+				w.err("ERR only prefix patterns like 'prefix*' are supported")
+				return
+			}
+			prefix = pattern
+		case "count":
+			n, err := strconv.Atoi(string(opts[i+1]))
+			if err != nil || n <= 0 {
+				w.err("ERR value is not an integer or out of range")
+				return
+			}
+			count = n
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+	}
+	iter := s.db.NewPrefixIterator(prefix, start)
+	defer iter.Close()
+	var (
+		keys [][]byte
+		next []byte
+	)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := utils.ParseKey(iter.Item().Entry().Key)
+		if exact && !bytes.Equal(key, prefix) {
+			break
+		}
+		if len(keys) == count {
+			next = key
+			break
+		}
+		keys = append(keys, utils.SafeCopy(nil, key))
+	}
+	if err := iter.Err(); err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	w.array(2)
+	if next == nil {
+		w.bulk([]byte("0"))
+	} else {
+		w.bulk([]byte(hex.EncodeToString(next)))
+	}
+	w.array(len(keys))
+	for _, key := range keys {
+		w.bulk(key)
+	}
+}
+
+// cmdInfo 以redis INFO的格式输出DB的统计信息
+func cmdInfo(s *server, w respWriter, args [][]byte) {
+	var b strings.Builder
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(&b, "corekv_work_dir:%s\r\n", *workDir)
+	st := s.db.Info()
+	b.WriteString("\r\n# Stats\r\n")
+	fmt.Fprintf(&b, "entry_num:%d\r\n", st.EntryNum)
+	fmt.Fprintf(&b, "num_gets:%d\r\n", st.NumGets)
+	fmt.Fprintf(&b, "num_sets:%d\r\n", st.NumSets)
+	fmt.Fprintf(&b, "num_deletes:%d\r\n", st.NumDeletes)
+	fmt.Fprintf(&b, "bytes_read:%d\r\n", st.BytesRead)
+	fmt.Fprintf(&b, "bytes_written:%d\r\n", st.BytesWritten)
+	fmt.Fprintf(&b, "num_flushes:%d\r\n", st.NumFlushes)
+	fmt.Fprintf(&b, "num_compactions:%d\r\n", st.NumCompactions)
+	fmt.Fprintf(&b, "write_amp:%.2f\r\n", st.WriteAmp)
+	b.WriteString("\r\n# Memory\r\n")
+	fmt.Fprintf(&b, "memtable_size:%d\r\n", st.MemTableSize)
+	fmt.Fprintf(&b, "num_immutables:%d\r\n", st.NumImmutables)
+	b.WriteString("\r\n# Vlog\r\n")
+	fmt.Fprintf(&b, "vlog_size:%d\r\n", st.VlogSize)
+	fmt.Fprintf(&b, "vlog_discard:%d\r\n", st.VlogDiscard)
+	b.WriteString("\r\n# Levels\r\n")
+	for _, l := range st.Levels {
+		fmt.Fprintf(&b, "level%d:tables=%d,size=%d,stale=%d,keys=%d\r\n", l.Level, l.NumTables, l.Size, l.StaleSize, l.KeyCount)
+	}
+	w.bulk([]byte(b.String()))
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// corekv-server 通过redis的RESP协议对外提供corekv, 可以直接使用redis-cli等工具访问
+//
+//	corekv-server -dir ./data -addr 127.0.0.1:6380
+//	redis-cli -p 6380 set foo bar ex 60
+//
+// 指定 -grpc-addr 时同时提供 pb.KVService, 指定 -debug-addr 时在 /debug/corekv/ 下提供调试接口,
+// 在 /metrics 下提供Prometheus格式的指标
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/kvrpc"
+	"google.golang.org/grpc"
+)
+
+var (
+	addr             = flag.String("addr", "127.0.0.1:6380", "监听地址")
+	grpcAddr         = flag.String("grpc-addr", "", "grpc 服务的监听地址, 为空时不启动")
+	debugAddr        = flag.String("debug-addr", "", "http 调试接口的监听地址, 为空时不启动")
+	workDir          = flag.String("dir", "./work_test", "corekv 的工作目录")
+	valueThreshold   = flag.Int64("value-threshold", 0, "value 大于等于该值时写入 vlog")
+	memTableSize     = flag.Int64("memtable-size", 256<<10, "内存表大小(字节)")
+	sstMaxSize       = flag.Int64("sst-size", 1<<30, "sst 文件最大尺寸(字节)")
+	vlogFileSize     = flag.Int("vlog-file-size", 64<<20, "单个 vlog 文件大小(字节)")
+	vlogMaxEntries   = flag.Uint("vlog-max-entries", 1000000, "单个 vlog 文件最多写入的 entry 数量")
+	verifyValueCheck = flag.Bool("verify-checksum", false, "读取 vlog 时校验 checksum")
+)
+
+// options 根据命令行参数构建 corekv 的配置
+func options() *corekv.Options {
+	return &corekv.Options{
+		WorkDir:             *workDir,
+		ValueThreshold:      *valueThreshold,
+		MemTableSize:        *memTableSize,
+		SSTableMaxSz:        *sstMaxSize,
+		ValueLogFileSize:    *vlogFileSize,
+		ValueLogMaxEntries:  uint32(*vlogMaxEntries),
+		VerifyValueChecksum: *verifyValueCheck,
+		MaxBatchCount:       10000,
+		MaxBatchSize:        16 << 20,
+	}
+}
+
+func main() {
+	flag.Parse()
+	if err := os.MkdirAll(*workDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := corekv.Open(options())
+	s := newServer(db)
+
+	var gs *grpc.Server
+	if *grpcAddr != "" {
+		gln, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gs = grpc.NewServer()
+		kvrpc.NewServer(db).Register(gs)
+		log.Printf("grpc listening on %s", gln.Addr())
+		go func() {
+			if err := gs.Serve(gln); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	if *debugAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/corekv/", http.StripPrefix("/debug/corekv", db.DebugHandler()))
+		mux.Handle("/metrics", db.MetricsHandler())
+		go func() {
+			log.Print(http.ListenAndServe(*debugAddr, mux))
+		}()
+	}
+
+	// 收到信号后先断开所有连接, 再关闭db
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		s.close()
+	}()
+
+	log.Printf("corekv-server listening on %s, dir %s", ln.Addr(), *workDir)
+	if err := s.serve(ln); err != nil {
+		log.Print(err)
+	}
+	s.close()
+	if gs != nil {
+		gs.GracefulStop()
+	}
+	if err := db.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+)
+
+const (
+	maxBulkLen  = 512 << 20
+	maxArrayLen = 1 << 20
+	// maxLineLen 内联命令与长度行的上限, 与redis的内联命令上限相同
+	maxLineLen = 64 << 10
+)
+
+// errProtocol 客户端发送了无法解析的请求, 回复错误后关闭连接
+var errProtocol = errors.New("ERR Protocol error")
+
+// readCommand 读取一条命令, 支持RESP数组和telnet风格的内联命令
+func readCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// 内联命令, 空行直接忽略
+		return bytes.Fields(line), nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArrayLen {
+		return nil, errProtocol
+	}
+	args := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errProtocol
+		}
+		sz, err := strconv.Atoi(string(line[1:]))
+		if err != nil || sz < 0 || sz > maxBulkLen {
+			return nil, errProtocol
+		}
+		buf := make([]byte, sz+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[sz] != '\r' || buf[sz+1] != '\n' {
+			return nil, errProtocol
+		}
+		args = append(args, buf[:sz])
+	}
+	return args, nil
+}
+
+// readLine 读取一行并去掉结尾的\r\n, 超过maxLineLen还没有换行时返回协议错误
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(line)+len(frag) > maxLineLen {
+			return nil, errProtocol
+		}
+		line = append(line, frag...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// respWriter 回复的编码, 由调用方决定何时Flush
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w respWriter) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) err(s string) {
+	w.WriteByte('-')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) int(n int64) {
+	w.WriteByte(':')
+	w.WriteString(strconv.FormatInt(n, 10))
+	w.WriteString("\r\n")
+}
+
+// bulk b为nil时回复空值
+func (w respWriter) bulk(b []byte) {
+	if b == nil {
+		w.WriteString("$-1\r\n")
+		return
+	}
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(b)))
+	w.WriteString("\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w respWriter) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
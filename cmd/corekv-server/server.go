@@ -0,0 +1,152 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/hardcore-os/corekv"
+)
+
+// server 把RESP命令映射到DB上, 每个连接一个goroutine
+type server struct {
+	db *corekv.DB
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+	// rmw 串行化所有写命令, 先读后写的命令(如EXPIRE)执行期间不会有其他写入
+	rmw sync.Mutex
+}
+
+func newServer(db *corekv.DB) *server {
+	return &server{db: db, conns: make(map[net.Conn]struct{})}
+}
+
+// serve 接受连接直到close被调用
+func (s *server) serve(ln net.Listener) error {
+	s.mu.Lock()
+	s.ln = ln
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// close 停止监听并断开所有连接, 等待正在执行的命令结束
+func (s *server) close() {
+	s.mu.Lock()
+	s.closed = true
+	if s.ln != nil {
+		s.ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *server) handle(conn net.Conn) {
+	defer func() {
+		// 单个连接上的异常只断开该连接, 不影响整个进程
+		if r := recover(); r != nil {
+			log.Printf("panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack())
+		}
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := respWriter{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r)
+		if err == errProtocol {
+			w.err(err.Error())
+			w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("read from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.exec(w, args)
+		// 流水线中的命令都执行完再统一回复
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// exec 执行一条命令, 返回是否需要关闭连接
+func (s *server) exec(w respWriter, args [][]byte) bool {
+	name := strings.ToLower(string(args[0]))
+	if name == "quit" {
+		w.simple("OK")
+		return true
+	}
+	c, ok := commands[name]
+	if !ok {
+		w.err("ERR unknown command '" + string(args[0]) + "'")
+		return false
+	}
+	n := len(args) - 1
+	if n < c.minArgs || (c.maxArgs >= 0 && n > c.maxArgs) || (c.pairs && n%2 != 0) {
+		w.err("ERR wrong number of arguments for '" + name + "' command")
+		return false
+	}
+	c.run(s, w, args[1:])
+	return false
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/stretchr/testify/require"
+)
+
+// client 测试用的最小RESP客户端, 回复解析为string, int64, nil, []interface{}或error
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *client) do(args ...string) interface{} {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	require.NoError(c.t, err)
+	return c.read()
+}
+
+func (c *client) read() interface{} {
+	line, err := readLine(c.r)
+	require.NoError(c.t, err)
+	switch line[0] {
+	case '+':
+		return string(line[1:])
+	case '-':
+		return fmt.Errorf("%s", line[1:])
+	case ':':
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		require.NoError(c.t, err)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(string(line[1:]))
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		_, err := c.r.Read(buf)
+		require.NoError(c.t, err)
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(string(line[1:]))
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read()
+		}
+		return items
+	}
+	c.t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func startServer(t *testing.T) (*client, func()) {
+	opt := &corekv.Options{
+		WorkDir:            t.TempDir(),
+		SSTableMaxSz:       1 << 20,
+		MemTableSize:       1 << 20,
+		ValueLogFileSize:   1 << 20,
+		ValueLogMaxEntries: 1000,
+		MaxBatchCount:      100,
+		MaxBatchSize:       1 << 20,
+	}
+	db := corekv.Open(opt)
+	s := newServer(db)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.serve(ln)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	c := &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	return c, func() {
+		conn.Close()
+		s.close()
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+
+	require.Equal(t, "PONG", c.do("PING"))
+	require.Equal(t, "OK", c.do("SET", "foo", "bar"))
+	require.Equal(t, "bar", c.do("GET", "foo"))
+	require.Nil(t, c.do("GET", "missing"))
+	require.Equal(t, int64(-1), c.do("TTL", "foo"))
+	require.Equal(t, int64(-2), c.do("TTL", "missing"))
+
+	// 过期时间
+	require.Equal(t, "OK", c.do("SET", "tmp", "v", "EX", "100"))
+	ttl := c.do("TTL", "tmp").(int64)
+	require.True(t, ttl > 90 && ttl <= 100)
+	require.Equal(t, "OK", c.do("SET", "tmp2", "v", "PX", "1500"))
+	require.Equal(t, int64(2), c.do("TTL", "tmp2"))
+	require.Equal(t, int64(1), c.do("EXPIRE", "foo", "50"))
+	require.Equal(t, "bar", c.do("GET", "foo"))
+	require.Equal(t, int64(50), c.do("TTL", "foo"))
+	require.Equal(t, int64(0), c.do("EXPIRE", "missing", "50"))
+	require.Equal(t, int64(1), c.do("EXPIRE", "tmp2", "0"))
+	require.Nil(t, c.do("GET", "tmp2"))
+
+	require.Equal(t, "OK", c.do("MSET", "a", "1", "b", "2", "c", "3"))
+	require.Equal(t, []interface{}{"1", nil, "3"}, c.do("MGET", "a", "x", "c"))
+	require.Equal(t, int64(2), c.do("EXISTS", "a", "b", "x"))
+	require.Equal(t, int64(2), c.do("DEL", "a", "b", "x"))
+	require.Equal(t, int64(0), c.do("EXISTS", "a", "b"))
+
+	require.Error(t, c.do("MSET", "a").(error))
+	require.Error(t, c.do("NOSUCH").(error))
+	require.Error(t, c.do("SET", "k", "v", "EX", "-1").(error))
+
+	// 内部前缀的key只能由引擎写入
+	require.Error(t, c.do("SET", "!corekv!repl", "v").(error))
+	require.Error(t, c.do("MSET", "d", "4", "!corekv!x", "v").(error))
+	require.Nil(t, c.do("GET", "d"))
+	require.Error(t, c.do("DEL", "!corekv!repl").(error))
+	require.Error(t, c.do("EXPIRE", "!corekv!repl", "0").(error))
+	require.Contains(t, c.do("INFO").(string), "# Stats")
+}
+
+func TestServerScan(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+
+	for i := 0; i < 25; i++ {
+		require.Equal(t, "OK", c.do("SET", fmt.Sprintf("user:%02d", i), "v"))
+	}
+	require.Equal(t, "OK", c.do("SET", "other", "v"))
+	require.Equal(t, int64(1), c.do("DEL", "user:03"))
+
+	var keys []string
+	cursor := "0"
+	for {
+		reply := c.do("SCAN", cursor, "MATCH", "user:*", "COUNT", "10").([]interface{})
+		for _, k := range reply[1].([]interface{}) {
+			keys = append(keys, k.(string))
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			break
+		}
+	}
+	require.Len(t, keys, 24)
+	require.Equal(t, "user:00", keys[0])
+	require.NotContains(t, keys, "user:03")
+	require.Equal(t, "user:24", keys[23])
+
+	reply := c.do("SCAN", "0", "MATCH", "other").([]interface{})
+	require.Equal(t, []interface{}{"other"}, reply[1])
+	require.Error(t, c.do("SCAN", "0", "MATCH", "u?er*").(error))
+}
+
+func TestServerPipeline(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+
+	// 内联命令与流水线
+	_, err := c.conn.Write([]byte("SET k1 v1\r\nGET k1\r\nPING\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "OK", c.read())
+	require.Equal(t, "v1", c.read())
+	require.Equal(t, "PONG", c.read())
+	require.Equal(t, "OK", c.do("QUIT"))
+}
+
+func TestServerBadInput(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+	dial := func() *client {
+		conn, err := net.Dial("tcp", c.conn.RemoteAddr().String())
+		require.NoError(t, err)
+		return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	// 负数长度的数组是协议错误, 回复错误后断开连接
+	bad := dial()
+	defer bad.conn.Close()
+	_, err := bad.conn.Write([]byte("*-1\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, errProtocol.Error(), bad.read().(error).Error())
+	_, err = bad.r.ReadByte()
+	require.Error(t, err)
+
+	// 没有换行的超长行是协议错误, 多写一个默认大小的读缓冲让服务端读完全部数据后再断开
+	long := dial()
+	defer long.conn.Close()
+	_, err = long.conn.Write([]byte(strings.Repeat("a", maxLineLen+4096)))
+	require.NoError(t, err)
+	require.Equal(t, errProtocol.Error(), long.read().(error).Error())
+	_, err = long.r.ReadByte()
+	require.Error(t, err)
+
+	// 命令执行中的panic只断开当前连接
+	commands["panic"] = &command{minArgs: 0, maxArgs: 0, run: func(s *server, w respWriter, args [][]byte) {
+		panic("boom")
+	}}
+	defer delete(commands, "panic")
+	p := dial()
+	defer p.conn.Close()
+	_, err = p.conn.Write([]byte("PANIC\r\n"))
+	require.NoError(t, err)
+	_, err = p.r.ReadByte()
+	require.Error(t, err)
+
+	require.Equal(t, "PONG", c.do("PING"))
+	require.Equal(t, "PONG", dial().do("PING"))
+}
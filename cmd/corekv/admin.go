@@ -0,0 +1,152 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+func init() {
+	register(&command{name: "info", usage: "info [-tables]", run: runInfo})
+	register(&command{name: "compact", usage: "compact", run: runCompact})
+	register(&command{name: "vlog-gc", usage: "vlog-gc [-ratio r]", run: runVlogGC})
+	register(&command{name: "repair", usage: "repair [dir]", run: runRepair})
+}
+
+func runInfo(args []string) error {
+	fs := newFlagSet("info")
+	showTables := fs.Bool("tables", false, "输出每个 sst 文件的详情")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDB(func(db *corekv.DB) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "LEVEL\tTABLES\tSIZE\tSTALE")
+		var tables, size int64
+		for _, l := range db.Levels() {
+			fmt.Fprintf(w, "L%d\t%d\t%s\t%s\n", l.Level, l.NumTables, humanize(l.Size), humanize(l.StaleSize))
+			tables += int64(l.NumTables)
+			size += l.Size
+		}
+		fmt.Fprintf(w, "total\t%d\t%s\t\n", tables, humanize(size))
+		w.Flush()
+
+		if *showTables {
+			fmt.Println()
+			w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tLEVEL\tSIZE\tKEYS\tMAX VERSION\tSTALE\tMIN KEY\tMAX KEY")
+			for _, l := range db.Levels() {
+				for _, t := range l.Tables {
+					fmt.Fprintf(w, "%05d\tL%d\t%s\t%d\t%d\t%s\t%s\t%s\n", t.ID, t.Level, humanize(t.Size),
+						t.KeyCount, t.MaxVersion, humanize(int64(t.StaleDataSize)),
+						printable(utils.ParseKey(t.MinKey)), printable(utils.ParseKey(t.MaxKey)))
+				}
+			}
+			w.Flush()
+		}
+
+		fmt.Println()
+		w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VLOG\tSIZE\tDISCARD")
+		var vsize int64
+		for _, f := range db.VlogFiles() {
+			fmt.Fprintf(w, "%05d.vlog\t%s\t%s\n", f.Fid, humanize(f.Size), humanize(f.Discard))
+			vsize += f.Size
+		}
+		fmt.Fprintf(w, "total\t%s\t\n", humanize(vsize))
+		return w.Flush()
+	})
+}
+
+func runCompact(args []string) error {
+	return withDB(func(db *corekv.DB) error {
+		var rounds int
+		// 持续压缩直到没有需要执行的压缩任务
+		for db.RunCompaction() {
+			rounds++
+		}
+		fmt.Printf("ran %d compaction(s)\n", rounds)
+		return nil
+	})
+}
+
+func runVlogGC(args []string) error {
+	fs := newFlagSet("vlog-gc")
+	ratio := fs.Float64("ratio", 0.5, "可回收数据的占比超过该值时才会重写 vlog 文件")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDB(func(db *corekv.DB) error {
+		var rounds int
+		for {
+			err := db.RunValueLogGC(*ratio)
+			if err == utils.ErrNoRewrite {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			rounds++
+		}
+		fmt.Printf("rewrote %d vlog file(s)\n", rounds)
+		return nil
+	})
+}
+
+func humanize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func runRepair(args []string) error {
+	if len(args) > 1 {
+		return errors.New("expected at most one directory")
+	}
+	if len(args) == 1 {
+		*workDir = args[0]
+	}
+	if _, err := os.Stat(*workDir); err != nil {
+		return err
+	}
+	report, err := corekv.Repair(options())
+	if err != nil {
+		return err
+	}
+	for _, id := range report.Corrupted {
+		fmt.Printf("corrupted: %05d.sst moved aside\n", id)
+	}
+	for _, id := range report.SalvagedWals {
+		fmt.Printf("salvaged:  %05d.wal\n", id)
+	}
+	fmt.Printf("salvaged %d entries from %d wal(s)\n", report.SalvagedEntries, len(report.SalvagedWals))
+	for level, ids := range report.Levels {
+		fmt.Printf("L%d: %d table(s)\n", level, len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/hardcore-os/corekv"
+)
+
+func init() {
+	register(&command{name: "backup", usage: "backup [-since version] -o <file>", run: runBackup})
+	register(&command{name: "restore", usage: "restore -i <file>", run: runRestore})
+	register(&command{name: "checkpoint", usage: "checkpoint <dir>", run: runCheckpoint})
+}
+
+func runBackup(args []string) error {
+	fs := newFlagSet("backup")
+	out := fs.String("o", "", "备份文件路径")
+	since := fs.Uint64("since", 0, "只备份版本大于该值的数据, 用于增量备份")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("-o is required")
+	}
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var version uint64
+	if err := withDB(func(db *corekv.DB) (err error) {
+		version, err = db.Backup(f, *since)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	fmt.Printf("backed up to %s, max version %d\n", *out, version)
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := newFlagSet("restore")
+	in := fs.String("i", "", "备份文件路径")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return errors.New("-i is required")
+	}
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := withDB(func(db *corekv.DB) error {
+		return db.Load(f)
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("restored from %s\n", *in)
+	return nil
+}
+
+func runCheckpoint(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one dir")
+	}
+	dir := args[0]
+	if err := withDB(func(db *corekv.DB) error {
+		return db.Checkpoint(dir)
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("checkpoint created in %s\n", dir)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+func init() {
+	register(&command{name: "get", usage: "get <key>", run: runGet})
+	register(&command{name: "set", usage: "set [-ttl duration] <key> <value>", run: runSet})
+	register(&command{name: "del", usage: "del <key>", run: runDel})
+	register(&command{name: "scan", usage: "scan [-prefix p] [-limit n]", run: runScan})
+}
+
+func runGet(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one key")
+	}
+	return withDB(func(db *corekv.DB) error {
+		e, err := db.Get([]byte(args[0]))
+		if err != nil {
+			return err
+		}
+		fmt.Println(printable(e.Value))
+		if e.ExpiresAt > 0 {
+			fmt.Printf("expires at: %s\n", time.Unix(int64(e.ExpiresAt), 0).Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+func runSet(args []string) error {
+	fs := newFlagSet("set")
+	ttl := fs.Duration("ttl", 0, "过期时间，0 表示永不过期")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("expected <key> <value>")
+	}
+	e := utils.NewEntry([]byte(fs.Arg(0)), []byte(fs.Arg(1)))
+	if *ttl > 0 {
+		e.WithTTL(*ttl)
+	}
+	return withDB(func(db *corekv.DB) error {
+		return db.Set(e)
+	})
+}
+
+func runDel(args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected exactly one key")
+	}
+	return withDB(func(db *corekv.DB) error {
+		return db.Del([]byte(args[0]))
+	})
+}
+
+func runScan(args []string) error {
+	fs := newFlagSet("scan")
+	prefix := fs.String("prefix", "", "只输出以该前缀开头的 key")
+	limit := fs.Int("limit", 0, "最多输出的条数，0 表示不限制")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDB(func(db *corekv.DB) error {
+		iter := db.NewPrefixIterator([]byte(*prefix), nil)
+		defer iter.Close()
+		var n int
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			e := iter.Item().Entry()
+			key := utils.ParseKey(e.Key)
+			fmt.Printf("%s\t%s\n", printable(key), printable(e.Value))
+			n++
+			if *limit > 0 && n >= *limit {
+				break
+			}
+		}
+		return iter.Err()
+	})
+}
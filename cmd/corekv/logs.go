@@ -0,0 +1,99 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+func init() {
+	register(&command{name: "vlog", usage: "vlog dump [-q] <fid>", run: dispatch("vlog", map[string]func([]string) error{
+		"dump": runVlogDump,
+	})})
+	register(&command{name: "wal", usage: "wal dump [-q] <file.wal>", run: dispatch("wal", map[string]func([]string) error{
+		"dump": runWalDump,
+	})})
+}
+
+func runVlogDump(args []string) error {
+	fs := newFlagSet("vlog")
+	quiet := fs.Bool("q", false, "只输出汇总信息")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one vlog fid")
+	}
+	fid, err := strconv.ParseUint(fs.Arg(0), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid fid %q: %v", fs.Arg(0), err)
+	}
+	return dumpLog(*quiet, func(fn func(r *corekv.LogRecord) error) (*corekv.LogSummary, error) {
+		return corekv.DumpValueLog(*workDir, uint32(fid), fn)
+	})
+}
+
+func runWalDump(args []string) error {
+	fs := newFlagSet("wal")
+	quiet := fs.Bool("q", false, "只输出汇总信息")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one wal file")
+	}
+	return dumpLog(*quiet, func(fn func(r *corekv.LogRecord) error) (*corekv.LogSummary, error) {
+		return corekv.DumpWal(fs.Arg(0), fn)
+	})
+}
+
+// dumpLog 输出每一条记录以及第一个损坏的位置, 文件存在损坏时返回错误
+func dumpLog(quiet bool, dump func(fn func(r *corekv.LogRecord) error) (*corekv.LogSummary, error)) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var fn func(r *corekv.LogRecord) error
+	if !quiet {
+		fmt.Fprintln(w, "OFFSET\tLEN\tHEADER\tMETA\tEXPIRES AT\tVALUE SIZE\tCRC\tKEY\tVERSION")
+		fn = func(r *corekv.LogRecord) error {
+			_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%d\t%d\tok\t%s\t%d\n", r.Offset, r.Len, r.HeaderLen,
+				metaString(r.Meta), r.ExpiresAt, r.ValueLen, printable(utils.ParseKey(r.Key)), utils.ParseTs(r.Key))
+			return err
+		}
+	}
+	ls, err := dump(fn)
+	w.Flush()
+	if err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Println()
+	}
+	fmt.Printf("file size: %d\n", ls.Size)
+	fmt.Printf("records:   %d\n", ls.Records)
+	fmt.Printf("valid end: %d\n", ls.ValidEnd)
+	if ls.Corrupt != nil {
+		fmt.Printf("corrupt:   %v\n", ls.Corrupt)
+		return fmt.Errorf("first corrupt record at offset %d, %d byte(s) after it would be dropped on replay",
+			ls.ValidEnd, ls.Size-int64(ls.ValidEnd))
+	}
+	fmt.Printf("corrupt:   none\n")
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// corekv 是一个直接操作 corekv 工作目录的命令行工具
+//
+//	corekv -dir ./data set foo bar
+//	corekv -dir ./data get foo
+//	corekv -dir ./data scan -prefix foo -limit 10
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hardcore-os/corekv"
+)
+
+// command 子命令
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var (
+	commands = map[string]*command{}
+
+	workDir          = flag.String("dir", "./work_test", "corekv 的工作目录")
+	valueThreshold   = flag.Int64("value-threshold", 0, "value 大于等于该值时写入 vlog")
+	memTableSize     = flag.Int64("memtable-size", 256<<10, "内存表大小(字节)")
+	sstMaxSize       = flag.Int64("sst-size", 1<<30, "sst 文件最大尺寸(字节)")
+	vlogFileSize     = flag.Int("vlog-file-size", 64<<20, "单个 vlog 文件大小(字节)")
+	vlogMaxEntries   = flag.Uint("vlog-max-entries", 1000000, "单个 vlog 文件最多写入的 entry 数量")
+	verifyValueCheck = flag.Bool("verify-checksum", false, "读取 vlog 时校验 checksum")
+)
+
+func register(c *command) {
+	commands[c.name] = c
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "corekv: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if err := c.run(flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "corekv %s: %v\n", c.name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: corekv [flags] <command> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+// dispatch 分发 "sst dump" 这类二级子命令
+func dispatch(name string, subs map[string]func(args []string) error) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("expected a sub command, usage: corekv %s", commands[name].usage)
+		}
+		run, ok := subs[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown sub command %q, usage: corekv %s", args[0], commands[name].usage)
+		}
+		return run(args[1:])
+	}
+}
+
+// options 根据命令行参数构建 corekv 的配置
+func options() *corekv.Options {
+	return &corekv.Options{
+		WorkDir:             *workDir,
+		ValueThreshold:      *valueThreshold,
+		MemTableSize:        *memTableSize,
+		SSTableMaxSz:        *sstMaxSize,
+		ValueLogFileSize:    *vlogFileSize,
+		ValueLogMaxEntries:  uint32(*vlogMaxEntries),
+		VerifyValueChecksum: *verifyValueCheck,
+		MaxBatchCount:       10000,
+		MaxBatchSize:        16 << 20,
+	}
+}
+
+// withDB 打开 db 执行 fn，结束后关闭
+func withDB(fn func(db *corekv.DB) error) (err error) {
+	if _, err := os.Stat(*workDir); err != nil {
+		return err
+	}
+	db := corekv.Open(options())
+	defer func() {
+		if cerr := db.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return fn(db)
+}
+
+// newFlagSet 子命令的参数解析
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: corekv %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// printable 可打印的内容原样输出，否则输出16进制
+func printable(b []byte) string {
+	if !utf8.Valid(b) {
+		return fmt.Sprintf("0x%x", b)
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("0x%x", b)
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/stretchr/testify/require"
+)
+
+// run 在dir上执行子命令, 返回标准输出
+func run(t *testing.T, dir string, args ...string) (string, error) {
+	*workDir = dir
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	err = commands[args[0]].run(args[1:])
+	require.NoError(t, w.Close())
+	out, rerr := ioutil.ReadAll(r)
+	require.NoError(t, rerr)
+	return string(out), err
+}
+
+func mustRun(t *testing.T, dir string, args ...string) string {
+	out, err := run(t, dir, args...)
+	require.NoError(t, err, "%v", args)
+	return out
+}
+
+func TestKVCommands(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	mustRun(t, dir, "set", "foo2", "baz")
+	mustRun(t, dir, "set", "other", "x")
+	require.Equal(t, "bar\n", mustRun(t, dir, "get", "foo"))
+	require.Equal(t, "foo\tbar\nfoo2\tbaz\n", mustRun(t, dir, "scan", "-prefix", "foo"))
+	require.Equal(t, "foo\tbar\n", mustRun(t, dir, "scan", "-limit", "1"))
+
+	mustRun(t, dir, "del", "foo")
+	_, err := run(t, dir, "get", "foo")
+	require.Error(t, err)
+	require.Equal(t, "foo2\tbaz\nother\tx\n", mustRun(t, dir, "scan"))
+}
+
+func TestBackupRestoreCommands(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	mustRun(t, src, "set", "foo", "bar")
+	mustRun(t, src, "set", "hello", "world")
+	file := filepath.Join(t.TempDir(), "backup")
+	mustRun(t, src, "backup", "-o", file)
+	// 备份文件已存在时不覆盖
+	_, err := run(t, src, "backup", "-o", file)
+	require.Error(t, err)
+
+	mustRun(t, dst, "restore", "-i", file)
+	require.Equal(t, "foo\tbar\nhello\tworld\n", mustRun(t, dst, "scan"))
+}
+
+func TestCommandErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := run(t, filepath.Join(dir, "missing"), "get", "foo")
+	require.Error(t, err, "work dir does not exist")
+	_, err = run(t, dir, "set", "foo")
+	require.Error(t, err)
+	_, err = run(t, dir, "get")
+	require.Error(t, err)
+}
+
+func TestAdminCommands(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	mustRun(t, dir, "compact")
+	out := mustRun(t, dir, "info", "-tables")
+	require.Contains(t, out, "LEVEL")
+	require.Contains(t, out, "00000.vlog")
+	require.Equal(t, "bar\n", mustRun(t, dir, "get", "foo"))
+}
+
+func TestSSTCommands(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	*workDir = dir
+	require.NoError(t, withDB(func(db *corekv.DB) error { return db.Flush() }))
+	files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	out := mustRun(t, dir, "sst", "dump", "-kv", files[0])
+	require.Contains(t, out, "index checksum:  ok")
+	require.Contains(t, out, "min key:         foo")
+
+	_, err = run(t, dir, "sst")
+	require.Error(t, err)
+	_, err = run(t, dir, "sst", "unknown")
+	require.Error(t, err)
+	_, err = run(t, dir, "sst", "dump", filepath.Join(dir, "missing.sst"))
+	require.Error(t, err)
+}
+
+func TestLogCommands(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	mustRun(t, dir, "set", "hello", "world")
+	out := mustRun(t, dir, "vlog", "dump", "0")
+	require.Contains(t, out, "records:   2")
+	require.Contains(t, out, "corrupt:   none")
+
+	wals, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	require.NoError(t, err)
+	require.NotEmpty(t, wals)
+	out = mustRun(t, dir, "wal", "dump", "-q", wals[0])
+	require.Contains(t, out, "corrupt:   none")
+	// 尾部的垃圾数据被报告为第一个损坏的位置
+	f, err := os.OpenFile(wals[0], os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("garbage"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	out, err = run(t, dir, "wal", "dump", "-q", wals[0])
+	require.Error(t, err)
+	require.NotContains(t, out, "corrupt:   none")
+
+	_, err = run(t, dir, "vlog", "dump", "x")
+	require.Error(t, err)
+}
+
+func TestManifestCommands(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	*workDir = dir
+	require.NoError(t, withDB(func(db *corekv.DB) error { return db.Flush() }))
+	files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	out := mustRun(t, dir, "manifest", "show")
+	require.Contains(t, out, "CREATE 00001.sst L0")
+	require.Contains(t, out, fmt.Sprintf("L0: %d table(s) 00001", len(files)))
+	require.Equal(t, fmt.Sprintf("ok: %d table(s)\n", len(files)), mustRun(t, dir, "manifest", "check"))
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "00001.sst")))
+	out, err = run(t, dir, "manifest", "check")
+	require.Error(t, err)
+	require.Contains(t, out, "missing:  00001.sst (L0)")
+}
+
+func TestRepairCommand(t *testing.T) {
+	dir := t.TempDir()
+	mustRun(t, dir, "set", "foo", "bar")
+	*workDir = dir
+	require.NoError(t, withDB(func(db *corekv.DB) error { return db.Flush() }))
+	require.NoError(t, os.Remove(filepath.Join(dir, "MANIFEST")))
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	out := mustRun(t, dir, "repair", dir)
+	require.NotContains(t, out, "corrupted")
+	require.Equal(t, fmt.Sprintf("ok: %d table(s)\n", len(files)), mustRun(t, dir, "manifest", "check"))
+	require.Equal(t, "bar\n", mustRun(t, dir, "get", "foo"))
+
+	_, err = run(t, dir, "repair", dir, dir)
+	require.Error(t, err)
+}
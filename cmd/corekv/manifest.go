@@ -0,0 +1,101 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hardcore-os/corekv/file"
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+func init() {
+	register(&command{name: "manifest", usage: "manifest show|check", run: dispatch("manifest", map[string]func([]string) error{
+		"show":  runManifestShow,
+		"check": runManifestCheck,
+	})})
+}
+
+// replayManifest 只读地重放工作目录下的 MANIFEST
+func replayManifest(fn func(offset int64, cs *pb.ManifestChangeSet) error) (*file.Manifest, int64, error) {
+	f, err := os.Open(filepath.Join(*workDir, utils.ManifestFilename))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return file.WalkManifestFile(f, fn)
+}
+
+func runManifestShow(args []string) error {
+	var n int
+	m, end, err := replayManifest(func(offset int64, cs *pb.ManifestChangeSet) error {
+		fmt.Printf("#%d offset %d, %d change(s)\n", n, offset, len(cs.Changes))
+		for _, c := range cs.Changes {
+			switch c.Op {
+			case pb.ManifestChange_CREATE:
+				fmt.Printf("  CREATE %05d.sst L%d\n", c.Id, c.Level)
+			default:
+				fmt.Printf("  %s %05d.sst\n", c.Op, c.Id)
+			}
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\n%d change set(s), valid end %d, creations %d, deletions %d\n\n", n, end, m.Creations, m.Deletions)
+	for level, l := range m.Levels {
+		ids := sortedIDs(l.Tables)
+		fmt.Printf("L%d: %d table(s)", level, len(ids))
+		for _, id := range ids {
+			fmt.Printf(" %05d", id)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func runManifestCheck(args []string) error {
+	m, _, err := replayManifest(nil)
+	if err != nil {
+		return err
+	}
+	missing, orphaned := m.Diff(utils.LoadIDMap(*workDir))
+	for _, id := range missing {
+		fmt.Printf("missing:  %05d.sst (L%d) is referenced by MANIFEST but does not exist\n", id, m.Tables[id].Level)
+	}
+	for _, id := range orphaned {
+		fmt.Printf("orphaned: %05d.sst exists but is not referenced by MANIFEST\n", id)
+	}
+	if len(missing)+len(orphaned) > 0 {
+		return fmt.Errorf("%d missing and %d orphaned table(s)", len(missing), len(orphaned))
+	}
+	fmt.Printf("ok: %d table(s)\n", len(m.Tables))
+	return nil
+}
+
+func sortedIDs(set map[uint64]struct{}) []uint64 {
+	ids := make([]uint64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hardcore-os/corekv/lsm"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+func init() {
+	register(&command{name: "sst", usage: "sst dump [-kv] <file.sst>", run: dispatch("sst", map[string]func([]string) error{
+		"dump": runSSTDump,
+	})})
+}
+
+func runSSTDump(args []string) error {
+	fs := newFlagSet("sst")
+	showKV := fs.Bool("kv", false, "输出每一个 kv")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("expected exactly one sst file")
+	}
+
+	var fn func(e *utils.Entry) error
+	kw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if *showKV {
+		fmt.Fprintln(kw, "KEY\tVERSION\tMETA\tEXPIRES AT\tVALUE")
+		fn = func(e *utils.Entry) error {
+			_, err := fmt.Fprintf(kw, "%s\t%d\t%s\t%d\t%s\n", printable(utils.ParseKey(e.Key)),
+				utils.ParseTs(e.Key), metaString(e.Meta), e.ExpiresAt, printable(e.Value))
+			return err
+		}
+	}
+	ts, err := lsm.InspectTable(fs.Arg(0), fn)
+	if ts == nil {
+		return err
+	}
+	if *showKV {
+		kw.Flush()
+		fmt.Println()
+	}
+
+	fmt.Printf("file:            %s\n", fs.Arg(0))
+	fmt.Printf("size:            %s\n", humanize(ts.Size))
+	fmt.Printf("index length:    %d\n", ts.IndexLen)
+	fmt.Printf("index checksum:  %s\n", checksumStatus(ts.IndexChecksum))
+	fmt.Printf("key count:       %d\n", ts.KeyCount)
+	fmt.Printf("max version:     %d\n", ts.MaxVersion)
+	fmt.Printf("stale data size: %s\n", humanize(int64(ts.StaleDataSize)))
+	fmt.Printf("tombstones:      %d\n", ts.TombstoneCount)
+	fmt.Printf("ttl data size:   %s\n", humanize(int64(ts.TTLDataSize)))
+	if ts.MaxExpiresAt > 0 {
+		fmt.Printf("expires at:      %d - %d\n", ts.MinExpiresAt, ts.MaxExpiresAt)
+	}
+	if ts.OldestEntryTime > 0 {
+		fmt.Printf("oldest entry:    %s\n", time.Unix(int64(ts.OldestEntryTime), 0).Format(time.RFC3339))
+	}
+	if ts.BloomSize > 0 {
+		fmt.Printf("bloom filter:    %s, %d hashes, estimated fpr %.4f%%\n", humanize(int64(ts.BloomSize)), ts.BloomHashes, ts.BloomFPR*100)
+	} else {
+		fmt.Printf("bloom filter:    none\n")
+	}
+	fmt.Printf("min key:         %s\n", printable(utils.ParseKey(ts.MinKey)))
+	fmt.Printf("max key:         %s\n", printable(utils.ParseKey(ts.MaxKey)))
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BLOCK\tOFFSET\tLEN\tENTRIES\tCHECKSUM\tBASE KEY")
+	for i, b := range ts.Blocks {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%s\n", i, b.Offset, b.Len, b.NumEntries,
+			checksumStatus(b.Checksum), printable(utils.ParseKey(b.BaseKey)))
+	}
+	if werr := w.Flush(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func checksumStatus(err error) string {
+	if err != nil {
+		return "BAD (" + err.Error() + ")"
+	}
+	return "ok"
+}
+
+// metaString 解码 entry 的 meta 位
+func metaString(meta byte) string {
+	var bits []string
+	if meta&utils.BitDelete > 0 {
+		bits = append(bits, "delete")
+	}
+	if meta&utils.BitValuePointer > 0 {
+		bits = append(bits, "vptr")
+	}
+	if rest := meta &^ (utils.BitDelete | utils.BitValuePointer); rest > 0 {
+		bits = append(bits, fmt.Sprintf("0x%02x", rest))
+	}
+	if len(bits) == 0 {
+		return "-"
+	}
+	return strings.Join(bits, "|")
+}
@@ -0,0 +1,165 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func levelsSize(db *DB) (size int64, nonEmpty []int) {
+	for _, l := range db.Levels() {
+		size += l.Size
+		if l.NumTables > 0 {
+			nonEmpty = append(nonEmpty, l.Level)
+		}
+	}
+	return size, nonEmpty
+}
+
+func TestCompactRange(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	db := Open(&copt)
+	defer db.Close()
+
+	// 每个key写入三个版本, 小的memtable会产生很多互相重合的l0 sst
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d-%d", i, round)
+			require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+		}
+		require.NoError(t, db.Flush())
+	}
+	before, _ := levelsSize(db)
+
+	require.NoError(t, db.CompactRange(nil, nil))
+	after, nonEmpty := levelsSize(db)
+	last := len(db.Levels()) - 1
+	require.Equal(t, []int{last}, nonEmpty)
+	// 旧版本在合并时被丢弃
+	require.Less(t, after, before)
+	for i := 0; i < 100; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val%d-2", i), string(e.Value))
+	}
+
+	// 只合并部分区间, 区间外的sst留在原来的层
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d-3", i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+	}
+	require.NoError(t, db.CompactRange([]byte("key200"), []byte("key300")))
+	_, nonEmpty = levelsSize(db)
+	require.Equal(t, []int{0, last}, nonEmpty)
+
+	require.NoError(t, db.CompactRange([]byte("key010"), []byte("key020")))
+	for i := 0; i < 100; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val%d-3", i), string(e.Value))
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	clearDir()
+	fopt := *opt
+	fopt.ValueLogMaxEntries = 1000
+	db := Open(&fopt)
+	defer db.Close()
+
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 100; i++ {
+			key, val := fmt.Sprintf("key%03d", i), fmt.Sprintf("val%d-%d", i, round)
+			require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte(val))))
+		}
+		require.NoError(t, db.Flush())
+		if round == 1 {
+			// 让数据分布在多个层上
+			require.NoError(t, db.CompactRange(nil, []byte("key050")))
+		}
+	}
+
+	require.NoError(t, db.Flatten(4))
+	_, nonEmpty := levelsSize(db)
+	require.Equal(t, []int{len(db.Levels()) - 1}, nonEmpty)
+	for i := 0; i < 100; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val%d-3", i), string(e.Value))
+	}
+}
+
+// TestCompactRangeDropsTombstones 手动压缩到最后一层时丢弃墓碑, 不需要启用冷数据压缩
+func TestCompactRangeDropsTombstones(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	db := Open(&copt)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("val"))))
+	}
+	require.NoError(t, db.CompactRange(nil, nil))
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Del([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	require.NoError(t, db.CompactRange(nil, nil))
+	size, _ := levelsSize(db)
+	require.Zero(t, size)
+	require.NoError(t, db.Close())
+
+	db = Open(&copt)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.Equal(t, utils.ErrKeyNotFound, err, "key%03d", i)
+	}
+}
+
+// TestDroppedTombstoneAfterReopen 最后一层丢弃的墓碑与旧值在重新打开之后不会从vlog重放回来
+func TestDroppedTombstoneAfterReopen(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	copt.ValueThreshold = 64
+	copt.CompactionGarbageRatio = 0.1
+	db := Open(&copt)
+	val := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), val)))
+	}
+	require.NoError(t, db.Flatten(1))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Del([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	require.NoError(t, db.Flatten(1))
+	// 墓碑与被它遮住的旧值都已经被丢弃
+	size, _ := levelsSize(db)
+	require.Zero(t, size)
+	require.NoError(t, db.Close())
+
+	db = Open(&copt)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.Equal(t, utils.ErrKeyNotFound, err, "key%03d", i)
+	}
+}
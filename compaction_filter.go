@@ -0,0 +1,69 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+
+	"github.com/hardcore-os/corekv/lsm"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// CompactionDecision _
+type CompactionDecision = lsm.CompactionDecision
+
+const (
+	// CompactionKeep 原样保留
+	CompactionKeep = lsm.CompactionKeep
+	// CompactionDrop 删除这个key
+	CompactionDrop = lsm.CompactionDrop
+	// CompactionChangeValue 用过滤器返回的value替换原来的value
+	CompactionChangeValue = lsm.CompactionChangeValue
+)
+
+// CompactionFilter 通过Options.CompactionFilter配置, 压缩时对每个未过期且未删除的key调用,
+// 可以删除应用层已经不需要的key或者改写value. 在压缩协程中并发调用, 实现必须并发安全且不能调用DB的方法
+type CompactionFilter interface {
+	// Filter level为压缩的目标层, key与value为用户写入的内容, 不能修改
+	Filter(level int, key, value []byte) (decision CompactionDecision, newValue []byte)
+}
+
+// compactionFilter 把用户的过滤器适配到lsm, 值指针需要先从vlog读出value
+type compactionFilter struct {
+	db     *DB
+	filter CompactionFilter
+}
+
+func (f *compactionFilter) Filter(level int, e *utils.Entry) (CompactionDecision, []byte) {
+	key := utils.ParseKey(e.Key)
+	if bytes.HasPrefix(key, corekvPrefix) {
+		// 内部使用的key不交给用户过滤
+		return CompactionKeep, nil
+	}
+	value := e.Value
+	if utils.IsValuePtr(e) {
+		var vp utils.ValuePtr
+		vp.Decode(e.Value)
+		buf, cb, err := f.db.vlog.read(&vp)
+		defer utils.RunCallback(cb)
+		if err != nil {
+			// 读不到value时保守地保留
+			f.db.logger.Warn("compaction filter failed to read value log", "key", key, "err", err)
+			return CompactionKeep, nil
+		}
+		value = buf
+	}
+	return f.filter.Filter(level, key, value)
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// tenantFilter 删除被标记为已注销的租户数据, 并去掉value中废弃的字段
+type tenantFilter struct{}
+
+func (tenantFilter) Filter(level int, key, value []byte) (CompactionDecision, []byte) {
+	switch {
+	case bytes.HasPrefix(value, []byte("deleted")):
+		return CompactionDrop, nil
+	case bytes.HasSuffix(value, []byte(";deprecated")):
+		return CompactionChangeValue, bytes.TrimSuffix(value, []byte(";deprecated"))
+	}
+	return CompactionKeep, nil
+}
+
+func TestCompactionFilter(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	copt.CompactionFilter = tenantFilter{}
+	db := Open(&copt)
+	defer db.Close()
+
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("tenant1/key%03d", i)), []byte("active"))))
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("tenant2/key%03d", i)), []byte(fmt.Sprintf("val%d;deprecated", i)))))
+	}
+	// 旧版本先合并到最后一层, 过滤器删除新版本时需要遮住这些旧值
+	require.NoError(t, db.CompactRange(nil, nil))
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("tenant1/key%03d", i)), []byte("deleted"))))
+	}
+	require.NoError(t, db.CompactRange(nil, nil))
+
+	for i := 0; i < 50; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("tenant1/key%03d", i)))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+		e, err := db.Get([]byte(fmt.Sprintf("tenant2/key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val%d", i), string(e.Value))
+	}
+
+	// 过滤器删除的key可以重新写入
+	require.NoError(t, db.Set(utils.NewEntry([]byte("tenant1/key000"), []byte("back"))))
+	e, err := db.Get([]byte("tenant1/key000"))
+	require.NoError(t, err)
+	require.Equal(t, "back", string(e.Value))
+}
+
+// rewriteFilter 给每个value加上前缀
+type rewriteFilter struct{}
+
+func (rewriteFilter) Filter(level int, key, value []byte) (CompactionDecision, []byte) {
+	return CompactionChangeValue, append([]byte("v2:"), value...)
+}
+
+// TestCompactionFilterSkipsTombstones 改写value的过滤器不能让已删除的key重新出现
+func TestCompactionFilterSkipsTombstones(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	copt.CompactionFilter = rewriteFilter{}
+	db := Open(&copt)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("val"))))
+	}
+	require.NoError(t, db.CompactRange(nil, nil))
+	for i := 0; i < 20; i += 2 {
+		require.NoError(t, db.Del([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	require.NoError(t, db.CompactRange(nil, nil))
+
+	for i := 0; i < 20; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if i%2 == 0 {
+			require.Equal(t, utils.ErrKeyNotFound, err, "key%03d", i)
+			continue
+		}
+		require.NoError(t, err)
+		require.True(t, bytes.HasPrefix(e.Value, []byte("v2:")), string(e.Value))
+	}
+}
+
+// TestCompactionFilterDropAfterReopen 过滤器直接丢弃的key在重新打开之后不会从vlog重放回来
+func TestCompactionFilterDropAfterReopen(t *testing.T) {
+	clearDir()
+	copt := *opt
+	copt.ValueLogMaxEntries = 1000
+	copt.CompactionFilter = tenantFilter{}
+	db := Open(&copt)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("deleted"))))
+	}
+	// 没有更低层的旧值, 被过滤的key不保留墓碑
+	require.NoError(t, db.CompactRange(nil, nil))
+	require.NoError(t, db.Close())
+
+	db = Open(&copt)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.Equal(t, utils.ErrKeyNotFound, err, "key%03d", i)
+	}
+}
@@ -1,14 +1,14 @@
 package corekv
 
 import (
-	"expvar"
-	"fmt"
+	"bytes"
 	"math"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/hardcore-os/corekv/lsm"
+	"github.com/hardcore-os/corekv/pb"
 	"github.com/hardcore-os/corekv/utils"
 	"github.com/pkg/errors"
 )
@@ -19,7 +19,7 @@ type (
 		Set(data *utils.Entry) error
 		Get(key []byte) (*utils.Entry, error)
 		Del(key []byte) error
-		NewIterator(opt *utils.Options) utils.Iterator
+		NewIterator(opt *utils.Options) *DBIterator
 		Info() *Stats
 		Close() error
 	}
@@ -30,19 +30,34 @@ type (
 		opt         *Options
 		lsm         *lsm.LSM
 		vlog        *valueLog
-		stats       *Stats
+		stats       *stats
+		metrics     *dbMetrics
+		logger      utils.Logger
 		flushChan   chan flushTask // For flushing memtables.
 		writeCh     chan *request
 		blockWrites int32
 		vhead       *utils.ValuePtr
 		logRotates  int32
+		pub         *publisher
+		repl        *replLog
+		replica     int32 // follower模式下拒绝客户端写入
+		// writeLock 串行化写入lsm与提交, 复制日志与订阅者看到的顺序与lsm中的一致
+		writeLock sync.Mutex
+		// version 最近一次提交的版本, 在writeLock内分配, 写入lsm之后原子更新, 不大于它的版本都已经可读
+		version uint64
 	}
 )
 
 var (
-	head = []byte("!corekv!head") // For storing value offset for replay.
+	head         = []byte("!corekv!head") // For storing value offset for replay.
+	corekvPrefix = []byte("!corekv!")     // 内部key的前缀，迭代时对用户不可见
 )
 
+// IsInternalKey 判断key是否带有内部前缀, 对外提供写入的服务需要拒绝这类key
+func IsInternalKey(key []byte) bool {
+	return bytes.HasPrefix(key, corekvPrefix)
+}
+
 /**
 SSTableMaxSz:        1024,
 MemTableSize:        1024,
@@ -60,11 +75,38 @@ NumCompactors:       3,
 // TODO 这里是不是要上一个目录锁比较好，防止多个进程打开同一个目录?
 func Open(opt *Options) *DB {
 	c := utils.NewCloser()
-	db := &DB{opt: opt}
+	db := &DB{opt: opt, pub: newPublisher(), repl: newReplLog(opt.ReplicationLogSize), stats: newStats(opt)}
+	if db.logger = opt.Logger; db.logger == nil {
+		db.logger = utils.DefaultLogger()
+	}
 	// 初始化vlog结构
 	db.initVLog()
 	// 初始化LSM结构
-	db.lsm = lsm.NewLSM(&lsm.Options{
+	lopt := lsmOptions(opt)
+	lopt.DiscardStatsCh = &(db.vlog.lfDiscardStats.flushChan)
+	lopt.BeforeFlush = db.persistHead
+	if opt.CompactionFilter != nil {
+		lopt.CompactionFilter = &compactionFilter{db: db, filter: opt.CompactionFilter}
+	}
+	db.lsm = lsm.NewLSM(lopt)
+	db.metrics = newDBMetrics(db)
+	// 重放vlog 需要写入lsm，因此放在lsm初始化之后
+	db.replayVLog()
+	// 新的写入的版本大于已有的所有数据
+	db.version = db.lsm.MaxVersion()
+	// 启动 sstable 的合并压缩过程
+	db.lsm.StartCompacter()
+	// 准备vlog gc
+	c.Add(1)
+	db.writeCh = make(chan *request)
+	db.flushChan = make(chan flushTask, 16)
+	go db.doWrites(c)
+	return db
+}
+
+// lsmOptions 根据db的配置生成lsm的配置
+func lsmOptions(opt *Options) *lsm.Options {
+	return &lsm.Options{
 		WorkDir:             opt.WorkDir,
 		MemTableSize:        opt.MemTableSize,
 		SSTableMaxSz:        opt.SSTableMaxSz,
@@ -77,23 +119,29 @@ func Open(opt *Options) *DB {
 		NumLevelZeroTables:  15,
 		MaxLevelNum:         7,
 		NumCompactors:       1,
-		DiscardStatsCh:      &(db.vlog.lfDiscardStats.flushChan),
-	})
-	// 初始化统计信息
-	db.stats = newStats(opt)
-	// 启动 sstable 的合并压缩过程
-	go db.lsm.StartCompacter()
-	// 准备vlog gc
-	c.Add(1)
-	db.writeCh = make(chan *request)
-	db.flushChan = make(chan flushTask, 16)
-	go db.doWrites(c)
-	// 启动 info 统计过程
-	go db.stats.StartStats()
-	return db
+		EventListener:       opt.EventListener,
+		Logger:              opt.Logger,
+
+		NumLevelZeroTablesSlowdown: opt.NumLevelZeroTablesSlowdown,
+		NumLevelZeroTablesStall:    opt.NumLevelZeroTablesStall,
+		CompactionStyle:            opt.CompactionStyle,
+		TieredOptions:              opt.TieredOptions,
+		FIFOOptions:                opt.FIFOOptions,
+		InternalKeyPrefix:          corekvPrefix,
+		CompactionTableAge:         opt.CompactionTableAge,
+		CompactionGarbageRatio:     opt.CompactionGarbageRatio,
+		RateLimiter:                opt.RateLimiter,
+	}
+}
+
+// Repair 离线重建manifest, manifest丢失或损坏导致无法Open时使用, 调用期间不能打开该目录
+func Repair(opt *Options) (*lsm.RepairReport, error) {
+	return lsm.Repair(lsmOptions(opt))
 }
 
 func (db *DB) Close() error {
+	db.repl.close()
+	db.pub.close()
 	db.vlog.lfDiscardStats.closer.Close()
 	if err := db.lsm.Close(); err != nil {
 		return err
@@ -101,17 +149,15 @@ func (db *DB) Close() error {
 	if err := db.vlog.close(); err != nil {
 		return err
 	}
-	if err := db.stats.close(); err != nil {
-		return err
-	}
 	return nil
 }
 
 func (db *DB) Del(key []byte) error {
-	// 写入一个值为nil的entry 作为墓碑消息实现删除
+	// 写入一个带有BitDelete标记的entry 作为墓碑消息实现删除
 	return db.Set(&utils.Entry{
 		Key:       key,
 		Value:     nil,
+		Meta:      utils.BitDelete,
 		ExpiresAt: 0,
 	})
 }
@@ -119,13 +165,28 @@ func (db *DB) Set(data *utils.Entry) error {
 	if data == nil || len(data.Key) == 0 {
 		return utils.ErrEmptyKey
 	}
+	if db.isReplica() {
+		return utils.ErrReplicaReadOnly
+	}
+	defer observeSince(db.metrics.setLatency, time.Now())
 	// 做一些必要性的检查
 	// 如果value 大于一个阈值 则创建值指针，并将其写入vlog中
 	var (
 		vp  *utils.ValuePtr
 		err error
 	)
-	data.Key = utils.KeyWithTs(data.Key, math.MaxUint32)
+	db.throttleWrites(1)
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	version := db.version + 1
+	defer atomic.StoreUint64(&db.version, version)
+	data.Key = utils.KeyWithTs(data.Key, version)
+	// 订阅者需要看到原始的value, 在替换为值指针之前拷贝
+	var kvs []*pb.KV
+	if db.needCommitKVs() {
+		kvs = entriesToKVs([]*utils.Entry{data})
+	}
+	counts := countWrites([]*utils.Entry{data})
 	// 如果value不应该直接写入LSM 则先写入 vlog文件，这时必须保证vlog具有重放功能
 	// 以便于崩溃后恢复数据
 	if !db.shouldWriteValueToLSM(data) {
@@ -135,7 +196,17 @@ func (db *DB) Set(data *utils.Entry) error {
 		data.Meta |= utils.BitValuePointer
 		data.Value = vp.Encode()
 	}
-	return db.lsm.Set(data)
+	if err = db.lsm.Set(data); err != nil {
+		return err
+	}
+	if vp != nil {
+		db.Lock()
+		db.updateHead([]*utils.ValuePtr{vp})
+		db.Unlock()
+	}
+	db.stats.recordWrites(counts)
+	db.commit(kvs)
+	return nil
 }
 func (db *DB) Get(key []byte) (*utils.Entry, error) {
 	if len(key) == 0 {
@@ -145,13 +216,20 @@ func (db *DB) Get(key []byte) (*utils.Entry, error) {
 		entry *utils.Entry
 		err   error
 	)
-	key = utils.KeyWithTs(key, math.MaxUint32)
+	var hit *utils.Entry
+	defer func(userKey []byte) { db.stats.recordGet(userKey, hit) }(key)
+	defer observeSince(db.metrics.getLatency, time.Now())
+	key = utils.KeyWithTs(key, math.MaxUint64)
 	// 从LSM中查询entry，这时不确定entry是不是值指针
 	if entry, err = db.lsm.Get(key); err != nil {
 		return entry, err
 	}
+	// 墓碑与过期的key不需要读取vlog
+	if entry.IsDeletedOrExpired() {
+		return nil, utils.ErrKeyNotFound
+	}
 	// 检查从lsm拿到的value是否是value ptr,是则从vlog中拿值
-	if entry != nil && utils.IsValuePtr(entry) {
+	if utils.IsValuePtr(entry) {
 		var vp utils.ValuePtr
 		vp.Decode(entry.Value)
 		result, cb, err := db.vlog.read(&vp)
@@ -161,57 +239,55 @@ func (db *DB) Get(key []byte) (*utils.Entry, error) {
 		}
 		entry.Value = utils.SafeCopy(nil, result)
 	}
-
-	if isDeletedOrExpired(entry) {
-		return nil, utils.ErrKeyNotFound
-	}
+	hit = entry
 	return entry, nil
 }
 
-// 判断是否过期 是可删除
-func isDeletedOrExpired(e *utils.Entry) bool {
-	if e.Value == nil {
-		return true
+// RunValueLogGC triggers a value log garbage collection.
+func (db *DB) RunValueLogGC(discardRatio float64) error {
+	if discardRatio >= 1.0 || discardRatio <= 0.0 {
+		return utils.ErrInvalidRequest
 	}
-	if e.ExpiresAt == 0 {
-		return false
+	// 只回收持久化的head之前的vlog文件, 它们已经全部写入lsm
+	vp, err := db.getHead()
+	if err != nil {
+		return errors.Wrap(err, "Retrieving vlog head")
 	}
 
-	return e.ExpiresAt <= uint64(time.Now().Unix())
+	// Pick a log file and run GC
+	return db.vlog.runGC(discardRatio, vp)
 }
 
-func (db *DB) Info() *Stats {
-	// 读取stats结构，打包数据并返回
-	return db.stats
+// RunCompaction 立即触发一轮sst压缩，返回是否有压缩任务被执行
+func (db *DB) RunCompaction() bool {
+	return db.lsm.TriggerCompact()
 }
 
-// RunValueLogGC triggers a value log garbage collection.
-func (db *DB) RunValueLogGC(discardRatio float64) error {
-	if discardRatio >= 1.0 || discardRatio <= 0.0 {
-		return utils.ErrInvalidRequest
-	}
-	// Find head on disk
-	headKey := utils.KeyWithTs(head, math.MaxUint64)
-	val, err := db.lsm.Get(headKey)
-	if err != nil {
-		if err == utils.ErrKeyNotFound {
-			val = &utils.Entry{
-				Key:   headKey,
-				Value: []byte{},
-			}
-		} else {
-			return errors.Wrap(err, "Retrieving head from on-disk LSM")
-		}
+// CompactRange 将内存表刷盘后, 把与[start, end]重合的sst逐层合并到最后一层, nil表示不限制,
+// 合并会丢弃被覆盖的旧版本, 合并到最后一层时丢弃墓碑与过期的数据, 可以在批量删除后调用以回收磁盘空间, 阻塞直到合并完成
+func (db *DB) CompactRange(start, end []byte) error {
+	if err := db.lsm.Flush(); err != nil {
+		return err
 	}
+	return db.lsm.CompactRange(start, end)
+}
 
-	// 内部key head 一定是value ptr 不需要检查内容
-	var head utils.ValuePtr
-	if len(val.Value) > 0 {
-		head.Decode(val.Value)
+// Flatten 将内存表刷盘后把所有sst合并到最后一层, workers为并发合并的协程数, 阻塞直到合并完成
+func (db *DB) Flatten(workers int) error {
+	if err := db.lsm.Flush(); err != nil {
+		return err
 	}
+	return db.lsm.Flatten(workers)
+}
 
-	// Pick a log file and run GC
-	return db.vlog.runGC(discardRatio, &head)
+// Flush 将内存表中的数据刷到L0
+func (db *DB) Flush() error {
+	return db.lsm.Flush()
+}
+
+// Levels 返回lsm每一层的sst分布
+func (db *DB) Levels() []lsm.LevelInfo {
+	return db.lsm.LevelsInfo()
 }
 
 func (db *DB) shouldWriteValueToLSM(e *utils.Entry) bool {
@@ -257,14 +333,12 @@ func (db *DB) doWrites(lc *utils.Closer) {
 
 	writeRequests := func(reqs []*request) {
 		if err := db.writeRequests(reqs); err != nil {
-			utils.Err(fmt.Errorf("writeRequests: %v", err))
+			db.logger.Error("failed to write requests", "err", err)
+			db.listener().OnBackgroundError("write", err)
 		}
 		<-pendingCh
 	}
 
-	// This variable tracks the number of pending writes.
-	reqLen := new(expvar.Int)
-
 	reqs := make([]*request, 0, 10)
 	for {
 		var r *request
@@ -276,10 +350,17 @@ func (db *DB) doWrites(lc *utils.Closer) {
 
 		for {
 			reqs = append(reqs, r)
-			reqLen.Set(int64(len(reqs)))
+			atomic.StoreInt64(&db.metrics.pendingWrites, int64(len(reqs)))
 
 			if len(reqs) >= 3*utils.KVWriteChCapacity {
+				db.metrics.writeStalls.Inc()
+				stallStart := time.Now()
 				pendingCh <- struct{}{} // blocking.
+				db.listener().OnWriteStall(WriteStallInfo{
+					Reason:          "pending writes",
+					PendingRequests: len(reqs),
+					Duration:        time.Since(stallStart),
+				})
 				goto writeCase
 			}
 
@@ -310,7 +391,7 @@ func (db *DB) doWrites(lc *utils.Closer) {
 	writeCase:
 		go writeRequests(reqs)
 		reqs = make([]*request, 0, 10)
-		reqLen.Set(0)
+		atomic.StoreInt64(&db.metrics.pendingWrites, 0)
 	}
 }
 
@@ -319,6 +400,9 @@ func (db *DB) writeRequests(reqs []*request) error {
 	if len(reqs) == 0 {
 		return nil
 	}
+	db.throttleWrites(len(reqs))
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
 
 	done := func(err error) {
 		for _, r := range reqs {
@@ -326,25 +410,45 @@ func (db *DB) writeRequests(reqs []*request) error {
 			r.Wg.Done()
 		}
 	}
+	// 每个请求分配一个提交版本, 写入vlog之前替换版本为0的key; 已带版本的key(如vlog gc重写)保持原版本
+	versions := make([]uint64, len(reqs))
+	version := db.version
+	for i, b := range reqs {
+		if len(b.Entries) == 0 {
+			continue
+		}
+		version++
+		versions[i] = version
+		for _, e := range b.Entries {
+			if utils.ParseTs(e.Key) == 0 {
+				e.Key = utils.KeyWithTs(utils.ParseKey(e.Key), version)
+			}
+		}
+	}
+	// 失败时也推进版本, 已分配的版本不会被复用
+	defer atomic.StoreUint64(&db.version, version)
 	err := db.vlog.write(reqs)
 	if err != nil {
 		done(err)
 		return err
 	}
-	var count int
-	for _, b := range reqs {
+	for i, b := range reqs {
 		if len(b.Entries) == 0 {
 			continue
 		}
-		count += len(b.Entries)
-		if err != nil {
-			done(err)
-			return errors.Wrap(err, "writeRequests")
+		var kvs []*pb.KV
+		if db.needCommitKVs() {
+			kvs = entriesToKVs(b.Entries)
 		}
+		counts := countWrites(b.Entries)
 		if err := db.writeToLSM(b); err != nil {
 			done(err)
 			return errors.Wrap(err, "writeRequests")
 		}
+		atomic.StoreUint64(&db.version, versions[i])
+		db.stats.recordWrites(counts)
+		// 写入lsm之后才通知订阅者和follower
+		db.commit(kvs)
 		db.Lock()
 		db.updateHead(b.Ptrs)
 		db.Unlock()
@@ -352,6 +456,36 @@ func (db *DB) writeRequests(reqs []*request) error {
 	done(nil)
 	return nil
 }
+
+// throttleWrites l0积压时由lsm延迟或阻塞这一批写入, 并记录限流的次数与时长
+func (db *DB) throttleWrites(pending int) {
+	start := time.Now()
+	reason := db.lsm.ThrottleWrites()
+	if reason == "" {
+		return
+	}
+	db.metrics.writeStalls.Inc()
+	db.listener().OnWriteStall(WriteStallInfo{
+		Reason:          reason,
+		PendingRequests: pending,
+		Duration:        time.Since(start),
+	})
+}
+
+// needCommitKVs 有订阅者或follower时, 需要在写入lsm之前拷贝出原始的kv
+func (db *DB) needCommitKVs() bool {
+	return db.pub.hasSubscribers() || db.repl.enabled()
+}
+
+// commit 将已经写入lsm的批次按提交顺序交给复制日志和订阅者, 调用方需要持有writeLock
+func (db *DB) commit(kvs []*pb.KV) {
+	if len(kvs) == 0 {
+		return
+	}
+	db.repl.append(kvs)
+	db.pub.send(kvs)
+}
+
 func (db *DB) writeToLSM(b *request) error {
 	if len(b.Ptrs) != len(b.Entries) {
 		return errors.Errorf("Ptrs and Entries don't match: %+v", b)
@@ -401,7 +535,7 @@ func (db *DB) pushHead(ft flushTask) error {
 		return errors.New("Head should not be zero")
 	}
 
-	fmt.Printf("Storing value log head: %+v\n", ft.vptr)
+	db.logger.Debug("storing value log head", "fid", ft.vptr.Fid, "offset", ft.vptr.Offset, "len", ft.vptr.Len)
 	val := ft.vptr.Encode()
 
 	// Pick the max commit ts, so in case of crash, our read ts would be higher than all the
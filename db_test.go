@@ -15,11 +15,19 @@
 package corekv
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAPI(t *testing.T) {
@@ -80,3 +88,215 @@ func TestAPI(t *testing.T) {
 	}
 
 }
+
+// TestIteratorDoubleClose 重复关闭迭代器不会释放仍在使用的内存表
+func TestIteratorDoubleClose(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	defer db.Close()
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("value"))))
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	require.NoError(t, iter.Close())
+	require.NoError(t, iter.Close())
+
+	require.NoError(t, db.Flush())
+	e, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), e.Value)
+}
+
+func TestOptionsLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lopt := *opt
+	lopt.WorkDir = t.TempDir()
+	lopt.ValueLogMaxEntries = 1000
+	lopt.Logger = utils.NewLogger(&buf, utils.LogDebug)
+	db := Open(&lopt)
+	require.NoError(t, db.Set(utils.NewEntry([]byte("key"), []byte("value"))))
+	require.NoError(t, db.Close())
+
+	// 重新打开时会重放vlog
+	db = Open(&lopt)
+	require.NoError(t, db.Close())
+	require.True(t, strings.Contains(buf.String(), "INFO replaying value log fid=0"), buf.String())
+}
+
+// TestIteratorOrder 数据分布在内存表与多层sst中时, 升序与降序遍历都按key有序且每个key只出现一次
+func TestIteratorOrder(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	defer func() { _ = db.Close() }()
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < 300; i++ {
+		require.NoError(t, db.Set(utils.NewEntry(key(i), []byte("old"))))
+	}
+	require.NoError(t, db.Flatten(1))
+	for i := 0; i < 300; i += 3 {
+		require.NoError(t, db.Set(utils.NewEntry(key(i), []byte("new"))))
+	}
+
+	collect := func(it utils.Iterator) (keys []string) {
+		defer func() { _ = it.Close() }()
+		for ; it.Valid(); it.Next() {
+			e := it.Item().Entry()
+			k := string(utils.ParseKey(e.Key))
+			var i int
+			fmt.Sscanf(k, "key%d", &i)
+			want := "old"
+			if i%3 == 0 {
+				want = "new"
+			}
+			require.Equal(t, want, string(e.Value), k)
+			keys = append(keys, k)
+		}
+		return keys
+	}
+	asc := db.NewIterator(&utils.Options{IsAsc: true})
+	asc.Rewind()
+	keys := collect(asc)
+	require.Len(t, keys, 300)
+	require.True(t, sort.StringsAreSorted(keys))
+
+	desc := db.NewIterator(&utils.Options{IsAsc: false})
+	desc.Rewind()
+	keys = collect(desc)
+	require.Len(t, keys, 300)
+	require.True(t, sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] > keys[j] }))
+
+	asc = db.NewIterator(&utils.Options{IsAsc: true})
+	asc.Seek(utils.KeyWithTs(key(150), math.MaxUint64))
+	require.Equal(t, []string{"key150", "key151"}, collect(asc)[:2])
+	desc = db.NewIterator(&utils.Options{IsAsc: false})
+	desc.Seek(utils.KeyWithTs(key(150), math.MaxUint64))
+	require.Equal(t, []string{"key150", "key149"}, collect(desc)[:2])
+}
+
+func TestPrefixIterator(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	defer func() { _ = db.Close() }()
+	for _, k := range []string{"a1", "b1", "b2", "b3", "c1"} {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(k), []byte("old"))))
+	}
+	require.NoError(t, db.Set(utils.NewEntry([]byte("b2"), []byte("new"))))
+	require.NoError(t, db.Del([]byte("b3")))
+
+	scan := func(prefix, start string) (kvs []string) {
+		it := db.NewPrefixIterator([]byte(prefix), []byte(start))
+		defer func() { _ = it.Close() }()
+		for it.Rewind(); it.Valid(); it.Next() {
+			e := it.Item().Entry()
+			kvs = append(kvs, string(utils.ParseKey(e.Key))+"="+string(e.Value))
+		}
+		return kvs
+	}
+	require.Equal(t, []string{"b1=old", "b2=new"}, scan("b", ""))
+	require.Equal(t, []string{"b2=new"}, scan("b", "b2"))
+	require.Equal(t, []string{"b1=old", "b2=new"}, scan("b", "a"))
+	require.Empty(t, scan("b", "c"))
+	require.Equal(t, []string{"a1=old", "b1=old", "b2=new", "c1=old"}, scan("", ""))
+}
+
+// TestTombstoneMeta 删除写入的墓碑带有BitDelete标记, value是否写入vlog都不影响读取, 空value是合法的值
+func TestTombstoneMeta(t *testing.T) {
+	for _, threshold := range []int64{0, 64} {
+		topt := *opt
+		topt.WorkDir = t.TempDir()
+		topt.ValueThreshold = threshold
+		db := Open(&topt)
+		require.NoError(t, db.Set(utils.NewEntry([]byte("empty"), []byte{})))
+		require.NoError(t, db.Set(utils.NewEntry([]byte("deleted"), []byte("value"))))
+		require.NoError(t, db.Del([]byte("deleted")))
+
+		e, err := db.Get([]byte("empty"))
+		require.NoError(t, err)
+		require.Empty(t, e.Value)
+		_, err = db.Get([]byte("deleted"))
+		require.Equal(t, utils.ErrKeyNotFound, err)
+
+		var keys []string
+		iter := db.NewIterator(&utils.Options{IsAsc: true})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			keys = append(keys, string(utils.ParseKey(iter.Item().Entry().Key)))
+		}
+		require.NoError(t, iter.Err())
+		require.NoError(t, iter.Close())
+		require.Equal(t, []string{"empty"}, keys)
+		require.NoError(t, db.Close())
+	}
+}
+
+// TestIteratorReadError vlog中的value损坏时迭代器停止并通过Err返回错误, 备份失败而不是缺少数据
+func TestIteratorReadError(t *testing.T) {
+	iopt := *opt
+	iopt.WorkDir = t.TempDir()
+	iopt.VerifyValueChecksum = true
+	db := Open(&iopt)
+	defer func() { _ = db.Close() }()
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(k), []byte("value-"+k))))
+	}
+	// 破坏b的value的校验和
+	e, err := db.lsm.Get(utils.KeyWithTs([]byte("b"), math.MaxUint64))
+	require.NoError(t, err)
+	require.True(t, utils.IsValuePtr(e))
+	var vp utils.ValuePtr
+	vp.Decode(e.Value)
+	fd, err := os.OpenFile(db.vlog.filesMap[vp.Fid].FileName(), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = fd.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(vp.Offset+vp.Len-4))
+	require.NoError(t, err)
+	require.NoError(t, fd.Close())
+
+	var keys []string
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(utils.ParseKey(iter.Item().Entry().Key)))
+	}
+	require.Equal(t, []string{"a"}, keys)
+	require.True(t, errors.Is(iter.Err(), utils.ErrChecksumMismatch), "%v", iter.Err())
+	require.NoError(t, iter.Close())
+
+	var buf bytes.Buffer
+	_, err = db.Backup(&buf, 0)
+	require.Error(t, err)
+}
+
+// TestVersionSnapshot 迭代器只看到创建时已提交的版本, 重启后新的写入版本继续增长
+func TestVersionSnapshot(t *testing.T) {
+	vopt := *opt
+	vopt.WorkDir = t.TempDir()
+	db := Open(&vopt)
+	scan := func(it *DBIterator) (kvs []string) {
+		defer func() { _ = it.Close() }()
+		for it.Rewind(); it.Valid(); it.Next() {
+			e := it.Item().Entry()
+			kvs = append(kvs, string(utils.ParseKey(e.Key))+"="+string(e.Value))
+		}
+		require.NoError(t, it.Err())
+		return kvs
+	}
+	require.NoError(t, db.Set(utils.NewEntry([]byte("a"), []byte("v1"))))
+	require.NoError(t, db.Set(utils.NewEntry([]byte("b"), []byte("v1"))))
+	require.NoError(t, db.Flatten(1))
+	old := db.NewIterator(&utils.Options{IsAsc: true})
+	require.NoError(t, db.Set(utils.NewEntry([]byte("a"), []byte("v2"))))
+	require.NoError(t, db.Del([]byte("b")))
+	require.NoError(t, db.Set(utils.NewEntry([]byte("c"), []byte("v1"))))
+	require.Equal(t, []string{"a=v1", "b=v1"}, scan(old))
+	require.Equal(t, []string{"a=v2", "c=v1"}, scan(db.NewIterator(&utils.Options{IsAsc: true})))
+
+	version := atomic.LoadUint64(&db.version)
+	require.Equal(t, uint64(5), version)
+	require.NoError(t, db.Close())
+
+	db = Open(&vopt)
+	defer func() { _ = db.Close() }()
+	require.Equal(t, version, atomic.LoadUint64(&db.version))
+	require.Equal(t, []string{"a=v2", "c=v1"}, scan(db.NewIterator(&utils.Options{IsAsc: true})))
+	require.NoError(t, db.Set(utils.NewEntry([]byte("a"), []byte("v3"))))
+	e, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "v3", string(e.Value))
+	require.Equal(t, version+1, atomic.LoadUint64(&db.version))
+}
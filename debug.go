@@ -0,0 +1,224 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// debugEndpoints DebugHandler提供的接口, 修改状态的接口只接受POST
+var debugEndpoints = []struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+	Desc   string `json:"desc"`
+}{
+	{"/stats", http.MethodGet, "DB.Info的统计信息"},
+	{"/levels", http.MethodGet, "每一层的sst数量与大小"},
+	{"/tables", http.MethodGet, "所有sst的列表"},
+	{"/compaction", http.MethodGet, "正在进行的压缩"},
+	{"/vlog", http.MethodGet, "vlog文件及可回收的字节数"},
+	{"/cache", http.MethodGet, "缓存命中率"},
+	{"/flush", http.MethodPost, "将内存表刷到L0"},
+	{"/compact", http.MethodPost, "立即执行一轮压缩"},
+	{"/vlog/gc", http.MethodPost, "执行一次vlog gc, 参数ratio默认为0.5"},
+}
+
+// DebugHandler 返回以JSON输出内部状态的http.Handler, 路径相对于挂载点
+//
+//	http.Handle("/debug/corekv/", http.StripPrefix("/debug/corekv", db.DebugHandler()))
+func (db *DB) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, debugEndpoints)
+	})
+	mux.HandleFunc("/stats", getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, db.Info())
+	}))
+	mux.HandleFunc("/levels", getOnly(db.debugLevels))
+	mux.HandleFunc("/tables", getOnly(db.debugTables))
+	mux.HandleFunc("/compaction", getOnly(db.debugCompaction))
+	mux.HandleFunc("/vlog", getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, db.VlogFiles())
+	}))
+	mux.HandleFunc("/cache", getOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, db.lsm.CacheInfo())
+	}))
+	mux.HandleFunc("/flush", postOnly(db.debugFlush))
+	mux.HandleFunc("/compact", postOnly(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]bool{"compacted": db.RunCompaction()})
+	}))
+	mux.HandleFunc("/vlog/gc", postOnly(db.debugVlogGC))
+	return mux
+}
+
+type debugLevel struct {
+	Level     int   `json:"level"`
+	NumTables int   `json:"num_tables"`
+	Size      int64 `json:"size"`
+	StaleSize int64 `json:"stale_size"`
+}
+
+func (db *DB) debugLevels(w http.ResponseWriter, r *http.Request) {
+	var levels []debugLevel
+	for _, l := range db.Levels() {
+		levels = append(levels, debugLevel{Level: l.Level, NumTables: l.NumTables, Size: l.Size, StaleSize: l.StaleSize})
+	}
+	writeJSON(w, levels)
+}
+
+type debugTable struct {
+	ID            uint64 `json:"id"`
+	Level         int    `json:"level"`
+	Size          int64  `json:"size"`
+	KeyCount      uint32 `json:"key_count"`
+	MaxVersion    uint64 `json:"max_version"`
+	StaleDataSize uint32 `json:"stale_data_size"`
+	MinKey        string `json:"min_key"`
+	MaxKey        string `json:"max_key"`
+}
+
+func (db *DB) debugTables(w http.ResponseWriter, r *http.Request) {
+	tables := []debugTable{}
+	for _, l := range db.Levels() {
+		for _, t := range l.Tables {
+			tables = append(tables, debugTable{
+				ID:            t.ID,
+				Level:         t.Level,
+				Size:          t.Size,
+				KeyCount:      t.KeyCount,
+				MaxVersion:    t.MaxVersion,
+				StaleDataSize: t.StaleDataSize,
+				MinKey:        debugKey(t.MinKey),
+				MaxKey:        debugKey(t.MaxKey),
+			})
+		}
+	}
+	writeJSON(w, tables)
+}
+
+type debugRange struct {
+	Left  string `json:"left,omitempty"`
+	Right string `json:"right,omitempty"`
+	Inf   bool   `json:"inf,omitempty"`
+}
+
+type debugLevelCompaction struct {
+	Level   int          `json:"level"`
+	DelSize int64        `json:"del_size"`
+	Ranges  []debugRange `json:"ranges"`
+}
+
+func (db *DB) debugCompaction(w http.ResponseWriter, r *http.Request) {
+	st := db.lsm.CompactionState()
+	res := struct {
+		Tables []uint64               `json:"tables"`
+		Levels []debugLevelCompaction `json:"levels"`
+	}{Tables: st.Tables}
+	for _, l := range st.Levels {
+		lc := debugLevelCompaction{Level: l.Level, DelSize: l.DelSize, Ranges: []debugRange{}}
+		for _, kr := range l.Ranges {
+			lc.Ranges = append(lc.Ranges, debugRange{Left: debugKey(kr.Left), Right: debugKey(kr.Right), Inf: kr.Inf})
+		}
+		res.Levels = append(res.Levels, lc)
+	}
+	writeJSON(w, res)
+}
+
+func (db *DB) debugFlush(w http.ResponseWriter, r *http.Request) {
+	if err := db.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]bool{"flushed": true})
+}
+
+func (db *DB) debugVlogGC(w http.ResponseWriter, r *http.Request) {
+	ratio := 0.5
+	if s := r.FormValue("ratio"); s != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(s, 64); err != nil || ratio <= 0 || ratio >= 1 {
+			http.Error(w, "ratio must be in (0, 1)", http.StatusBadRequest)
+			return
+		}
+	}
+	switch err := db.RunValueLogGC(ratio); err {
+	case nil:
+		writeJSON(w, map[string]bool{"rewritten": true})
+	case utils.ErrNoRewrite:
+		writeJSON(w, map[string]bool{"rewritten": false})
+	case utils.ErrRejected:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func getOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func postOnly(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// debugKey 输出内部key中的用户key, 不可打印时输出16进制
+func debugKey(key []byte) string {
+	if len(key) > 8 {
+		key = utils.ParseKey(key)
+	}
+	if !utf8.Valid(key) {
+		return fmt.Sprintf("0x%x", key)
+	}
+	for _, r := range string(key) {
+		if !unicode.IsPrint(r) {
+			return fmt.Sprintf("0x%x", key)
+		}
+	}
+	return string(key)
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandler(t *testing.T) {
+	clearDir()
+	dopt := *opt
+	dopt.ValueLogMaxEntries = 1000
+	db := Open(&dopt)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))))
+	}
+
+	srv := httptest.NewServer(http.StripPrefix("/debug/corekv", db.DebugHandler()))
+	defer srv.Close()
+	call := func(method, path string, v interface{}) int {
+		req, err := http.NewRequest(method, srv.URL+"/debug/corekv"+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && v != nil {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/flush", nil))
+	var tables []debugTable
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "/tables", &tables))
+	require.NotEmpty(t, tables)
+	require.Equal(t, "key000", tables[0].MinKey)
+
+	var levels []debugLevel
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "/levels", &levels))
+	require.NotZero(t, levels[0].NumTables)
+
+	// 读取sst后缓存有访问记录
+	_, err := db.Get([]byte("key001"))
+	require.NoError(t, err)
+	var caches []map[string]interface{}
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "/cache", &caches))
+	require.Len(t, caches, 2)
+
+	var vlogs []VlogFileInfo
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "/vlog", &vlogs))
+	require.NotEmpty(t, vlogs)
+
+	var compaction map[string]interface{}
+	require.Equal(t, http.StatusOK, call(http.MethodGet, "/compaction", &compaction))
+	require.Contains(t, compaction, "levels")
+
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/compact", nil))
+	require.Equal(t, http.StatusOK, call(http.MethodPost, "/vlog/gc?ratio=0.9", nil))
+	require.Equal(t, http.StatusBadRequest, call(http.MethodPost, "/vlog/gc?ratio=2", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, call(http.MethodGet, "/flush", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, call(http.MethodPost, "/levels", nil))
+	require.Equal(t, http.StatusNotFound, call(http.MethodGet, "/nope", nil))
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"time"
+
+	"github.com/hardcore-os/corekv/lsm"
+)
+
+// EventListener 后台任务的回调, 通过Options.EventListener配置,
+// 在执行任务的协程中同步调用, 实现必须并发安全且尽快返回, 不能在回调中调用DB的方法
+type EventListener interface {
+	lsm.EventListener
+	OnValueLogGC(info ValueLogGCInfo)
+	OnWriteStall(info WriteStallInfo)
+}
+
+type (
+	// FlushInfo _
+	FlushInfo = lsm.FlushInfo
+	// CompactionInfo _
+	CompactionInfo = lsm.CompactionInfo
+	// TableInfo _
+	TableInfo = lsm.TableInfo
+)
+
+// ValueLogGCInfo 一次vlog文件的重写
+type ValueLogGCInfo struct {
+	Fid            uint32
+	MovedEntries   int   // 重新写入的entry个数
+	ReclaimedBytes int64 // 按文件大小减去重新写入的大小估算
+	Duration       time.Duration
+	Err            error
+}
+
+// WriteStallInfo 一次写入阻塞, 在阻塞结束后回调
+type WriteStallInfo struct {
+	// Reason 为"pending writes"、"l0 slowdown"或"l0 stall"
+	Reason          string
+	PendingRequests int
+	Duration        time.Duration
+}
+
+// BaseEventListener 所有回调都为空的实现, 可以嵌入到只关心部分事件的实现中
+type BaseEventListener struct {
+	lsm.BaseEventListener
+}
+
+// OnValueLogGC _
+func (BaseEventListener) OnValueLogGC(ValueLogGCInfo) {}
+
+// OnWriteStall _
+func (BaseEventListener) OnWriteStall(WriteStallInfo) {}
+
+// listener 没有配置EventListener时返回空实现
+func (db *DB) listener() EventListener {
+	if db.opt.EventListener == nil {
+		return BaseEventListener{}
+	}
+	return db.opt.EventListener
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// recordListener 记录收到的事件
+type recordListener struct {
+	BaseEventListener
+	sync.Mutex
+	events  []string
+	flushes []FlushInfo
+	created map[uint64]string
+}
+
+func (l *recordListener) record(event string) {
+	l.Lock()
+	defer l.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *recordListener) OnFlushBegin(info FlushInfo) { l.record("flush begin") }
+
+func (l *recordListener) OnFlushEnd(info FlushInfo) {
+	l.record("flush end")
+	l.Lock()
+	defer l.Unlock()
+	l.flushes = append(l.flushes, info)
+}
+
+func (l *recordListener) OnTableCreated(info TableInfo, reason string) {
+	l.Lock()
+	defer l.Unlock()
+	l.created[info.ID] = reason
+}
+
+func TestEventListener(t *testing.T) {
+	clearDir()
+	l := &recordListener{created: map[uint64]string{}}
+	eopt := *opt
+	eopt.ValueLogMaxEntries = 1000
+	eopt.MemTableSize = 1 << 20
+	eopt.EventListener = l
+	db := Open(&eopt)
+	defer db.Close()
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))))
+		}
+		require.NoError(t, db.Flush())
+	}
+	l.Lock()
+	defer l.Unlock()
+	require.Equal(t, []string{"flush begin", "flush end", "flush begin", "flush end"}, l.events)
+	for _, f := range l.flushes {
+		require.NoError(t, f.Err)
+		require.NotZero(t, f.MemTableSize)
+		require.Equal(t, 0, f.Table.Level)
+		require.Equal(t, "flush", l.created[f.Table.ID])
+		require.Equal(t, "key000", string(utils.ParseKey(f.Table.MinKey)))
+	}
+}
+
+type stallListener struct {
+	BaseEventListener
+	sync.Mutex
+	stalls []WriteStallInfo
+}
+
+func (l *stallListener) OnWriteStall(info WriteStallInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.stalls = append(l.stalls, info)
+}
+
+func (l *stallListener) count() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.stalls)
+}
+
+func TestWriteStallEvents(t *testing.T) {
+	clearDir()
+	l := &stallListener{}
+	sopt := *opt
+	sopt.ValueLogMaxEntries = 1000
+	sopt.NumLevelZeroTablesSlowdown = 15
+	sopt.NumLevelZeroTablesStall = 16
+	sopt.EventListener = l
+	db := Open(&sopt)
+	defer db.Close()
+
+	// 小的memtable让每隔几次写入就flush一次, l0很快达到限流阈值
+	for i := 0; i < 5000 && l.count() == 0; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%05d", i)), []byte("value"))))
+	}
+	l.Lock()
+	defer l.Unlock()
+	require.NotEmpty(t, l.stalls)
+	require.Contains(t, []string{"l0 slowdown", "l0 stall"}, l.stalls[0].Reason)
+	require.Equal(t, 1, l.stalls[0].PendingRequests)
+	require.EqualValues(t, len(l.stalls), db.metrics.writeStalls.Value())
+}
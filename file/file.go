@@ -14,7 +14,11 @@
 
 package file
 
-import "io"
+import (
+	"io"
+
+	"github.com/hardcore-os/corekv/utils"
+)
 
 // Options
 type Options struct {
@@ -24,6 +28,15 @@ type Options struct {
 	Path     string
 	Flag     int
 	MaxSz    int
+	// Logger 为nil时使用utils.DefaultLogger
+	Logger utils.Logger
+}
+
+func (opt *Options) logger() utils.Logger {
+	if opt.Logger == nil {
+		return utils.DefaultLogger()
+	}
+	return opt.Logger
 }
 
 type CoreFile interface {
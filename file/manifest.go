@@ -23,6 +23,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/hardcore-os/corekv/pb"
@@ -110,6 +112,11 @@ func OpenManifestFile(opt *Options) (*ManifestFile, error) {
 
 // ReplayManifestFile 对已经存在的manifest文件重新应用所有状态变更, 最后的多层sst排布到Manifest内存数据结构里面
 func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err error) {
+	return WalkManifestFile(fp, nil)
+}
+
+// WalkManifestFile 与ReplayManifestFile相同, 但在应用每个ManifestChangeSet之前按顺序回调fn, offset是该记录在文件中的起始位置
+func WalkManifestFile(fp *os.File, fn func(offset int64, cs *pb.ManifestChangeSet) error) (ret *Manifest, truncOffset int64, err error) {
 	r := &bufReader{reader: bufio.NewReader(fp)}
 	var magicBuf [8]byte
 	if _, err := io.ReadFull(r, magicBuf[:]); err != nil {
@@ -146,7 +153,7 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 			return &Manifest{}, 0, err
 		}
 		if crc32.Checksum(buf, utils.CastagnoliCrcTable) != binary.BigEndian.Uint32(lenCrcBuf[4:8]) {
-			return &Manifest{}, 0, utils.ErrBadChecksum
+			return &Manifest{}, 0, errors.Wrapf(utils.ErrBadChecksum, "at offset %d", offset)
 		}
 
 		var changeSet pb.ManifestChangeSet
@@ -154,8 +161,13 @@ func ReplayManifestFile(fp *os.File) (ret *Manifest, truncOffset int64, err erro
 			return &Manifest{}, 0, err
 		}
 
+		if fn != nil {
+			if err := fn(offset, &changeSet); err != nil {
+				return &Manifest{}, 0, err
+			}
+		}
 		if err := applyChangeSet(build, &changeSet); err != nil {
-			return &Manifest{}, 0, err
+			return &Manifest{}, 0, errors.Wrapf(err, "at offset %d", offset)
 		}
 	}
 
@@ -318,6 +330,21 @@ func helpRewrite(dir string, m *Manifest) (*os.File, int, error) {
 	return fp, netCreations, nil
 }
 
+// RewriteManifest 按给定的sst层级分布(id -> level)覆写dir下的manifest文件, 用于离线修复和checkpoint
+func RewriteManifest(dir string, levels map[uint64]int) error {
+	m := createManifest()
+	for id, level := range levels {
+		if err := applyManifestChange(m, newCreateChange(id, level, nil)); err != nil {
+			return err
+		}
+	}
+	fp, _, err := helpRewrite(dir, m)
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
 // Close 关闭文件
 func (mf *ManifestFile) Close() error {
 	if err := mf.f.Close(); err != nil {
@@ -371,25 +398,43 @@ func (mf *ManifestFile) AddTableMeta(levelNum int, t *TableMeta) (err error) {
 	return err
 }
 
+// Diff 对比manifest与目录中实际存在的sst, 返回manifest中引用但不存在的sst, 以及存在但未被引用的sst, 均按id升序
+func (m *Manifest) Diff(idMap map[uint64]struct{}) (missing, orphaned []uint64) {
+	for id := range m.Tables {
+		if _, ok := idMap[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	for id := range idMap {
+		if _, ok := m.Tables[id]; !ok {
+			orphaned = append(orphaned, id)
+		}
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] < missing[j] })
+	sort.Slice(orphaned, func(i, j int) bool { return orphaned[i] < orphaned[j] })
+	return missing, orphaned
+}
+
 // RevertToManifest checks that all necessary table files exist and removes all table files not
 // referenced by the manifest.  idMap is a set of table file id's that were read from the directory
 // listing.
 func (mf *ManifestFile) RevertToManifest(idMap map[uint64]struct{}) error {
+	missing, orphaned := mf.manifest.Diff(idMap)
 	// 1. Check all files in manifest exist.
-	for id := range mf.manifest.Tables {
-		if _, ok := idMap[id]; !ok {
-			return fmt.Errorf("file does not exist for table %d", id)
+	if len(missing) > 0 {
+		files := make([]string, 0, len(missing))
+		for _, id := range missing {
+			files = append(files, fmt.Sprintf("%s (L%d)", utils.FileNameSSTable(mf.opt.Dir, id), mf.manifest.Tables[id].Level))
 		}
+		return fmt.Errorf("MANIFEST references %d missing table file(s): %s", len(missing), strings.Join(files, ", "))
 	}
 
 	// 2. Delete files that shouldn't exist.
-	for id := range idMap {
-		if _, ok := mf.manifest.Tables[id]; !ok {
-			utils.Err(fmt.Errorf("Table file %d  not referenced in MANIFEST", id))
-			filename := utils.FileNameSSTable(mf.opt.Dir, id)
-			if err := os.Remove(filename); err != nil {
-				return errors.Wrapf(err, "While removing table %d", id)
-			}
+	for _, id := range orphaned {
+		filename := utils.FileNameSSTable(mf.opt.Dir, id)
+		mf.opt.logger().Warn("table file not referenced in MANIFEST, removing", "file", filename)
+		if err := os.Remove(filename); err != nil {
+			return errors.Wrapf(err, "While removing table %d", id)
 		}
 	}
 	return nil
@@ -47,7 +47,9 @@ type SSTable struct {
 // OpenSStable 打开一个 sst文件
 func OpenSStable(opt *Options) *SSTable {
 	omf, err := OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
-	utils.Err(err)
+	if err != nil {
+		opt.logger().Error("failed to open sstable", "file", opt.FileName, "err", err)
+	}
 	return &SSTable{f: omf, fid: opt.FID, lock: &sync.RWMutex{}}
 }
 
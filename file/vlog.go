@@ -30,7 +30,7 @@ func (lf *LogFile) Open(opt *Options) error {
 	utils.Panic2(nil, err)
 	fi, err := lf.f.Fd.Stat()
 	if err != nil {
-		return utils.WarpErr("Unable to run file.Stat", err)
+		return errors.Wrap(err, "Unable to run file.Stat")
 	}
 	// 获取文件尺寸
 	sz := fi.Size()
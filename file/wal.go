@@ -51,6 +51,11 @@ func (wf *WalFile) Close() error {
 	return os.Remove(fileName)
 }
 
+// Release 只关闭文件不删除, 用于只读地打开wal的场景
+func (wf *WalFile) Release() error {
+	return wf.f.Close()
+}
+
 // Name _
 func (wf *WalFile) Name() string {
 	return wf.f.Fd.Name()
@@ -63,11 +68,13 @@ func (wf *WalFile) Size() uint32 {
 
 // OpenWalFile _
 func OpenWalFile(opt *Options) *WalFile {
-	omf, err := OpenMmapFile(opt.FileName, os.O_CREATE|os.O_RDWR, opt.MaxSz)
+	omf, err := OpenMmapFile(opt.FileName, opt.Flag, opt.MaxSz)
 	wf := &WalFile{f: omf, lock: &sync.RWMutex{}, opts: opt}
 	wf.buf = &bytes.Buffer{}
 	wf.size = uint32(len(wf.f.Data))
-	utils.Err(err)
+	if err != nil {
+		opt.logger().Error("failed to open wal", "file", opt.FileName, "err", err)
+	}
 	return wf
 }
 
@@ -189,6 +196,7 @@ func (r *SafeRead) MakeEntry(reader io.Reader) (*utils.Entry, error) {
 	if crc != tee.Sum32() {
 		return nil, utils.ErrTruncate
 	}
+	e.Meta = h.Meta
 	e.ExpiresAt = h.ExpiresAt
 	return e, nil
 }
@@ -10,5 +10,6 @@ require (
 	github.com/stretchr/testify v1.7.0
 	golang.org/x/sys v0.0.0-20210910150752-751e447fb3d0
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	google.golang.org/grpc v1.43.0
 	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -15,13 +15,29 @@
 package corekv
 
 import (
+	"bytes"
+	"math"
+	"sync/atomic"
+
 	"github.com/hardcore-os/corekv/lsm"
 	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
 )
 
+// DBIterator 每个用户key只返回版本不大于readTs的最新版本, 读取vlog出错时停止, 错误由Err返回
 type DBIterator struct {
-	iitr utils.Iterator
-	vlog *valueLog
+	iitr    utils.Iterator
+	vlog    *valueLog
+	reverse bool
+	// readTs 只返回版本不大于readTs的数据, 之后的写入对迭代器不可见
+	readTs uint64
+	// withDeleted 为true时同一个key的最新版本是墓碑也会返回, value为空
+	withDeleted bool
+	// prefix 不为空时只遍历带有prefix的key, Rewind定位到start, 离开prefix之后Valid返回false
+	prefix, start []byte
+	item          *utils.Entry
+	err           error
+	closed        bool
 }
 type Item struct {
 	e *utils.Entry
@@ -30,64 +46,156 @@ type Item struct {
 func (it *Item) Entry() *utils.Entry {
 	return it.e
 }
-func (db *DB) NewIterator(opt *utils.Options) utils.Iterator {
+
+// NewIterator 每个用户key只返回创建迭代器时可见的最新版本, 跳过删除与过期的key
+func (db *DB) NewIterator(opt *utils.Options) *DBIterator {
+	return db.newIterator(opt, atomic.LoadUint64(&db.version), false)
+}
+
+// NewPrefixIterator 返回只遍历带有prefix的key的升序迭代器, Rewind定位到第一个不小于start的key
+// start为空或小于prefix时从prefix开始, 每个key只返回可见的最新版本
+func (db *DB) NewPrefixIterator(prefix, start []byte) *DBIterator {
+	return db.newPrefixIterator(prefix, start, atomic.LoadUint64(&db.version))
+}
+
+// newPrefixIterator 只返回版本不大于readTs的数据, 多个迭代器可以共享同一个readTs读取同一时刻的快照
+func (db *DB) newPrefixIterator(prefix, start []byte, readTs uint64) *DBIterator {
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
+	iter := db.newIterator(&utils.Options{IsAsc: true, Prefix: prefix}, readTs, false)
+	iter.prefix, iter.start = prefix, start
+	return iter
+}
+
+func (db *DB) newIterator(opt *utils.Options, readTs uint64, withDeleted bool) *DBIterator {
 	iters := make([]utils.Iterator, 0)
 	iters = append(iters, db.lsm.NewIterators(opt)...)
 
+	// opt.IsAsc为false时按key从大到小遍历
 	res := &DBIterator{
-		vlog: db.vlog,
-		iitr: lsm.NewMergeIterator(iters, opt.IsAsc),
+		vlog:        db.vlog,
+		iitr:        lsm.NewMergeIterator(iters, !opt.IsAsc),
+		reverse:     !opt.IsAsc,
+		readTs:      readTs,
+		withDeleted: withDeleted,
 	}
 	return res
 }
 
 func (iter *DBIterator) Next() {
-	iter.iitr.Next()
-	for ; iter.Valid() && iter.Item() == nil; iter.iitr.Next() {
-	}
+	iter.advance()
 }
 func (iter *DBIterator) Valid() bool {
-	return iter.iitr.Valid()
+	return iter.item != nil
 }
 func (iter *DBIterator) Rewind() {
-	iter.iitr.Rewind()
-	for ; iter.Valid() && iter.Item() == nil; iter.iitr.Next() {
+	iter.err = nil
+	// 内部key不允许用户key为空, 没有起点时直接从头开始
+	if len(iter.start) > 0 {
+		iter.iitr.Seek(utils.KeyWithTs(iter.start, math.MaxUint64))
+	} else {
+		iter.iitr.Rewind()
 	}
+	iter.advance()
 }
 func (iter *DBIterator) Item() utils.Item {
-	// 检查从lsm拿到的value是否是value ptr,是则从vlog中拿值
-	e := iter.iitr.Item().Entry()
-	var value []byte
+	if iter.item == nil {
+		return nil
+	}
+	return iter.item
+}
 
-	if e != nil && utils.IsValuePtr(e) {
+// Err 返回迭代过程中读取vlog的错误, 出错后Valid返回false, 调用方需要在遍历结束后检查
+func (iter *DBIterator) Err() error {
+	return iter.err
+}
+
+// advance 从当前位置开始依次消费每个用户key的所有版本, 停在下一个可见的key上
+// 升序时同一个key的新版本在前, 降序时旧版本在前
+func (iter *DBIterator) advance() {
+	iter.item = nil
+	if iter.err != nil {
+		return
+	}
+	for iter.iitr.Valid() {
+		var latest *utils.Entry
+		userKey := utils.SafeCopy(nil, utils.ParseKey(iter.iitr.Item().Entry().Key))
+		if len(iter.prefix) > 0 && !bytes.HasPrefix(userKey, iter.prefix) {
+			return
+		}
+		for ; iter.iitr.Valid(); iter.iitr.Next() {
+			e := iter.iitr.Item().Entry()
+			if !bytes.Equal(utils.ParseKey(e.Key), userKey) {
+				break
+			}
+			if utils.ParseTs(e.Key) > iter.readTs || (latest != nil && !iter.reverse) {
+				continue
+			}
+			latest = &utils.Entry{
+				Key:       utils.SafeCopy(nil, e.Key),
+				Value:     utils.SafeCopy(nil, e.Value),
+				ExpiresAt: e.ExpiresAt,
+				Meta:      e.Meta,
+			}
+		}
+		if latest == nil || bytes.HasPrefix(userKey, corekvPrefix) {
+			continue
+		}
+		item, err := iter.resolve(latest)
+		if err != nil {
+			iter.err = err
+			return
+		}
+		if item != nil {
+			iter.item = item
+			return
+		}
+	}
+}
+
+// resolve 跳过不可见的墓碑与过期的key, 值指针从vlog中读出value, 不可见时返回nil
+func (iter *DBIterator) resolve(e *utils.Entry) (*utils.Entry, error) {
+	switch {
+	case e.IsTombstone():
+		if !iter.withDeleted {
+			return nil, nil
+		}
+		e.Value = nil
+		e.Meta &^= utils.BitValuePointer
+	case e.IsDeletedOrExpired():
+		return nil, nil
+	case utils.IsValuePtr(e):
 		var vp utils.ValuePtr
 		vp.Decode(e.Value)
 		result, cb, err := iter.vlog.read(&vp)
 		defer utils.RunCallback(cb)
 		if err != nil {
-			return nil
+			return nil, errors.Wrapf(err, "read value of key %q", utils.ParseKey(e.Key))
 		}
-		value = utils.SafeCopy(nil, result)
+		e.Value = utils.SafeCopy(nil, result)
+		e.Meta &^= utils.BitValuePointer
 	}
+	e.Version = utils.ParseTs(e.Key)
+	return e, nil
+}
 
-	if e.IsDeletedOrExpired() || value == nil {
+// Close 释放内存表与sst的引用, 重复调用直接返回, 否则内存表的跳表会在刷盘前被释放
+func (iter *DBIterator) Close() error {
+	if iter.closed {
 		return nil
 	}
-
-	res := &utils.Entry{
-		Key:          e.Key,
-		Value:        value,
-		ExpiresAt:    e.ExpiresAt,
-		Meta:         e.Meta,
-		Version:      e.Version,
-		Offset:       e.Offset,
-		Hlen:         e.Hlen,
-		ValThreshold: e.ValThreshold,
-	}
-	return res
-}
-func (iter *DBIterator) Close() error {
+	iter.closed = true
 	return iter.iitr.Close()
 }
+
+// Seek 升序时定位到第一个>=key的位置, 降序时定位到最后一个用户key<=key中用户key的位置
 func (iter *DBIterator) Seek(key []byte) {
+	iter.err = nil
+	if iter.reverse {
+		// 版本为0的key排在同一个用户key的所有版本之后
+		key = utils.KeyWithTs(utils.ParseKey(key), 0)
+	}
+	iter.iitr.Seek(key)
+	iter.advance()
 }
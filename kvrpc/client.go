@@ -0,0 +1,114 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvrpc
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Client KVService的Go客户端
+type Client struct {
+	conn *grpc.ClientConn
+	kv   pb.KVServiceClient
+}
+
+// Dial 连接target, 没有传入opts时使用不加密的连接
+func Dial(target string, opts ...grpc.DialOption) (*Client, error) {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient 使用已有的连接, Close时会关闭该连接
+func NewClient(conn *grpc.ClientConn) *Client {
+	return &Client{conn: conn, kv: pb.NewKVServiceClient(conn)}
+}
+
+// Close _
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Get key不存在时返回utils.ErrKeyNotFound
+func (c *Client) Get(ctx context.Context, key []byte) (*pb.KV, error) {
+	resp, err := c.kv.Get(ctx, &pb.GetRequest{Key: key})
+	if status.Code(err) == codes.NotFound {
+		return nil, utils.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Kv, nil
+}
+
+// Put ttl为0表示永不过期
+func (c *Client) Put(ctx context.Context, key, value []byte, ttl time.Duration) error {
+	kv := &pb.KV{Key: key, Value: value}
+	if ttl > 0 {
+		kv.ExpiresAt = uint64(time.Now().Add(ttl).Unix())
+	}
+	_, err := c.kv.Put(ctx, &pb.PutRequest{Kv: kv})
+	return err
+}
+
+// Delete _
+func (c *Client) Delete(ctx context.Context, key []byte) error {
+	_, err := c.kv.Delete(ctx, &pb.DeleteRequest{Key: key})
+	return err
+}
+
+// BatchWrite 在服务端通过DB.Write写入wb
+func (c *Client) BatchWrite(ctx context.Context, wb *corekv.WriteBatch) error {
+	_, err := c.kv.BatchWrite(ctx, wb.KVList())
+	return err
+}
+
+// Scan 按key的顺序遍历带有prefix且不小于start的kv, limit为0表示不限制, fn返回错误时结束遍历
+func (c *Client) Scan(ctx context.Context, prefix, start []byte, limit uint32, fn func(kv *pb.KV) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.kv.Scan(ctx, &pb.ScanRequest{Prefix: prefix, Start: start, Limit: limit})
+	if err != nil {
+		return err
+	}
+	for {
+		list, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, kv := range list.Kv {
+			if err := fn(kv); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func startServer(t *testing.T) (*Client, func()) {
+	opt := &corekv.Options{
+		WorkDir:            t.TempDir(),
+		SSTableMaxSz:       1 << 20,
+		MemTableSize:       1 << 20,
+		ValueLogFileSize:   1 << 20,
+		ValueLogMaxEntries: 1000,
+		MaxBatchCount:      100,
+		MaxBatchSize:       1 << 20,
+	}
+	db := corekv.Open(opt)
+	gs := grpc.NewServer()
+	NewServer(db).Register(gs)
+	ln := bufconn.Listen(1 << 20)
+	go gs.Serve(ln)
+
+	c, err := Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return ln.DialContext(ctx)
+	}))
+	require.NoError(t, err)
+	return c, func() {
+		require.NoError(t, c.Close())
+		gs.Stop()
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestKVService(t *testing.T) {
+	c, stop := startServer(t)
+	defer stop()
+	ctx := context.Background()
+
+	require.NoError(t, c.Put(ctx, []byte("foo"), []byte("bar"), 0))
+	kv, err := c.Get(ctx, []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(kv.Value))
+	require.Zero(t, kv.ExpiresAt)
+
+	require.NoError(t, c.Put(ctx, []byte("tmp"), []byte("v"), time.Hour))
+	kv, err = c.Get(ctx, []byte("tmp"))
+	require.NoError(t, err)
+	require.NotZero(t, kv.ExpiresAt)
+
+	require.NoError(t, c.Delete(ctx, []byte("foo")))
+	_, err = c.Get(ctx, []byte("foo"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+	require.Error(t, c.Put(ctx, nil, []byte("v"), 0))
+
+	// 内部前缀的key只能由引擎写入
+	require.Equal(t, codes.InvalidArgument, status.Code(c.Put(ctx, []byte("!corekv!repl"), []byte("v"), 0)))
+	require.Equal(t, codes.InvalidArgument, status.Code(c.Delete(ctx, []byte("!corekv!repl"))))
+	bad := corekv.NewWriteBatch()
+	bad.Set([]byte("ok"), []byte("v"))
+	bad.Set([]byte("!corekv!x"), []byte("v"))
+	require.Equal(t, codes.InvalidArgument, status.Code(c.BatchWrite(ctx, bad)))
+	_, err = c.Get(ctx, []byte("ok"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	wb := corekv.NewWriteBatch()
+	for i := 0; i < 30; i++ {
+		wb.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+	}
+	wb.Delete([]byte("tmp"))
+	require.NoError(t, c.BatchWrite(ctx, wb))
+	_, err = c.Get(ctx, []byte("tmp"))
+	require.Equal(t, utils.ErrKeyNotFound, err)
+
+	var keys []string
+	require.NoError(t, c.Scan(ctx, []byte("key"), nil, 0, func(kv *pb.KV) error {
+		keys = append(keys, string(kv.Key))
+		return nil
+	}))
+	require.Len(t, keys, 30)
+	require.Equal(t, "key000", keys[0])
+	require.Equal(t, "key029", keys[29])
+
+	// 从start开始并限制条数
+	keys = keys[:0]
+	require.NoError(t, c.Scan(ctx, []byte("key"), []byte("key010"), 5, func(kv *pb.KV) error {
+		keys = append(keys, string(kv.Key))
+		return nil
+	}))
+	require.Equal(t, []string{"key010", "key011", "key012", "key013", "key014"}, keys)
+}
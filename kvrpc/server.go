@@ -0,0 +1,156 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kvrpc 基于pb.KVService的grpc服务端与客户端
+package kvrpc
+
+import (
+	"context"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scanBatchSize Scan每次发送的KVList的最大字节数
+const scanBatchSize = 1 << 20
+
+// Server 把pb.KVService映射到DB上
+type Server struct {
+	db *corekv.DB
+}
+
+// NewServer _
+func NewServer(db *corekv.DB) *Server {
+	return &Server{db: db}
+}
+
+// Register 在grpc server上注册KVService
+func (s *Server) Register(gs *grpc.Server) {
+	pb.RegisterKVServiceServer(gs, s)
+}
+
+// toStatus 将corekv的错误转换为grpc的状态码
+func toStatus(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case utils.ErrKeyNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case utils.ErrEmptyKey, utils.ErrTxnTooBig, utils.ErrInternalKey:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case utils.ErrReplicaReadOnly:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Get key不存在时返回NotFound
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	e, err := s.db.Get(req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.GetResponse{Kv: &pb.KV{
+		Key:       req.Key,
+		Value:     e.Value,
+		ExpiresAt: e.ExpiresAt,
+	}}, nil
+}
+
+// Put 写入kv, 保留其ExpiresAt
+func (s *Server) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse, error) {
+	if req.Kv == nil {
+		return nil, status.Error(codes.InvalidArgument, "kv must be set")
+	}
+	if corekv.IsInternalKey(req.Kv.Key) {
+		return nil, toStatus(utils.ErrInternalKey)
+	}
+	e := utils.NewEntry(req.Kv.Key, req.Kv.Value)
+	e.ExpiresAt = req.Kv.ExpiresAt
+	if err := s.db.Set(e); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.PutResponse{}, nil
+}
+
+// Delete _
+func (s *Server) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if corekv.IsInternalKey(req.Key) {
+		return nil, toStatus(utils.ErrInternalKey)
+	}
+	if err := s.db.Del(req.Key); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+// BatchWrite 通过DB.Write写入整个批次, 带有内部前缀的key使整个批次被拒绝
+func (s *Server) BatchWrite(ctx context.Context, list *pb.KVList) (*pb.BatchWriteResponse, error) {
+	for _, kv := range list.Kv {
+		if corekv.IsInternalKey(kv.Key) {
+			return nil, toStatus(utils.ErrInternalKey)
+		}
+	}
+	if err := s.db.Write(corekv.NewWriteBatchFromKVList(list)); err != nil {
+		return nil, toStatus(err)
+	}
+	return &pb.BatchWriteResponse{}, nil
+}
+
+// Scan 按key的顺序流式返回带有prefix的kv, 每个KVList不超过scanBatchSize
+func (s *Server) Scan(req *pb.ScanRequest, stream pb.KVService_ScanServer) error {
+	iter := s.db.NewPrefixIterator(req.Prefix, req.Start)
+	defer iter.Close()
+
+	var (
+		list  = &pb.KVList{}
+		size  int
+		count uint32
+	)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		if err := stream.Context().Err(); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		e := iter.Item().Entry()
+		key := utils.ParseKey(e.Key)
+		kv := &pb.KV{
+			Key:       utils.SafeCopy(nil, key),
+			Value:     utils.SafeCopy(nil, e.Value),
+			ExpiresAt: e.ExpiresAt,
+		}
+		list.Kv = append(list.Kv, kv)
+		size += kv.Size()
+		count++
+		if size >= scanBatchSize {
+			if err := stream.Send(list); err != nil {
+				return err
+			}
+			list, size = &pb.KVList{}, 0
+		}
+		if req.Limit > 0 && count >= req.Limit {
+			break
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return toStatus(err)
+	}
+	if len(list.Kv) > 0 {
+		return stream.Send(list)
+	}
+	return nil
+}
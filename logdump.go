@@ -0,0 +1,160 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+
+	"github.com/hardcore-os/corekv/file"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// LogRecord vlog 或 wal 中一条校验通过的记录
+type LogRecord struct {
+	Offset    uint32
+	Len       uint32 // header + key + value + crc32 的总长度
+	HeaderLen int
+	Key       []byte
+	ValueLen  int
+	Meta      byte
+	ExpiresAt uint64
+}
+
+// LogSummary 遍历一个日志文件的结果
+type LogSummary struct {
+	Size     int64  // 文件大小
+	Records  int    // 校验通过的记录数
+	ValidEnd uint32 // 最后一条有效记录的结束位置, 重放时文件会被截断到这里
+	Corrupt  error  // 不为nil 表示 ValidEnd 处存在无法解析或校验失败的数据, 重放时会被丢弃
+}
+
+// DumpValueLog 只读地遍历dir下编号为fid的vlog文件, 对每一条有效记录回调fn
+func DumpValueLog(dir string, fid uint32, fn func(r *LogRecord) error) (*LogSummary, error) {
+	path := utils.VlogFilePath(dir, fid)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LogSummary{Size: fi.Size()}
+	if ls.Size == 0 {
+		return ls, nil
+	}
+	lf := &file.LogFile{}
+	if err := lf.Open(&file.Options{
+		FID:      uint64(fid),
+		FileName: path,
+		Flag:     os.O_RDONLY,
+	}); err != nil {
+		return nil, err
+	}
+	defer lf.Close()
+
+	vlog := &valueLog{}
+	ls.ValidEnd, err = vlog.iterate(lf, 0, func(e *utils.Entry, vp *utils.ValuePtr) error {
+		ls.Records++
+		return callLogRecord(fn, e, vp.Len)
+	})
+	if err != nil {
+		return ls, err
+	}
+	ls.Corrupt = checkLogTail(path, ls.ValidEnd, false)
+	return ls, nil
+}
+
+// DumpWal 只读地遍历一个wal文件, 对每一条有效记录回调fn
+func DumpWal(path string, fn func(r *LogRecord) error) (*LogSummary, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	ls := &LogSummary{Size: fi.Size()}
+	if ls.Size == 0 {
+		return ls, nil
+	}
+	wf := file.OpenWalFile(&file.Options{FileName: path, Flag: os.O_RDONLY})
+	defer wf.Release()
+
+	ls.ValidEnd, err = wf.Iterate(true, 0, func(e *utils.Entry, _ *utils.ValuePtr) error {
+		ls.Records++
+		return callLogRecord(fn, e, uint32(e.Hlen+len(e.Key)+len(e.Value)+crc32.Size))
+	})
+	if err != nil {
+		return ls, err
+	}
+	ls.Corrupt = checkLogTail(path, ls.ValidEnd, true)
+	return ls, nil
+}
+
+func callLogRecord(fn func(r *LogRecord) error, e *utils.Entry, size uint32) error {
+	if fn == nil {
+		return nil
+	}
+	return fn(&LogRecord{
+		Offset:    e.Offset,
+		Len:       size,
+		HeaderLen: e.Hlen,
+		Key:       e.Key,
+		ValueLen:  len(e.Value),
+		Meta:      e.Meta,
+		ExpiresAt: e.ExpiresAt,
+	})
+}
+
+// checkLogTail 检查有效数据之后的内容, 全部为0说明是预分配的空间, 否则返回损坏的原因
+func checkLogTail(path string, end uint32, isWal bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if int64(end) >= fi.Size() {
+		return nil
+	}
+	tail := make([]byte, fi.Size()-int64(end))
+	if _, err := f.ReadAt(tail, int64(end)); err != nil {
+		return err
+	}
+	if len(bytes.Trim(tail, "\x00")) == 0 {
+		return nil
+	}
+
+	reader := utils.NewHashReader(bytes.NewReader(tail))
+	var hlen, klen, vlen int
+	if isWal {
+		var h utils.WalHeader
+		if hlen, err = h.Decode(reader); err != nil {
+			return errors.Errorf("offset %d: truncated header", end)
+		}
+		klen, vlen = int(h.KeyLen), int(h.ValueLen)
+	} else {
+		var h utils.Header
+		if hlen, err = h.DecodeFrom(reader); err != nil {
+			return errors.Errorf("offset %d: truncated header", end)
+		}
+		klen, vlen = int(h.KLen), int(h.VLen)
+	}
+	if need := hlen + klen + vlen + crc32.Size; need > len(tail) {
+		return errors.Errorf("offset %d: truncated record, key len %d, value len %d, need %d bytes but only %d left",
+			end, klen, vlen, need, len(tail))
+	}
+	return errors.Errorf("offset %d: checksum mismatch, key len %d, value len %d", end, klen, vlen)
+}
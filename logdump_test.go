@@ -0,0 +1,99 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hardcore-os/corekv/file"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpValueLog(t *testing.T) {
+	clearDir()
+	dopt := *opt
+	dopt.ValueLogMaxEntries = 1000
+	db := Open(&dopt)
+	n := 20
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%d", i)), []byte("value"))))
+	}
+	require.NoError(t, db.Close())
+
+	var keys int
+	ls, err := DumpValueLog(opt.WorkDir, 0, func(r *LogRecord) error {
+		require.Equal(t, fmt.Sprintf("key%d", keys), string(utils.ParseKey(r.Key)))
+		keys++
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ls.Corrupt)
+	require.Equal(t, n, ls.Records)
+	require.Equal(t, n, keys)
+
+	// 在有效数据之后写入垃圾数据
+	f, err := os.OpenFile(utils.VlogFilePath(opt.WorkDir, 0), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x02, 0x06, 0x05, 0x00, 'k', 'e', 'y'}, int64(ls.ValidEnd))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	end := ls.ValidEnd
+	ls, err = DumpValueLog(opt.WorkDir, 0, nil)
+	require.NoError(t, err)
+	require.Error(t, ls.Corrupt)
+	require.Equal(t, n, ls.Records)
+	require.Equal(t, end, ls.ValidEnd)
+}
+
+func TestDumpWal(t *testing.T) {
+	clearDir()
+	path := filepath.Join(opt.WorkDir, "00001.wal")
+	wf := file.OpenWalFile(&file.Options{FileName: path, Flag: os.O_CREATE | os.O_RDWR, MaxSz: 1 << 10})
+	n := 10
+	for i := 0; i < n; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%d", i)), 1), []byte("value"))
+		e.Meta = utils.BitDelete
+		require.NoError(t, wf.Write(e))
+	}
+	require.NoError(t, wf.Release())
+
+	ls, err := DumpWal(path, func(r *LogRecord) error {
+		require.Equal(t, utils.BitDelete, r.Meta)
+		require.Equal(t, len("value"), r.ValueLen)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, ls.Corrupt)
+	require.Equal(t, n, ls.Records)
+	require.Equal(t, int64(1<<10), ls.Size)
+
+	// 破坏最后一条记录的crc
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(ls.ValidEnd)-1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	end := ls.ValidEnd
+	ls, err = DumpWal(path, nil)
+	require.NoError(t, err)
+	require.Error(t, ls.Corrupt)
+	require.Equal(t, n-1, ls.Records)
+	require.True(t, ls.ValidEnd < end)
+}
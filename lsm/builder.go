@@ -21,6 +21,7 @@ import (
 	"math"
 	"os"
 	"sort"
+	"time"
 	"unsafe"
 
 	"github.com/hardcore-os/corekv/file"
@@ -36,9 +37,16 @@ type tableBuilder struct {
 	keyCount      uint32
 	keyHashes     []uint32
 	maxVersion    uint64
+	minExpiresAt  uint64
+	maxExpiresAt  uint64
 	baseKey       []byte
 	staleDataSize int
 	estimateSz    int64
+
+	oldestEntryTime uint64 // flush时为当前时间, 压缩时继承输入的sst
+	tombstoneCount  uint32
+	ttlDataSize     uint64
+	ioPriority      utils.IOPriority // 写入sst时的限速优先级, flush为高优先级
 }
 type buildData struct {
 	blockList []*block
@@ -97,6 +105,18 @@ func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 			data: make([]byte, tb.opt.BlockSize), // TODO 加密block后块的大小会增加，需要预留一些填充位置
 		}
 	}
+	if len(tb.keyHashes) == 0 || e.ExpiresAt < tb.minExpiresAt {
+		tb.minExpiresAt = e.ExpiresAt
+	}
+	if e.ExpiresAt > tb.maxExpiresAt {
+		tb.maxExpiresAt = e.ExpiresAt
+	}
+	if isTombstone(e) {
+		tb.tombstoneCount++
+	}
+	if e.ExpiresAt > 0 {
+		tb.ttlDataSize += uint64(len(key)) + uint64(val.EncodedSize())
+	}
 	tb.keyHashes = append(tb.keyHashes, utils.Hash(utils.ParseKey(key)))
 
 	if version := utils.ParseTs(key); version > tb.maxVersion {
@@ -128,14 +148,16 @@ func (tb *tableBuilder) add(e *utils.Entry, isStale bool) {
 }
 func newTableBuilerWithSSTSize(opt *Options, size int64) *tableBuilder {
 	return &tableBuilder{
-		opt:     opt,
-		sstSize: size,
+		opt:             opt,
+		sstSize:         size,
+		oldestEntryTime: uint64(time.Now().Unix()),
 	}
 }
 func newTableBuiler(opt *Options) *tableBuilder {
 	return &tableBuilder{
-		opt:     opt,
-		sstSize: opt.SSTableMaxSz,
+		opt:             opt,
+		sstSize:         opt.SSTableMaxSz,
+		oldestEntryTime: uint64(time.Now().Unix()),
 	}
 }
 
@@ -254,26 +276,36 @@ func (tb *tableBuilder) flush(lm *levelManager, tableName string) (t *table, err
 		FileName: tableName,
 		Dir:      lm.opt.WorkDir,
 		Flag:     os.O_CREATE | os.O_RDWR,
-		MaxSz:    int(bd.size)})
-	buf := make([]byte, bd.size)
-	written := bd.Copy(buf)
-	utils.CondPanic(written != len(buf), fmt.Errorf("tableBuilder.flush written != len(buf)"))
+		MaxSz:    int(bd.size),
+		Logger:   lm.opt.Logger})
 	// 在内存映射文件的数组里分配一个sst所需要的空间
 	dst, err := t.ss.Bytes(0, bd.size)
 	if err != nil {
 		return nil, err
 	}
-	// sst落盘
-	copy(dst, buf)
+	// sst落盘, 每写入一个block前向Options.RateLimiter请求这部分的配额, 写入速度平滑而不是整个sst一次性放行
+	written := bd.copyTo(dst, func(n int) { lm.opt.RateLimiter.Request(int64(n), tb.ioPriority) })
+	utils.CondPanic(written != bd.size, fmt.Errorf("tableBuilder.flush written != bd.size"))
 	return t, nil
 }
 
 // Copy 将builder里的block, table_index, checksum等都复制到dst中
 func (bd *buildData) Copy(dst []byte) int {
+	return bd.copyTo(dst, nil)
+}
+
+// copyTo 与Copy相同, before不为nil时在复制每个block以及最后的索引部分之前以其字节数调用
+func (bd *buildData) copyTo(dst []byte, before func(n int)) int {
 	var written int
 	for _, bl := range bd.blockList {
+		if before != nil {
+			before(bl.end)
+		}
 		written += copy(dst[written:], bl.data[:bl.end])
 	}
+	if before != nil {
+		before(bd.size - written)
+	}
 	written += copy(dst[written:], bd.index)
 	written += copy(dst[written:], utils.U32ToBytes(uint32(len(bd.index))))
 
@@ -313,6 +345,12 @@ func (tb *tableBuilder) buildIndex(bloom []byte) ([]byte, uint32) {
 	}
 	tableIndex.KeyCount = tb.keyCount
 	tableIndex.MaxVersion = tb.maxVersion
+	tableIndex.StaleDataSize = uint32(tb.staleDataSize)
+	tableIndex.MinExpiresAt = tb.minExpiresAt
+	tableIndex.MaxExpiresAt = tb.maxExpiresAt
+	tableIndex.OldestEntryTime = tb.oldestEntryTime
+	tableIndex.TombstoneCount = tb.tombstoneCount
+	tableIndex.TtlDataSize = tb.ttlDataSize
 	tableIndex.Offsets = tb.writeBlockOffsets(tableIndex)
 	var dataSize uint32
 	for i := range tb.blockList {
@@ -471,6 +509,10 @@ func (itr *blockIterator) Next() {
 	itr.setIdx(itr.idx + 1)
 }
 
+func (itr *blockIterator) prev() {
+	itr.setIdx(itr.idx - 1)
+}
+
 func (itr *blockIterator) Valid() bool {
 	return itr.err != io.EOF // TODO 这里用err比较好
 }
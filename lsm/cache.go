@@ -29,6 +29,23 @@ type blockBuffer struct {
 
 const defaultCacheSize = 1024
 
+// CacheInfo 缓存的命中情况
+type CacheInfo struct {
+	Name     string
+	Hits     uint64
+	Misses   uint64
+	HitRatio float64
+}
+
+func cacheInfo(name string, c *coreCache.Cache) CacheInfo {
+	hits, misses := c.Metrics()
+	info := CacheInfo{Name: name, Hits: hits, Misses: misses}
+	if hits+misses > 0 {
+		info.HitRatio = float64(hits) / float64(hits+misses)
+	}
+	return info
+}
+
 // close
 func (c *cache) close() error {
 	return nil
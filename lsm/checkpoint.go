@@ -0,0 +1,61 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"github.com/hardcore-os/corekv/file"
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// Checkpoint 先将memtable刷盘, 然后把当前所有存活的sst硬链接到dir下, 并按其层级生成新的manifest
+// 期间持有的引用保证这些sst不会被压缩删除
+func (lsm *LSM) Checkpoint(dir string) error {
+	if err := lsm.Flush(); err != nil {
+		return err
+	}
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+
+	// 同时持有所有层的读锁, 拿到一份一致的层级视图
+	lm := lsm.levels
+	for _, lh := range lm.levels {
+		lh.RLock()
+	}
+	levels := make(map[uint64]int)
+	var tables []*table
+	for _, lh := range lm.levels {
+		for _, t := range lh.tables {
+			// 压缩过程中一个sst可能短暂地同时出现在两层, 只保留较高的一层
+			if _, ok := levels[t.fid]; ok {
+				continue
+			}
+			t.IncrRef()
+			tables = append(tables, t)
+			levels[t.fid] = lh.levelNum
+		}
+	}
+	for _, lh := range lm.levels {
+		lh.RUnlock()
+	}
+	defer decrRefs(tables)
+
+	for _, t := range tables {
+		src := utils.FileNameSSTable(lsm.option.WorkDir, t.fid)
+		if err := utils.LinkOrCopy(src, utils.FileNameSSTable(dir, t.fid), -1); err != nil {
+			return err
+		}
+	}
+	return file.RewriteManifest(dir, levels)
+}
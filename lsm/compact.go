@@ -18,7 +18,6 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"math/rand"
 	"sort"
@@ -38,6 +37,7 @@ type compactionPriority struct {
 	adjusted     float64
 	dropPrefixes [][]byte
 	t            targets
+	cold         bool // level没有超过目标大小, 只压缩过老或垃圾过多的sst
 }
 
 // 归并目标
@@ -63,6 +63,11 @@ type compactDef struct {
 	thisSize int64
 
 	dropPrefixes [][]byte
+	hasOverlap   bool // 更低的层中是否有与本次压缩重合的sst
+	dropGarbage  bool // 丢弃墓碑与过期的数据, 见dropsGarbage
+	deleteOnly   bool // 直接删除top中的sst, 不读取也不写出数据
+
+	oldestEntryTime uint64 // 输入的sst中最老的数据写入的时间, 由输出的sst继承
 }
 
 func (cd *compactDef) lockLevels() {
@@ -85,7 +90,7 @@ func (lm *levelManager) runCompacter(id int) {
 		randomDelay.Stop()
 		return
 	}
-	//TODO 这个值有待验证
+	// 压缩主要由flush与上一次压缩的完成触发, 定时器只是兜底
 	ticker := time.NewTicker(50000 * time.Millisecond)
 	defer ticker.Stop()
 	for {
@@ -93,26 +98,32 @@ func (lm *levelManager) runCompacter(id int) {
 		// Can add a done channel or other stuff.
 		case <-ticker.C:
 			lm.runOnce(id)
+		case <-lm.compactCh:
+			if lm.runOnce(id) {
+				// 压缩会改变当前层与下一层的得分, 继续检查直到没有可执行的压缩
+				lm.triggerCompaction()
+			}
 		case <-lm.lsm.closer.CloseSignal:
 			return
 		}
 	}
 }
 
-// runOnce
+// triggerCompaction 唤醒一个压缩协程, 已经有未处理的通知时直接返回
+func (lm *levelManager) triggerCompaction() {
+	select {
+	case lm.compactCh <- struct{}{}:
+	default:
+	}
+}
+
+// runOnce 按压缩策略给出的优先级依次尝试, 执行成功一个压缩即返回
 func (lm *levelManager) runOnce(id int) bool {
-	prios := lm.pickCompactLevels()
-	if id == 0 {
-		// 0号协程 总是倾向于压缩l0层
-		prios = moveL0toFront(prios)
+	if rl := lm.opt.RateLimiter; rl != nil {
+		// 积压的数据越多压缩越快, 以BaseLevelSize作为全速的阈值
+		rl.Tune(lm.pendingCompactionBytes(), lm.opt.BaseLevelSize)
 	}
-	for _, p := range prios {
-		if id == 0 && p.level == 0 {
-			// 对于l0 无论得分多少都要运行
-		} else if p.adjusted < 1.0 {
-			// 对于其他level 如果等分小于 则不执行
-			break
-		}
+	for _, p := range lm.strategy().priorities(lm, id) {
 		if lm.run(id, p) {
 			return true
 		}
@@ -147,7 +158,8 @@ func (lm *levelManager) run(id int, p compactionPriority) bool {
 	case utils.ErrFillTables:
 		// 什么也不做，此时合并过程被忽略
 	default:
-		log.Printf("[taskID:%d] While running doCompact: %v\n ", id, err)
+		lm.opt.Logger.Error("compaction failed", "compactor", id, "level", p.level, "err", err)
+		lm.listener().OnBackgroundError("compaction", err)
 	}
 	return false
 }
@@ -157,7 +169,7 @@ func (lm *levelManager) doCompact(id int, p compactionPriority) error {
 	l := p.level
 	utils.CondPanic(l >= lm.opt.MaxLevelNum, errors.New("[doCompact] Sanity check. l >= lm.opt.MaxLevelNum")) // Sanity check.
 	if p.t.baseLevel == 0 {
-		p.t = lm.levelTargets()
+		p.t = lm.strategy().targets(lm)
 	}
 	// 创建真正的压缩计划
 	cd := compactDef{
@@ -168,21 +180,9 @@ func (lm *levelManager) doCompact(id int, p compactionPriority) error {
 		dropPrefixes: p.dropPrefixes,
 	}
 
-	// 如果是第0层 对齐单独填充处理
-	if l == 0 {
-		cd.nextLevel = lm.levels[p.t.baseLevel]
-		if !lm.fillTablesL0(&cd) {
-			return utils.ErrFillTables
-		}
-	} else {
-		cd.nextLevel = cd.thisLevel
-		// 如果不是最后一层，则压缩到下一层即可
-		if !cd.thisLevel.isLastLevel() {
-			cd.nextLevel = lm.levels[l+1]
-		}
-		if !lm.fillTables(&cd) {
-			return utils.ErrFillTables
-		}
+	// 由压缩策略选择目标level与参与压缩的sst
+	if !lm.strategy().fill(lm, &cd) {
+		return utils.ErrFillTables
 	}
 	// 完成合并后 从合并状态中删除
 	defer lm.compactState.delete(cd) // Remove the ranges from compaction status.
@@ -190,11 +190,11 @@ func (lm *levelManager) doCompact(id int, p compactionPriority) error {
 	// 执行合并计划
 	if err := lm.runCompactDef(id, l, cd); err != nil {
 		// This compaction couldn't be done successfully.
-		log.Printf("[Compactor: %d] LOG Compact FAILED with error: %+v: %+v", id, err, cd)
 		return err
 	}
 
-	log.Printf("[Compactor: %d] Compaction for level: %d DONE", id, cd.thisLevel.levelNum)
+	lm.opt.Logger.Info("compaction done", "compactor", id, "from", cd.thisLevel.levelNum, "to", cd.nextLevel.levelNum,
+		"top", len(cd.top), "bot", len(cd.bot), "score", fmt.Sprintf("%.2f", p.adjusted))
 	return nil
 }
 
@@ -249,12 +249,40 @@ func (lm *levelManager) pickCompactLevels() (prios []compactionPriority) {
 	}
 	prios = out
 
+	// 没有因为大小被选中的level中, 过老或墓碑与过期数据过多的sst也需要压缩, 使其逐层下沉直到在最后一层被丢弃
+	picked := make(map[int]bool, len(prios))
+	for _, p := range prios {
+		picked[p.level] = true
+	}
+	now := time.Now()
+	for i, lh := range lm.levels {
+		if !picked[i] && lm.hasColdTables(lh, now) {
+			prios = append(prios, compactionPriority{level: i, score: 1, adjusted: 1, t: t, cold: true})
+		}
+	}
+
 	// 按优先级排序
 	sort.Slice(prios, func(i, j int) bool {
 		return prios[i].adjusted > prios[j].adjusted
 	})
 	return prios
 }
+
+// pendingCompactionBytes 估算等待压缩的字节数: l0的全部数据加上其他层超过目标大小的部分
+func (lm *levelManager) pendingCompactionBytes() int64 {
+	t := lm.strategy().targets(lm)
+	pending := lm.levels[0].getTotalSize()
+	for i := 1; i < len(lm.levels); i++ {
+		if t.targetSz[i] == 0 {
+			continue
+		}
+		if over := lm.levels[i].getTotalSize() - t.targetSz[i]; over > 0 {
+			pending += over
+		}
+	}
+	return pending
+}
+
 func (lm *levelManager) lastLevel() *levelHandler {
 	return lm.levels[len(lm.levels)-1]
 }
@@ -326,13 +354,20 @@ func (lm *levelManager) fillTables(cd *compactDef) bool {
 	if len(tables) == 0 {
 		return false
 	}
-	// We're doing a maxLevel to maxLevel compaction. Pick tables based on the stale data size.
-	if cd.thisLevel.isLastLevel() {
+	switch {
+	case cd.p.cold:
+		tables = lm.coldTables(tables, cd.thisLevel.isLastLevel(), time.Now())
+		if cd.thisLevel.isLastLevel() {
+			return lm.fillMaxLevelColdTables(tables, cd)
+		}
+	case cd.thisLevel.isLastLevel():
+		// We're doing a maxLevel to maxLevel compaction. Pick tables based on the stale data size.
 		return lm.fillMaxLevelTables(tables, cd)
+	default:
+		// We pick tables, so we compact older tables first. This is similar to
+		// kOldestLargestSeqFirst in RocksDB.
+		lm.sortByHeuristic(tables, cd)
 	}
-	// We pick tables, so we compact older tables first. This is similar to
-	// kOldestLargestSeqFirst in RocksDB.
-	lm.sortByHeuristic(tables, cd)
 
 	for _, t := range tables {
 		cd.thisSize = t.Size()
@@ -388,27 +423,50 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 	thisLevel := cd.thisLevel
 	nextLevel := cd.nextLevel
 
-	utils.CondPanic(len(cd.splits) != 0, errors.New("len(cd.splits) != 0"))
-	if thisLevel == nextLevel {
-		// l0 to l0 和 lmax to lmax 不做特殊处理
-	} else {
-		lm.addSplits(&cd)
-	}
-	// 追加一个空的
-	if len(cd.splits) == 0 {
-		cd.splits = append(cd.splits, keyRange{})
-	}
-
-	newTables, decr, err := lm.compactBuildTables(l, cd)
-	if err != nil {
-		return err
-	}
+	// 旧表在替换后会被关闭, 提前收集输入表的信息
+	top, topSize := tableInfos(cd.top, thisLevel.levelNum)
+	bot, botSize := tableInfos(cd.bot, nextLevel.levelNum)
+	info := CompactionInfo{
+		CompactorID: id,
+		FromLevel:   thisLevel.levelNum,
+		ToLevel:     nextLevel.levelNum,
+		Inputs:      append(top, bot...),
+		InputBytes:  topSize + botSize,
+	}
+	listener := lm.listener()
+	listener.OnCompactionBegin(info)
 	defer func() {
-		// Only assign to err, if it's not already nil.
-		if decErr := decr(); err == nil {
-			err = decErr
-		}
+		info.Duration = time.Since(timeStart)
+		info.Err = err
+		listener.OnCompactionEnd(info)
 	}()
+
+	var newTables []*table
+	if !cd.deleteOnly {
+		utils.CondPanic(len(cd.splits) != 0, errors.New("len(cd.splits) != 0"))
+		if thisLevel == nextLevel {
+			// l0 to l0 和 lmax to lmax 不做特殊处理
+		} else {
+			lm.addSplits(&cd)
+		}
+		// 追加一个空的
+		if len(cd.splits) == 0 {
+			cd.splits = append(cd.splits, keyRange{})
+		}
+
+		var decr func() error
+		newTables, decr, err = lm.compactBuildTables(l, cd)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			// Only assign to err, if it's not already nil.
+			if decErr := decr(); err == nil {
+				err = decErr
+			}
+		}()
+	}
+	info.Outputs, info.OutputBytes = tableInfos(newTables, nextLevel.levelNum)
 	changeSet := buildChangeSet(&cd, newTables)
 
 	// 删除之前先更新manifest文件
@@ -420,22 +478,31 @@ func (lm *levelManager) runCompactDef(id, l int, cd compactDef) (err error) {
 		return err
 	}
 	defer decrRefs(cd.top)
+	// 直接删除的sst没有经过subcompact, 需要在删除之前单独统计其中值指针引用的vlog数据
+	var discardStats map[uint32]int64
+	if cd.deleteOnly {
+		discardStats = discardStatsOf(cd.top)
+	}
 	if err := thisLevel.deleteTables(cd.top); err != nil {
 		return err
 	}
+	if discardStats != nil {
+		lm.updateDiscardStats(discardStats)
+	}
+	lm.lsm.metrics.addCompaction(nextLevel.levelNum, time.Since(timeStart), info.InputBytes, info.OutputBytes)
+	for _, t := range info.Outputs {
+		listener.OnTableCreated(t, "compaction")
+	}
+	for _, t := range info.Inputs {
+		listener.OnTableDeleted(t, "compaction")
+	}
 
 	from := append(tablesToString(cd.top), tablesToString(cd.bot)...)
 	to := tablesToString(newTables)
 	if dur := time.Since(timeStart); dur > 2*time.Second {
-		var expensive string
-		if dur > time.Second {
-			expensive = " [E]"
-		}
-		fmt.Printf("[%d]%s LOG Compact %d->%d (%d, %d -> %d tables with %d splits)."+
-			" [%s] -> [%s], took %v\n",
-			id, expensive, thisLevel.levelNum, nextLevel.levelNum, len(cd.top), len(cd.bot),
-			len(newTables), len(cd.splits), strings.Join(from, " "), strings.Join(to, " "),
-			dur.Round(time.Millisecond))
+		lm.opt.Logger.Warn("slow compaction", "compactor", id, "from", thisLevel.levelNum, "to", nextLevel.levelNum,
+			"splits", len(cd.splits), "inputs", strings.Join(from, " "), "outputs", strings.Join(to, " "),
+			"took", dur.Round(time.Millisecond))
 	}
 	return nil
 }
@@ -487,6 +554,16 @@ func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, fu
 
 	topTables := cd.top
 	botTables := cd.bot
+	// l0到l0时l0中其他的sst也可能有旧值
+	all := append(append([]*table{}, topTables...), botTables...)
+	cd.hasOverlap = cd.nextLevel.levelNum == 0 || lm.checkOverlap(all, cd.nextLevel.levelNum+1)
+	cd.dropGarbage = lm.dropsGarbage(&cd)
+	cd.oldestEntryTime = math.MaxUint64
+	for _, t := range all {
+		if ts := t.oldestEntryTime(); ts < cd.oldestEntryTime {
+			cd.oldestEntryTime = ts
+		}
+	}
 	iterOpt := &utils.Options{
 		IsAsc: true,
 	}
@@ -498,7 +575,8 @@ func (lm *levelManager) compactBuildTables(lev int, cd compactDef) ([]*table, fu
 		case lev == 0:
 			iters = append(iters, iteratorsReversed(topTables, iterOpt)...)
 		case len(topTables) > 0:
-			iters = []utils.Iterator{topTables[0].NewIterator(iterOpt)}
+			// 非l0层的sst互不重合, 手动压缩时top可能有多个sst
+			iters = []utils.Iterator{NewConcatIterator(topTables, iterOpt)}
 		}
 		return append(iters, NewConcatIterator(botTables, iterOpt))
 	}
@@ -683,6 +761,70 @@ func (lm *levelManager) fillMaxLevelTables(tables []*table, cd *compactDef) bool
 	return lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
 }
 
+// isCold sst中最老的数据超过CompactionTableAge, 或者墓碑与过期数据的比例达到CompactionGarbageRatio.
+// 最后一层的sst原地重写后最老的数据不变, 按文件的创建时间判断
+func (lm *levelManager) isCold(t *table, last bool, now time.Time) bool {
+	if ratio := lm.opt.CompactionGarbageRatio; ratio > 0 && t.garbageRatio(uint64(now.Unix())) >= ratio {
+		return true
+	}
+	if age := lm.opt.CompactionTableAge; age > 0 {
+		born := time.Unix(int64(t.oldestEntryTime()), 0)
+		if last {
+			born = *t.GetCreatedAt()
+		}
+		return now.Sub(born) >= age
+	}
+	return false
+}
+
+func (lm *levelManager) hasColdTables(lh *levelHandler, now time.Time) bool {
+	if lm.opt.CompactionTableAge <= 0 && lm.opt.CompactionGarbageRatio <= 0 {
+		return false
+	}
+	lh.RLock()
+	defer lh.RUnlock()
+	for _, t := range lh.tables {
+		if lm.isCold(t, lh.isLastLevel(), now) {
+			return true
+		}
+	}
+	return false
+}
+
+// coldTables 返回需要压缩的sst, 垃圾比例高的在前, 相同时最老的在前
+func (lm *levelManager) coldTables(tables []*table, last bool, now time.Time) []*table {
+	var out []*table
+	for _, t := range tables {
+		if lm.isCold(t, last, now) {
+			out = append(out, t)
+		}
+	}
+	ts := uint64(now.Unix())
+	sort.SliceStable(out, func(i, j int) bool {
+		gi, gj := out[i].garbageRatio(ts), out[j].garbageRatio(ts)
+		if gi != gj {
+			return gi > gj
+		}
+		return out[i].oldestEntryTime() < out[j].oldestEntryTime()
+	})
+	return out
+}
+
+// fillMaxLevelColdTables 最后一层的sst之下没有数据, 单独重写即可丢弃其中的墓碑与过期数据
+func (lm *levelManager) fillMaxLevelColdTables(tables []*table, cd *compactDef) bool {
+	for _, t := range tables {
+		cd.top = []*table{t}
+		cd.bot = []*table{}
+		cd.thisSize = t.Size()
+		cd.thisRange = getKeyRange(t)
+		cd.nextRange = cd.thisRange
+		if lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+			return true
+		}
+	}
+	return false
+}
+
 // fillTablesL0 先尝试从l0 到lbase的压缩，如果失败则对l0自己压缩
 func (lm *levelManager) fillTablesL0(cd *compactDef) bool {
 	if ok := lm.fillTablesL0ToLbase(cd); ok {
@@ -827,6 +969,24 @@ func iteratorsReversed(th []*table, opt *utils.Options) []utils.Iterator {
 	}
 	return out
 }
+
+// discardStatsOf 统计tables中值指针引用的vlog数据, 这些sst被删除后数据不再被引用
+func discardStatsOf(tables []*table) map[uint32]int64 {
+	discardStats := make(map[uint32]int64)
+	for _, t := range tables {
+		it := t.NewIterator(&utils.Options{IsAsc: true})
+		for it.Rewind(); it.Valid(); it.Next() {
+			if e := it.Item().Entry(); e.Meta&utils.BitValuePointer > 0 {
+				var vp utils.ValuePtr
+				vp.Decode(e.Value)
+				discardStats[vp.Fid] += int64(vp.Len)
+			}
+		}
+		it.Close()
+	}
+	return discardStats
+}
+
 func (lm *levelManager) updateDiscardStats(discardStats map[uint32]int64) {
 	select {
 	case *lm.lsm.option.DiscardStatsCh <- discardStats:
@@ -874,15 +1034,38 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 				}
 				// 更新右边界
 				tableKr.right = lastKey
+			} else {
+				// 同一个key的旧版本已被更新的版本覆盖, 直接丢弃
+				updateStats(it.Item().Entry())
+				continue
 			}
 			// TODO 这里要区分值的指针
 			// 判断是否是过期内容，是的话就删除
+			e := it.Item().Entry()
 			switch {
 			case isExpired:
-				updateStats(it.Item().Entry())
-				builder.AddStaleKey(it.Item().Entry())
+				updateStats(e)
+				if !cd.dropGarbage {
+					builder.AddStaleKey(e)
+				}
+			case isTombstone(e) && cd.dropGarbage:
+				updateStats(e)
+			case lm.opt.CompactionFilter != nil && !isTombstone(e):
+				// 墓碑不交给过滤器, 否则改写value会让已删除的key重新出现
+				out, stale := lm.filterEntry(&cd, e)
+				if out != e {
+					// 值指针指向的vlog数据不再被引用
+					updateStats(e)
+				}
+				switch {
+				case out == nil:
+				case stale:
+					builder.AddStaleKey(out)
+				default:
+					builder.AddKey(out)
+				}
 			default:
-				builder.AddKey(it.Item().Entry())
+				builder.AddKey(e)
 			}
 		}
 	} // End of function: addKeys
@@ -902,6 +1085,7 @@ func (lm *levelManager) subcompact(it utils.Iterator, kr keyRange, cd compactDef
 		// 拼装table创建的参数
 		// TODO 这里可能要大改，对open table的参数复制一份opt
 		builder := newTableBuilerWithSSTSize(lm.opt, cd.t.fileSz[cd.nextLevel.levelNum])
+		builder.oldestEntryTime = cd.oldestEntryTime
 
 		// This would do the iteration and add keys to builder.
 		addKeys(builder)
@@ -960,6 +1144,21 @@ func isDeletedOrExpired(meta byte, expiresAt uint64) bool {
 	return expiresAt <= uint64(time.Now().Unix())
 }
 
+// dropsGarbage 更低的层没有这些key的旧版本时, 墓碑与过期的数据可以直接丢弃.
+// 手动压缩总是丢弃, 后台压缩只在启用了CompactionTableAge或CompactionGarbageRatio时丢弃, 未启用时与之前一样作为过期的数据保留.
+// sst中的数据都在持久化的vlog head之前, 丢弃之后重新打开时旧值不会被重放回来
+func (lm *levelManager) dropsGarbage(cd *compactDef) bool {
+	if cd.hasOverlap {
+		return false
+	}
+	return cd.compactorId == manualCompactorID || lm.opt.CompactionTableAge > 0 || lm.opt.CompactionGarbageRatio > 0
+}
+
+// isTombstone 删除写入的entry带有BitDelete标记, 墓碑写入vlog时同样是值指针
+func isTombstone(e *utils.Entry) bool {
+	return e.IsTombstone()
+}
+
 // compactStatus
 type compactStatus struct {
 	sync.RWMutex
@@ -992,6 +1191,44 @@ func (cs *compactStatus) delSize(l int) int64 {
 	return cs.levels[l].delSize
 }
 
+// CompactionState 正在进行的压缩, Tables为参与压缩的sst
+type CompactionState struct {
+	Tables []uint64
+	Levels []LevelCompaction
+}
+
+// LevelCompaction 某一层上被压缩占用的key范围以及将要删除的数据量
+type LevelCompaction struct {
+	Level   int
+	DelSize int64
+	Ranges  []CompactionRange
+}
+
+// CompactionRange _
+type CompactionRange struct {
+	Left  []byte
+	Right []byte
+	Inf   bool
+}
+
+func (cs *compactStatus) state() CompactionState {
+	cs.RLock()
+	defer cs.RUnlock()
+	st := CompactionState{Tables: make([]uint64, 0, len(cs.tables))}
+	for fid := range cs.tables {
+		st.Tables = append(st.Tables, fid)
+	}
+	sort.Slice(st.Tables, func(i, j int) bool { return st.Tables[i] < st.Tables[j] })
+	for i, l := range cs.levels {
+		lc := LevelCompaction{Level: i, DelSize: l.delSize}
+		for _, r := range l.ranges {
+			lc.Ranges = append(lc.Ranges, CompactionRange{Left: r.left, Right: r.right, Inf: r.inf})
+		}
+		st.Levels = append(st.Levels, lc)
+	}
+	return st
+}
+
 func (cs *compactStatus) delete(cd compactDef) {
 	cs.Lock()
 	defer cs.Unlock()
@@ -1010,16 +1247,8 @@ func (cs *compactStatus) delete(cd compactDef) {
 		found = nextLevel.remove(cd.nextRange) && found
 	}
 
-	if !found {
-		this := cd.thisRange
-		next := cd.nextRange
-		fmt.Printf("Looking for: %s in this level %d.\n", this, tl)
-		fmt.Printf("This Level:\n%s\n", thisLevel.debug())
-		fmt.Println()
-		fmt.Printf("Looking for: %s in next level %d.\n", next, cd.nextLevel.levelNum)
-		fmt.Printf("Next Level:\n%s\n", nextLevel.debug())
-		log.Fatal("keyRange not found")
-	}
+	utils.CondPanic(!found, fmt.Errorf("keyRange not found: looking for %s in level %d:\n%s\nlooking for %s in level %d:\n%s",
+		cd.thisRange, tl, thisLevel.debug(), cd.nextRange, cd.nextLevel.levelNum, nextLevel.debug()))
 	for _, t := range append(cd.top, cd.bot...) {
 		_, ok := cs.tables[t.fid]
 		utils.CondPanic(!ok, fmt.Errorf("cs.tables is nil"))
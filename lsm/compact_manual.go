@@ -0,0 +1,188 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// manualCompactorID 手动压缩在日志与事件中使用的压缩器编号, 与后台压缩器区分
+const manualCompactorID = -1
+
+// CompactRange 从l0开始把与[start, end]重合的sst逐层合并到下一层, 直到最后一层,
+// start与end为用户key, nil表示不限制. 内存表中的数据需要先刷盘, 阻塞直到合并完成
+func (lsm *LSM) CompactRange(start, end []byte) error {
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+	return lsm.levels.compactRange(start, end)
+}
+
+// Flatten 把所有sst合并到最后一层, workers为同一层并发合并的协程数, 阻塞直到合并完成
+func (lsm *LSM) Flatten(workers int) error {
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+	if workers < 1 {
+		workers = 1
+	}
+	return lsm.levels.flatten(workers)
+}
+
+func (lm *levelManager) compactRange(start, end []byte) error {
+	last := lm.lastLevel().levelNum
+	for l := 0; l < last; l++ {
+		if err := lm.compactManual(l, l+1, start, end, 1); err != nil {
+			return err
+		}
+	}
+	lm.opt.Logger.Info("compact range done", "start", start, "end", end)
+	return nil
+}
+
+func (lm *levelManager) flatten(workers int) error {
+	last := lm.lastLevel().levelNum
+	for {
+		// 找到最后一层之上最深的非空层, 它与最后一层之间没有数据, 可以直接合并到最后一层
+		l := -1
+		for i := last - 1; i >= 0; i-- {
+			if lm.levels[i].numTables() > 0 {
+				l = i
+				break
+			}
+		}
+		if l < 0 {
+			lm.opt.Logger.Info("flatten done", "level", last, "tables", lm.levels[last].numTables())
+			return nil
+		}
+		if err := lm.compactManual(l, last, nil, nil, workers); err != nil {
+			return err
+		}
+	}
+}
+
+// compactManual 把this层与[start, end]重合的sst全部合并到next层, workers个协程并发执行,
+// 与后台压缩冲突的sst会等待其完成后再合并
+func (lm *levelManager) compactManual(this, next int, start, end []byte, workers int) error {
+	limit := (lm.levels[this].numTables() + workers - 1) / workers
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errCh <- lm.compactManualWorker(this, next, start, end, limit)
+		}()
+	}
+	var err error
+	for i := 0; i < workers; i++ {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (lm *levelManager) compactManualWorker(this, next int, start, end []byte, limit int) error {
+	for {
+		cd := compactDef{
+			compactorId: manualCompactorID,
+			t:           lm.strategy().targets(lm),
+			thisLevel:   lm.levels[this],
+			nextLevel:   lm.levels[next],
+		}
+		ok, busy := lm.fillManualTables(&cd, start, end, limit)
+		if !ok {
+			if !busy {
+				return nil
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+				continue
+			case <-lm.lsm.closer.CloseSignal:
+				return utils.ErrCompactionAborted
+			}
+		}
+		err := lm.runCompactDef(cd.compactorId, this, cd)
+		lm.compactState.delete(cd)
+		if err != nil {
+			return err
+		}
+		lm.opt.Logger.Debug("manual compaction done", "from", this, "to", next, "top", len(cd.top), "bot", len(cd.bot))
+	}
+}
+
+// fillManualTables 选择thisLevel中与[start, end]重合的连续sst, 最多limit个, l0的sst之间互相重合, 总是全部选择.
+// ok为false时如果busy为true, 说明还有sst正被其他压缩占用, 需要稍后重试
+func (lm *levelManager) fillManualTables(cd *compactDef, start, end []byte, limit int) (ok, busy bool) {
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	var top []*table
+	if cd.thisLevel.levelNum == 0 {
+		for _, t := range cd.thisLevel.tables {
+			if tableInRange(t, start, end) {
+				top = append(top, cd.thisLevel.tables...)
+				break
+			}
+		}
+	} else {
+		for _, t := range cd.thisLevel.tables {
+			if !tableInRange(t, start, end) {
+				continue
+			}
+			if lm.compactState.overlapsWith(cd.thisLevel.levelNum, getKeyRange(t)) {
+				busy = true
+				if len(top) > 0 {
+					break
+				}
+				continue
+			}
+			if top = append(top, t); len(top) >= limit {
+				break
+			}
+		}
+	}
+	if len(top) == 0 {
+		return false, busy
+	}
+
+	cd.top = top
+	cd.thisRange = getKeyRange(top...)
+	for _, t := range top {
+		cd.thisSize += t.Size()
+	}
+	left, right := cd.nextLevel.overlappingTables(levelHandlerRLocked{}, cd.thisRange)
+	cd.bot = make([]*table, right-left)
+	copy(cd.bot, cd.nextLevel.tables[left:right])
+	if len(cd.bot) == 0 {
+		cd.nextRange = cd.thisRange
+	} else {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	if !lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd) {
+		return false, true
+	}
+	return true, false
+}
+
+// tableInRange 判断sst与用户key区间[start, end]是否重合
+func tableInRange(t *table, start, end []byte) bool {
+	if len(end) > 0 && bytes.Compare(utils.ParseKey(t.ss.MinKey()), end) > 0 {
+		return false
+	}
+	if len(start) > 0 && bytes.Compare(utils.ParseKey(t.ss.MaxKey()), start) < 0 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import "github.com/hardcore-os/corekv/utils"
+
+// CompactionDecision 压缩过滤器对一个key的处理决定
+type CompactionDecision int
+
+const (
+	// CompactionKeep 原样保留
+	CompactionKeep CompactionDecision = iota
+	// CompactionDrop 删除这个key
+	CompactionDrop
+	// CompactionChangeValue 用过滤器返回的value替换原来的value
+	CompactionChangeValue
+)
+
+// CompactionFilter 压缩时对每个未过期且不是墓碑的key调用, 在多个压缩协程中并发执行, 实现必须并发安全
+type CompactionFilter interface {
+	// Filter level为压缩的目标层, entry的Key带有版本, Value可能是值指针, 不能修改entry
+	Filter(level int, entry *utils.Entry) (decision CompactionDecision, newValue []byte)
+}
+
+// filterEntry 对entry执行压缩过滤器, 返回需要写入的entry, 为nil时直接丢弃.
+// 删除的key如果在更低的层还有旧值, 需要写入一个已经过期的墓碑遮住旧值, 此时stale为true.
+// 没有旧值时直接丢弃: sst中的数据都在持久化的vlog head之前, 重新打开时不会被重放回来
+func (lm *levelManager) filterEntry(cd *compactDef, e *utils.Entry) (out *utils.Entry, stale bool) {
+	decision, newValue := lm.opt.CompactionFilter.Filter(cd.nextLevel.levelNum, e)
+	switch decision {
+	case CompactionDrop:
+		if !cd.hasOverlap {
+			return nil, false
+		}
+		return &utils.Entry{Key: e.Key, ExpiresAt: 1}, true
+	case CompactionChangeValue:
+		// 新的value直接写入sst, 不再是值指针
+		return &utils.Entry{Key: e.Key, Value: newValue, ExpiresAt: e.ExpiresAt, Meta: e.Meta &^ utils.BitValuePointer}, false
+	}
+	return e, false
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import "time"
+
+// EventListener lsm后台任务的回调, 在执行任务的协程中同步调用,
+// 实现必须并发安全且尽快返回, 不能在回调中调用DB或LSM的方法
+type EventListener interface {
+	OnFlushBegin(info FlushInfo)
+	OnFlushEnd(info FlushInfo)
+	OnCompactionBegin(info CompactionInfo)
+	OnCompactionEnd(info CompactionInfo)
+	// OnTableCreated 与 OnTableDeleted 的reason为"flush"或"compaction"
+	OnTableCreated(info TableInfo, reason string)
+	OnTableDeleted(info TableInfo, reason string)
+	// OnBackgroundError 后台任务出错时调用, reason为出错的任务, 如"compaction"
+	OnBackgroundError(reason string, err error)
+}
+
+// FlushInfo 一次内存表刷盘, Table、Duration与Err只在OnFlushEnd中有效
+type FlushInfo struct {
+	MemTableSize int64 // 内存表wal的字节数
+	Table        TableInfo
+	Duration     time.Duration
+	Err          error
+}
+
+// CompactionInfo 一次压缩, Outputs、OutputBytes、Duration与Err只在OnCompactionEnd中有效
+type CompactionInfo struct {
+	CompactorID int
+	FromLevel   int
+	ToLevel     int
+	Inputs      []TableInfo
+	Outputs     []TableInfo
+	InputBytes  int64
+	OutputBytes int64
+	Duration    time.Duration
+	Err         error
+}
+
+// BaseEventListener 所有回调都为空的实现, 可以嵌入到只关心部分事件的实现中
+type BaseEventListener struct{}
+
+// OnFlushBegin _
+func (BaseEventListener) OnFlushBegin(FlushInfo) {}
+
+// OnFlushEnd _
+func (BaseEventListener) OnFlushEnd(FlushInfo) {}
+
+// OnCompactionBegin _
+func (BaseEventListener) OnCompactionBegin(CompactionInfo) {}
+
+// OnCompactionEnd _
+func (BaseEventListener) OnCompactionEnd(CompactionInfo) {}
+
+// OnTableCreated _
+func (BaseEventListener) OnTableCreated(TableInfo, string) {}
+
+// OnTableDeleted _
+func (BaseEventListener) OnTableDeleted(TableInfo, string) {}
+
+// OnBackgroundError _
+func (BaseEventListener) OnBackgroundError(string, error) {}
+
+// tableInfos 收集一组sst的信息, 需要在sst被关闭之前调用
+func tableInfos(tables []*table, level int) ([]TableInfo, int64) {
+	var size int64
+	infos := make([]TableInfo, 0, len(tables))
+	for _, t := range tables {
+		info := t.info(level)
+		size += info.Size
+		infos = append(infos, info)
+	}
+	return infos, size
+}
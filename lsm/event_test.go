@@ -0,0 +1,231 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+type compactionListener struct {
+	BaseEventListener
+	sync.Mutex
+	begin, end []CompactionInfo
+	created    map[uint64]string
+	deleted    map[uint64]string
+}
+
+func (l *compactionListener) OnCompactionBegin(info CompactionInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.begin = append(l.begin, info)
+}
+
+func (l *compactionListener) OnCompactionEnd(info CompactionInfo) {
+	l.Lock()
+	defer l.Unlock()
+	l.end = append(l.end, info)
+}
+
+func (l *compactionListener) OnTableCreated(info TableInfo, reason string) {
+	l.Lock()
+	defer l.Unlock()
+	l.created[info.ID] = reason
+}
+
+func (l *compactionListener) OnTableDeleted(info TableInfo, reason string) {
+	l.Lock()
+	defer l.Unlock()
+	l.deleted[info.ID] = reason
+}
+
+func TestCompactionEvents(t *testing.T) {
+	clearDir()
+	l := &compactionListener{created: map[uint64]string{}, deleted: map[uint64]string{}}
+	c := make(chan map[uint32]int64, 16)
+	lopt := *opt
+	lopt.DiscardStatsCh = &c
+	lopt.EventListener = l
+	lsm := NewLSM(&lopt)
+	defer lsm.Close()
+
+	baseTest(t, lsm, 128)
+	require.NotEmpty(t, lsm.levels.levels[0].tables)
+	for _, tbl := range lsm.levels.levels[0].tables {
+		require.Equal(t, "flush", l.created[tbl.fid])
+	}
+
+	cd := buildCompactDef(lsm, 0, 0, 1)
+	tricky(cd.thisLevel.tables)
+	require.True(t, lsm.levels.fillTables(cd))
+	require.NoError(t, lsm.levels.runCompactDef(0, 0, *cd))
+	lsm.levels.compactState.delete(*cd)
+
+	l.Lock()
+	defer l.Unlock()
+	require.Len(t, l.begin, 1)
+	require.Len(t, l.end, 1)
+	info := l.end[0]
+	require.NoError(t, info.Err)
+	require.Equal(t, 0, info.FromLevel)
+	require.Equal(t, 1, info.ToLevel)
+	require.Equal(t, l.begin[0].Inputs, info.Inputs)
+	require.NotEmpty(t, info.Outputs)
+	require.NotZero(t, info.InputBytes)
+	require.NotZero(t, info.OutputBytes)
+	for _, in := range info.Inputs {
+		require.Equal(t, "compaction", l.deleted[in.ID])
+	}
+	for _, out := range info.Outputs {
+		require.Equal(t, 1, out.Level)
+		require.Equal(t, "compaction", l.created[out.ID])
+	}
+	m := lsm.Metrics()
+	require.Equal(t, info.OutputBytes, m.Levels[1].CompactionBytesWritten)
+}
+
+// blockingFlushListener 在flush开始时阻塞, 直到release被关闭
+type blockingFlushListener struct {
+	BaseEventListener
+	once             sync.Once
+	started, release chan struct{}
+}
+
+func (l *blockingFlushListener) OnFlushBegin(FlushInfo) {
+	l.once.Do(func() { close(l.started) })
+	<-l.release
+}
+
+// TestFlushDoesNotBlockReadWrite 刷盘期间依然可以读写内存表, 刷盘完成后数据在L0中可读
+func TestFlushDoesNotBlockReadWrite(t *testing.T) {
+	clearDir()
+	l := &blockingFlushListener{started: make(chan struct{}), release: make(chan struct{})}
+	lopt := *opt
+	lopt.EventListener = l
+	lsm := NewLSM(&lopt)
+	defer lsm.Close()
+	entry := func(k string) *utils.Entry {
+		return utils.NewEntry(utils.KeyWithTs([]byte(k), math.MaxUint32), []byte("val"))
+	}
+	old := entry("old")
+	require.NoError(t, lsm.Set(old))
+	flushed := make(chan error, 1)
+	go func() { flushed <- lsm.Flush() }()
+	<-l.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, lsm.Set(entry("new")))
+		_, err := lsm.Get(old.Key)
+		require.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(l.release)
+		t.Fatal("read and write blocked by flush")
+	}
+	close(l.release)
+	require.NoError(t, <-flushed)
+	require.Equal(t, 1, lsm.levels.levels[0].numTables())
+	_, err := lsm.Get(old.Key)
+	require.NoError(t, err)
+}
+
+// TestBackgroundFlush 写满memtable的写入只通知后台刷盘, 刷盘(包括限速)阻塞时写入与读取照常进行
+func TestBackgroundFlush(t *testing.T) {
+	clearDir()
+	l := &blockingFlushListener{started: make(chan struct{}), release: make(chan struct{})}
+	lopt := *opt
+	lopt.EventListener = l
+	lsm := NewLSM(&lopt)
+	defer lsm.Close()
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), math.MaxUint32) }
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 第一个immutable的刷盘被阻塞之后继续写入, 直到切换出第二个immutable
+		for i := 0; ; i++ {
+			require.NoError(t, lsm.Set(utils.NewEntry(key(i), []byte("val"))))
+			if _, imms := lsm.memTables(); len(imms) >= 2 {
+				break
+			}
+		}
+		_, err := lsm.Get(key(0))
+		require.NoError(t, err)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(l.release)
+		t.Fatal("writes blocked by a background flush")
+	}
+	<-l.started
+	require.Zero(t, lsm.levels.levels[0].numTables())
+	close(l.release)
+	waitFlushed(lsm)
+	require.GreaterOrEqual(t, lsm.levels.levels[0].numTables(), 2)
+}
+
+// flushErrorListener 记录后台错误
+type flushErrorListener struct {
+	BaseEventListener
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (l *flushErrorListener) OnBackgroundError(reason string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reasons = append(l.reasons, reason)
+}
+
+// TestFlushRetry 后台刷盘失败时上报错误并重试, 不需要新的写入触发
+func TestFlushRetry(t *testing.T) {
+	clearDir()
+	l := &flushErrorListener{}
+	lopt := *opt
+	lopt.EventListener = l
+	var calls int32
+	lopt.BeforeFlush = func() error {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	lsm := NewLSM(&lopt)
+	defer lsm.Close()
+	for i := 0; ; i++ {
+		require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), 1), []byte("val"))))
+		if _, imms := lsm.memTables(); len(imms) > 0 {
+			break
+		}
+	}
+	waitFlushed(lsm)
+	require.Equal(t, 1, lsm.levels.levels[0].numTables())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	require.Equal(t, []string{"flush", "flush"}, l.reasons)
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// FIFOOptions 先进先出压缩的参数
+type FIFOOptions struct {
+	// MaxTableFilesSize 所有sst的总大小超过该值时从最老的sst开始删除, 0表示不限制
+	MaxTableFilesSize int64
+}
+
+// fifoStrategy 先进先出压缩, 适合每个key都带有过期时间且写入后不再覆盖的时序数据.
+// flush产生的sst留在l0, 从不重写: 所有entry都已过期的sst, 以及总大小超过MaxTableFilesSize时最老的sst会被直接删除.
+// 删除sst可能使同一个key更老的版本重新可见, 因此不适合覆盖写的负载. l0不再限制写入, 读放大随sst数量增长.
+// key区间与内部key的前缀相交的sst可能包含复制进度这类内部数据, 超过总大小时也不会被删除
+type fifoStrategy struct {
+	opt            FIFOOptions
+	internalPrefix []byte
+}
+
+func (s *fifoStrategy) targets(lm *levelManager) targets {
+	return uniformTargets(lm)
+}
+
+func (s *fifoStrategy) throttlesL0() bool { return false }
+
+// priorities 由深到浅返回有sst需要删除的level, 切换策略之前写入更深层的sst更老, 超过总大小时先删除
+func (s *fifoStrategy) priorities(lm *levelManager, id int) []compactionPriority {
+	t := s.targets(lm)
+	now := uint64(time.Now().Unix())
+	over := s.overSize(lm)
+	var prios []compactionPriority
+	for i := len(lm.levels) - 1; i >= 0; i-- {
+		lh := lm.levels[i]
+		if lh.numTables() == 0 {
+			continue
+		}
+		if over > 0 || s.hasExpired(lh, now) {
+			prios = append(prios, compactionPriority{level: i, score: 1, adjusted: 1, t: t})
+		}
+		over -= lh.getTotalSize()
+	}
+	return prios
+}
+
+// fill 选择thisLevel中已过期的sst, 超过总大小时再按从老到新的顺序补充, 只删除不重写
+func (s *fifoStrategy) fill(lm *levelManager, cd *compactDef) bool {
+	cd.nextLevel = cd.thisLevel
+	cd.deleteOnly = true
+
+	over := s.overSize(lm)
+	for _, lh := range lm.levels[cd.thisLevel.levelNum+1:] {
+		over -= lh.getTotalSize()
+	}
+	now := uint64(time.Now().Unix())
+
+	cd.thisLevel.RLock()
+	defer cd.thisLevel.RUnlock()
+	lm.compactState.Lock()
+	defer lm.compactState.Unlock()
+
+	tables := append([]*table{}, cd.thisLevel.tables...)
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].fid < tables[j].fid
+	})
+	var top []*table
+	for _, t := range tables {
+		if _, beingCompacted := lm.compactState.tables[t.fid]; beingCompacted {
+			continue
+		}
+		if s.mayHoldInternal(t) {
+			continue
+		}
+		if over > 0 || t.expired(now) {
+			top = append(top, t)
+			over -= t.Size()
+		}
+	}
+	if len(top) == 0 {
+		return false
+	}
+	cd.top = top
+	cd.thisRange = getKeyRange(top...)
+	for _, t := range top {
+		cd.thisSize += t.Size()
+	}
+	// 源与目标是同一层, 只登记一次区间, 与l0 to l0的压缩一致
+	thisLevel := lm.compactState.levels[cd.thisLevel.levelNum]
+	if thisLevel.overlapsWith(cd.thisRange) {
+		return false
+	}
+	thisLevel.ranges = append(thisLevel.ranges, cd.thisRange)
+	thisLevel.delSize += cd.thisSize
+	for _, t := range top {
+		lm.compactState.tables[t.fid] = struct{}{}
+	}
+	return true
+}
+
+// overSize 返回所有sst的总大小超过MaxTableFilesSize的部分
+func (s *fifoStrategy) overSize(lm *levelManager) int64 {
+	if s.opt.MaxTableFilesSize <= 0 {
+		return 0
+	}
+	var total int64
+	for _, lh := range lm.levels {
+		total += lh.getTotalSize()
+	}
+	return total - s.opt.MaxTableFilesSize
+}
+
+func (s *fifoStrategy) hasExpired(lh *levelHandler, now uint64) bool {
+	lh.RLock()
+	defer lh.RUnlock()
+	for _, t := range lh.tables {
+		if t.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayHoldInternal sst的用户key区间与内部key的前缀相交时, 其中可能有内部key
+func (s *fifoStrategy) mayHoldInternal(t *table) bool {
+	if len(s.internalPrefix) == 0 {
+		return false
+	}
+	min, max := utils.ParseKey(t.ss.MinKey()), utils.ParseKey(t.ss.MaxKey())
+	return bytes.Compare(max, s.internalPrefix) >= 0 &&
+		(bytes.Compare(min, s.internalPrefix) <= 0 || bytes.HasPrefix(min, s.internalPrefix))
+}
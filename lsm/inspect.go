@@ -0,0 +1,147 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"io/ioutil"
+	"math"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// TableSummary 一个sst文件解析后的信息
+type TableSummary struct {
+	Size          int64
+	IndexLen      int   // footer中记录的索引长度
+	IndexChecksum error // 索引checksum的校验结果, nil 表示通过
+	KeyCount      uint32
+	MaxVersion    uint64
+	StaleDataSize uint32
+	BloomSize     int     // 布隆过滤器的字节数
+	BloomHashes   int     // 布隆过滤器使用的hash函数个数
+	BloomFPR      float64 // 按key数量估算的假阳性率
+	MinKey        []byte
+	MaxKey        []byte
+	Blocks        []BlockSummary
+
+	// 压缩使用的统计信息, 见pb.TableIndex, 时间均为unix秒
+	TombstoneCount  uint32
+	TTLDataSize     uint64
+	MinExpiresAt    uint64
+	MaxExpiresAt    uint64
+	OldestEntryTime uint64
+}
+
+// BlockSummary 一个block的信息
+type BlockSummary struct {
+	BaseKey    []byte
+	Offset     uint32
+	Len        uint32
+	NumEntries int
+	Checksum   error // block checksum的校验结果, nil 表示通过
+}
+
+// InspectTable 不依赖levelManager直接解析一个sst文件, 文件损坏时尽可能多地返回已解析的信息
+// fn 不为空时按顺序回调每一个kv, 校验失败的block会被跳过, entry 在回调返回后不可再使用
+func InspectTable(path string, fn func(e *utils.Entry) error) (*TableSummary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ts := &TableSummary{Size: int64(len(data))}
+
+	// footer: | index | index_len(4B) | checksum | checksum_len(4B) |
+	readPos := len(data) - 4
+	if readPos < 0 {
+		return ts, errors.New("sst is too small")
+	}
+	checksumLen := int(utils.BytesToU32(data[readPos:]))
+	readPos -= checksumLen
+	if readPos < 4 {
+		return ts, errors.Errorf("invalid checksum length: %d", checksumLen)
+	}
+	checksum := data[readPos : readPos+checksumLen]
+	readPos -= 4
+	ts.IndexLen = int(utils.BytesToU32(data[readPos : readPos+4]))
+	readPos -= ts.IndexLen
+	if readPos < 0 {
+		return ts, errors.Errorf("invalid index length: %d", ts.IndexLen)
+	}
+	index := data[readPos : readPos+ts.IndexLen]
+	ts.IndexChecksum = utils.VerifyChecksum(index, checksum)
+
+	idx := &pb.TableIndex{}
+	if err := idx.Unmarshal(index); err != nil {
+		return ts, errors.Wrap(err, "failed to decode table index")
+	}
+	ts.KeyCount = idx.KeyCount
+	ts.MaxVersion = idx.MaxVersion
+	ts.StaleDataSize = idx.StaleDataSize
+	ts.TombstoneCount = idx.TombstoneCount
+	ts.TTLDataSize = idx.TtlDataSize
+	ts.MinExpiresAt = idx.MinExpiresAt
+	ts.MaxExpiresAt = idx.MaxExpiresAt
+	ts.OldestEntryTime = idx.OldestEntryTime
+	if bf := idx.BloomFilter; len(bf) > 1 {
+		ts.BloomSize = len(bf)
+		ts.BloomHashes = int(bf[len(bf)-1])
+		ts.BloomFPR = bloomFPR(len(bf)-1, ts.BloomHashes, int(ts.KeyCount))
+	}
+
+	for _, ko := range idx.Offsets {
+		bs := BlockSummary{BaseKey: ko.Key, Offset: ko.Offset, Len: ko.Len}
+		if ts.MinKey == nil {
+			ts.MinKey = ko.Key
+		}
+		end := int(ko.Offset) + int(ko.Len)
+		if end > len(data) {
+			bs.Checksum = errors.Errorf("block [%d, %d) is out of file", ko.Offset, end)
+			ts.Blocks = append(ts.Blocks, bs)
+			continue
+		}
+		b, err := decodeBlock(int(ko.Offset), data[ko.Offset:end])
+		if err != nil {
+			bs.Checksum = err
+			ts.Blocks = append(ts.Blocks, bs)
+			continue
+		}
+		bs.NumEntries = len(b.entryOffsets)
+		ts.Blocks = append(ts.Blocks, bs)
+
+		bi := &blockIterator{}
+		bi.setBlock(b)
+		for bi.seekToFirst(); bi.Valid(); bi.Next() {
+			e := bi.Item().Entry()
+			ts.MaxKey = append(ts.MaxKey[:0], e.Key...)
+			if fn != nil {
+				if err := fn(e); err != nil {
+					return ts, err
+				}
+			}
+		}
+	}
+	return ts, nil
+}
+
+// bloomFPR 估算布隆过滤器的假阳性率 (1 - e^(-kn/m))^k
+func bloomFPR(bytes, k, n int) float64 {
+	m := float64(bytes * 8)
+	if m == 0 || n == 0 {
+		return 0
+	}
+	return math.Pow(1-math.Exp(-float64(k*n)/m), float64(k))
+}
@@ -0,0 +1,76 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectTable(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	bopt := *opt
+	bopt.BlockSize = 256
+	bopt.BloomFalsePositive = 0.01
+	builder := newTableBuiler(&bopt)
+	n := 100
+	for i := 0; i < n; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), uint64(i+1)), []byte("value"))
+		if i%10 == 0 {
+			e.Meta = utils.BitDelete
+		}
+		builder.add(e, false)
+	}
+	name := utils.FileNameSSTable(opt.WorkDir, 1)
+	tbl := openTable(lsm.levels, name, builder)
+	assert.NotNil(t, tbl)
+	defer tbl.DecrRef()
+
+	var keys, deleted int
+	ts, err := InspectTable(name, func(e *utils.Entry) error {
+		if e.Meta&utils.BitDelete > 0 {
+			deleted++
+		}
+		keys++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, ts.IndexChecksum)
+	assert.Equal(t, n, keys)
+	assert.Equal(t, n/10, deleted)
+	assert.Equal(t, uint32(n), ts.KeyCount)
+	assert.Equal(t, uint64(n), ts.MaxVersion)
+	assert.Equal(t, "key000", string(utils.ParseKey(ts.MinKey)))
+	assert.Equal(t, "key099", string(utils.ParseKey(ts.MaxKey)))
+	assert.True(t, len(ts.Blocks) > 1)
+	assert.True(t, ts.BloomSize > 0)
+	assert.True(t, ts.BloomFPR > 0 && ts.BloomFPR < 0.05)
+	var entries int
+	for _, b := range ts.Blocks {
+		assert.Nil(t, b.Checksum)
+		entries += b.NumEntries
+	}
+	assert.Equal(t, n, entries)
+
+	// 破坏第二个block, 只影响该block的校验结果
+	lost := ts.Blocks[1].NumEntries
+	f, err := os.OpenFile(name, os.O_RDWR, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff}, int64(ts.Blocks[1].Offset)+8)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	keys = 0
+	ts, err = InspectTable(name, func(e *utils.Entry) error {
+		keys++
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, ts.Blocks[0].Checksum)
+	assert.NotNil(t, ts.Blocks[1].Checksum)
+	assert.Equal(t, n-lost, keys)
+}
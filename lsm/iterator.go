@@ -20,6 +20,7 @@ import (
 	"sort"
 
 	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
 )
 
 type Iterator struct {
@@ -38,11 +39,12 @@ func (it *Item) Entry() *utils.Entry {
 func (lsm *LSM) NewIterators(opt *utils.Options) []utils.Iterator {
 	iter := &Iterator{}
 	iter.iters = make([]utils.Iterator, 0)
-	iter.iters = append(iter.iters, lsm.memTable.NewIterator(opt))
-	for _, imm := range lsm.immutables {
+	mt, immutables := lsm.memTables()
+	iter.iters = append(iter.iters, mt.NewIterator(opt))
+	for _, imm := range immutables {
 		iter.iters = append(iter.iters, imm.NewIterator(opt))
 	}
-	iter.iters = append(iter.iters, lsm.levels.iterators()...)
+	iter.iters = append(iter.iters, lsm.levels.iterators(opt)...)
 	return iter.iters
 }
 func (iter *Iterator) Next() {
@@ -66,19 +68,28 @@ func (iter *Iterator) Seek(key []byte) {
 
 // 内存表迭代器
 type memIterator struct {
-	innerIter utils.Iterator
+	innerIter *utils.SkipListIterator
+	reverse   bool
 }
 
 func (m *memTable) NewIterator(opt *utils.Options) utils.Iterator {
-	return &memIterator{innerIter: m.sl.NewSkipListIterator()}
+	return &memIterator{innerIter: m.sl.NewSkipListIterator().(*utils.SkipListIterator), reverse: !opt.IsAsc}
 }
 func (iter *memIterator) Next() {
+	if iter.reverse {
+		iter.innerIter.Prev()
+		return
+	}
 	iter.innerIter.Next()
 }
 func (iter *memIterator) Valid() bool {
 	return iter.innerIter.Valid()
 }
 func (iter *memIterator) Rewind() {
+	if iter.reverse {
+		iter.innerIter.SeekToLast()
+		return
+	}
 	iter.innerIter.Rewind()
 }
 func (iter *memIterator) Item() utils.Item {
@@ -88,6 +99,11 @@ func (iter *memIterator) Close() error {
 	return iter.innerIter.Close()
 }
 func (iter *memIterator) Seek(key []byte) {
+	if iter.reverse {
+		iter.innerIter.SeekForPrev(key)
+		return
+	}
+	iter.innerIter.Seek(key)
 }
 
 // levelManager上的迭代器
@@ -97,7 +113,7 @@ type levelIterator struct {
 }
 
 func (lm *levelManager) NewIterators(options *utils.Options) []utils.Iterator {
-	return lm.iterators()
+	return lm.iterators(options)
 }
 func (iter *levelIterator) Next() {
 }
@@ -154,7 +170,7 @@ func (s *ConcatIterator) Rewind() {
 	if len(s.iters) == 0 {
 		return
 	}
-	if !s.options.IsAsc {
+	if s.options.IsAsc {
 		s.setIdx(0)
 	} else {
 		s.setIdx(len(s.iters) - 1)
@@ -203,7 +219,7 @@ func (s *ConcatIterator) Next() {
 		return
 	}
 	for { // In case there are empty tables.
-		if !s.options.IsAsc {
+		if s.options.IsAsc {
 			s.setIdx(s.idx + 1)
 		} else {
 			s.setIdx(s.idx - 1)
@@ -408,9 +424,9 @@ func (mi *MergeIterator) Close() error {
 	err1 := mi.left.iter.Close()
 	err2 := mi.right.iter.Close()
 	if err1 != nil {
-		return utils.WarpErr("MergeIterator", err1)
+		return errors.Wrap(err1, "MergeIterator")
 	}
-	return utils.WarpErr("MergeIterator", err2)
+	return errors.Wrap(err2, "MergeIterator")
 }
 
 // NewMergeIterator creates a merge iterator.
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/hardcore-os/corekv/file"
 	"github.com/hardcore-os/corekv/utils"
@@ -14,12 +15,16 @@ import (
 func (lsm *LSM) initLevelManager(opt *Options) *levelManager {
 	lm := &levelManager{lsm: lsm} // 反引用
 	lm.compactState = lsm.newCompactStatus()
+	lm.compactCh = make(chan struct{}, 1)
 	lm.opt = opt
+	lm.compaction = newCompactionStrategy(opt)
 	// 读取manifest文件构建管理器
 	if err := lm.loadManifest(); err != nil {
 		panic(err)
 	}
-	lm.build()
+	if err := lm.build(); err != nil {
+		panic(err)
+	}
 	return lm
 }
 
@@ -31,6 +36,8 @@ type levelManager struct {
 	levels       []*levelHandler
 	lsm          *LSM
 	compactState *compactStatus
+	compactCh    chan struct{} // 通知压缩协程立即检查是否需要压缩
+	compaction   compactionStrategy
 }
 
 func (lm *levelManager) close() error {
@@ -48,11 +55,11 @@ func (lm *levelManager) close() error {
 	return nil
 }
 
-func (lm *levelManager) iterators() []utils.Iterator {
+func (lm *levelManager) iterators(opt *utils.Options) []utils.Iterator {
 
 	itrs := make([]utils.Iterator, 0, len(lm.levels))
 	for _, level := range lm.levels {
-		itrs = append(itrs, level.iterators()...)
+		itrs = append(itrs, level.iterators(opt)...)
 	}
 	return itrs
 }
@@ -80,7 +87,7 @@ func (lm *levelManager) loadCache() {
 
 }
 func (lm *levelManager) loadManifest() (err error) {
-	lm.manifestFile, err = file.OpenManifestFile(&file.Options{Dir: lm.opt.WorkDir})
+	lm.manifestFile, err = file.OpenManifestFile(&file.Options{Dir: lm.opt.WorkDir, Logger: lm.opt.Logger})
 	return err
 }
 
@@ -111,7 +118,6 @@ func (lm *levelManager) build() error {
 		}
 		t := openTable(lm, fileName, nil) // 这一步挺耗资源的
 		lm.levels[tableInfo.Level].add(t)
-		lm.levels[tableInfo.Level].addSize(t) // 记录一个level的文件总大小
 	}
 	// 对每一层进行排序
 	for i := 0; i < lm.opt.MaxLevelNum; i++ {
@@ -124,12 +130,27 @@ func (lm *levelManager) build() error {
 
 // 向L0层flush一个sstable
 func (lm *levelManager) flush(immutable *memTable) (err error) {
+	start := time.Now()
+	info := FlushInfo{MemTableSize: int64(immutable.wal.Size())}
+	listener := lm.listener()
+	listener.OnFlushBegin(info)
+	defer func() {
+		info.Duration = time.Since(start)
+		info.Err = err
+		listener.OnFlushEnd(info)
+	}()
+	if lm.opt.BeforeFlush != nil {
+		if err = lm.opt.BeforeFlush(); err != nil {
+			return err
+		}
+	}
 	// 分配一个fid
 	fid := immutable.wal.Fid()
 	sstName := utils.FileNameSSTable(lm.opt.WorkDir, fid)
 
 	// 构建一个 builder
 	builder := newTableBuiler(lm.opt)
+	builder.ioPriority = utils.IOPriorityHigh
 	iter := immutable.sl.NewSkipListIterator()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
 		entry := iter.Item().Entry()
@@ -145,9 +166,22 @@ func (lm *levelManager) flush(immutable *memTable) (err error) {
 	utils.Panic(err)
 	// 更新manifest文件
 	lm.levels[0].add(table)
+	info.Table = table.info(0)
+	lm.lsm.metrics.addFlush(time.Since(start), info.Table.Size)
+	listener.OnTableCreated(info.Table, "flush")
+	// l0新增了sst, 让压缩协程重新计算各层的得分
+	lm.triggerCompaction()
 	return
 }
 
+// listener 没有配置EventListener时返回空实现
+func (lm *levelManager) listener() EventListener {
+	if lm.opt.EventListener == nil {
+		return BaseEventListener{}
+	}
+	return lm.opt.EventListener
+}
+
 //--------- level处理器 -------
 type levelHandler struct {
 	sync.RWMutex
@@ -170,6 +204,7 @@ func (lh *levelHandler) add(t *table) {
 	lh.Lock()
 	defer lh.Unlock()
 	lh.tables = append(lh.tables, t)
+	lh.addSize(t) // 记录一个level的文件总大小
 }
 func (lh *levelHandler) addBatch(ts []*table) {
 	lh.Lock()
@@ -230,8 +265,9 @@ func (lh *levelHandler) Sort() {
 
 func (lh *levelHandler) searchL0SST(key []byte) (*utils.Entry, error) {
 	var version uint64
-	for _, table := range lh.tables {
-		if entry, err := table.Serach(key, &version); err == nil {
+	// l0层的sst按fid升序排列，越靠后的越新，因此从后往前查找
+	for i := len(lh.tables) - 1; i >= 0; i-- {
+		if entry, err := lh.tables[i].Serach(key, &version); err == nil {
 			return entry, nil
 		}
 	}
@@ -249,9 +285,11 @@ func (lh *levelHandler) searchLNSST(key []byte) (*utils.Entry, error) {
 	return nil, utils.ErrKeyNotFound
 }
 func (lh *levelHandler) getTable(key []byte) *table {
+	// 同一个key的多个版本可能跨越sst的边界, 因此只比较去掉时间戳的key
+	userKey := utils.ParseKey(key)
 	for i := len(lh.tables) - 1; i >= 0; i-- {
-		if bytes.Compare(key, lh.tables[i].ss.MinKey()) > -1 &&
-			bytes.Compare(key, lh.tables[i].ss.MaxKey()) < 1 {
+		if bytes.Compare(userKey, utils.ParseKey(lh.tables[i].ss.MinKey())) > -1 &&
+			bytes.Compare(userKey, utils.ParseKey(lh.tables[i].ss.MaxKey())) < 1 {
 			return lh.tables[i]
 		}
 	}
@@ -273,8 +311,9 @@ func (lh *levelHandler) overlappingTables(_ levelHandlerRLocked, kr keyRange) (i
 	left := sort.Search(len(lh.tables), func(i int) bool {
 		return utils.CompareKeys(kr.left, lh.tables[i].ss.MaxKey()) <= 0
 	})
+	// 第一个最小key大于区间右边界的sst, 最大key大于右边界的sst仍可能与区间重合
 	right := sort.Search(len(lh.tables), func(i int) bool {
-		return utils.CompareKeys(kr.right, lh.tables[i].ss.MaxKey()) < 0
+		return utils.CompareKeys(kr.right, lh.tables[i].ss.MinKey()) < 0
 	})
 	return left, right
 }
@@ -311,7 +350,7 @@ func (lh *levelHandler) replaceTables(toDel, toAdd []*table) error {
 	// Assign tables.
 	lh.tables = newTables
 	sort.Slice(lh.tables, func(i, j int) bool {
-		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[i].ss.MinKey()) < 0
+		return utils.CompareKeys(lh.tables[i].ss.MinKey(), lh.tables[j].ss.MinKey()) < 0
 	})
 	lh.Unlock() // s.Unlock before we DecrRef tables -- that can be slow.
 	return decrRefs(toDel)
@@ -343,10 +382,10 @@ func (lh *levelHandler) deleteTables(toDel []*table) error {
 	return decrRefs(toDel)
 }
 
-func (lh *levelHandler) iterators() []utils.Iterator {
+func (lh *levelHandler) iterators(opt *utils.Options) []utils.Iterator {
 	lh.RLock()
 	defer lh.RUnlock()
-	topt := &utils.Options{IsAsc: true}
+	topt := &utils.Options{IsAsc: opt.IsAsc}
 	if lh.levelNum == 0 {
 		return iteratorsReversed(lh.tables, topt)
 	}
@@ -356,3 +395,83 @@ func (lh *levelHandler) iterators() []utils.Iterator {
 	}
 	return []utils.Iterator{NewConcatIterator(lh.tables, topt)}
 }
+
+// LevelInfo 某一层sst的分布情况，用于对外展示
+type LevelInfo struct {
+	Level     int
+	NumTables int
+	Size      int64
+	StaleSize int64
+	Tables    []TableInfo
+}
+
+// TableInfo sst文件的基本信息
+type TableInfo struct {
+	ID            uint64
+	Level         int
+	Size          int64
+	KeyCount      uint32
+	MaxVersion    uint64
+	StaleDataSize uint32
+	MinKey        []byte
+	MaxKey        []byte
+}
+
+// keySplits 以各层sst的最小key作为分割点, 返回去重排序后的用户key, 用于将key空间切分成多段并发扫描
+func (lm *levelManager) keySplits(prefix []byte) [][]byte {
+	var splits [][]byte
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			key := utils.ParseKey(t.ss.MinKey())
+			if bytes.HasPrefix(key, prefix) {
+				splits = append(splits, utils.SafeCopy(nil, key))
+			}
+		}
+		lh.RUnlock()
+	}
+	sort.Slice(splits, func(i, j int) bool { return bytes.Compare(splits[i], splits[j]) < 0 })
+	out := splits[:0]
+	for _, key := range splits {
+		if n := len(out); n > 0 && bytes.Equal(out[n-1], key) {
+			continue
+		}
+		out = append(out, key)
+	}
+	return out
+}
+
+// levelsInfo 收集每一层的sst信息
+func (lm *levelManager) levelsInfo() []LevelInfo {
+	infos := make([]LevelInfo, 0, len(lm.levels))
+	for _, lh := range lm.levels {
+		lh.RLock()
+		info := LevelInfo{
+			Level:     lh.levelNum,
+			NumTables: len(lh.tables),
+			Size:      lh.totalSize,
+			StaleSize: lh.totalStaleSize,
+		}
+		for _, t := range lh.tables {
+			info.Tables = append(info.Tables, t.info(lh.levelNum))
+		}
+		lh.RUnlock()
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// maxVersion 所有sst中最大的版本号
+func (lm *levelManager) maxVersion() uint64 {
+	var max uint64
+	for _, lh := range lm.levels {
+		lh.RLock()
+		for _, t := range lh.tables {
+			if v := t.ss.Indexs().MaxVersion; v > max {
+				max = v
+			}
+		}
+		lh.RUnlock()
+	}
+	return max
+}
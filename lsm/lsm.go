@@ -1,19 +1,32 @@
 package lsm
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/hardcore-os/corekv/utils"
 )
 
 // LSM _
 type LSM struct {
+	lock       sync.RWMutex // 保护memTable与immutables的切换
+	flushLock  sync.Mutex   // 保证immutable按顺序刷盘, 刷盘期间不持有lock
+	flushCh    chan struct{}
+	flushed    *sync.Cond // immutable刷盘之后唤醒等待切换memtable的写入, 与lock的写锁配合使用
+	stopped    bool       // 后台刷盘已经退出, 写入不再等待immutable减少
 	memTable   *memTable
 	immutables []*memTable
 	levels     *levelManager
 	option     *Options
 	closer     *utils.Closer
 	maxMemFID  uint32
+	metrics    *metrics
 }
 
+// maxImmutables immutable积压达到该数量时, 切换memtable的写入等待后台刷盘
+const maxImmutables = 4
+
 //Options _
 type Options struct {
 	WorkDir      string
@@ -33,7 +46,35 @@ type Options struct {
 	NumLevelZeroTables  int
 	MaxLevelNum         int
 
+	// NumLevelZeroTablesSlowdown l0的sst数量达到该值时延迟每批写入, 0表示NumLevelZeroTables的2倍, 不小于NumLevelZeroTables
+	NumLevelZeroTablesSlowdown int
+	// NumLevelZeroTablesStall l0的sst数量达到该值时阻塞写入直到压缩使其回落, 0表示NumLevelZeroTables的3倍
+	NumLevelZeroTablesStall int
+	// CompactionTableAge sst中最老的数据超过该时长时, 即使level没有超过目标大小也压缩到下一层,
+	// 最后一层的sst创建超过该时长后原地重写以丢弃墓碑与过期的数据, 0表示不启用, 只对LeveledCompaction生效
+	CompactionTableAge time.Duration
+	// CompactionGarbageRatio sst中墓碑占key的比例与估算的过期数据占大小的比例之和达到该值时优先压缩, 0表示不启用.
+	// 两者任意一个启用时, 更低的层中没有旧版本的墓碑与过期的数据会在压缩时被丢弃, 否则作为过期的数据保留
+	CompactionGarbageRatio float64
+	// RateLimiter 限制flush与压缩写入sst的速度, flush优先且按上限限速, 为nil时不限速
+	RateLimiter *utils.RateLimiter
+
 	DiscardStatsCh *chan map[uint32]int64
+	// BeforeFlush 每次memtable刷盘之前调用, 返回错误时放弃本次刷盘, 为nil时不调用
+	BeforeFlush func() error
+	// EventListener 为nil时不回调
+	EventListener EventListener
+	// CompactionFilter 为nil时压缩只丢弃过期的key
+	CompactionFilter CompactionFilter
+	// CompactionStyle 压缩策略, 默认为LeveledCompaction
+	CompactionStyle CompactionStyle
+	// TieredOptions 与 FIFOOptions 分别是TieredCompaction与FIFOCompaction的参数
+	TieredOptions TieredOptions
+	FIFOOptions   FIFOOptions
+	// InternalKeyPrefix 上层内部key的前缀, FIFO压缩不会删除可能包含这类key的sst, 为空时不区分
+	InternalKeyPrefix []byte
+	// Logger 为nil时使用utils.DefaultLogger
+	Logger utils.Logger
 }
 
 // Close  _
@@ -43,12 +84,12 @@ func (lsm *LSM) Close() error {
 	lsm.closer.Close()
 	// TODO 需要加锁保证并发安全
 	if lsm.memTable != nil {
-		if err := lsm.memTable.close(); err != nil {
+		if err := lsm.memTable.release(); err != nil {
 			return err
 		}
 	}
 	for i := range lsm.immutables {
-		if err := lsm.immutables[i].close(); err != nil {
+		if err := lsm.immutables[i].release(); err != nil {
 			return err
 		}
 	}
@@ -60,13 +101,32 @@ func (lsm *LSM) Close() error {
 
 // NewLSM _
 func NewLSM(opt *Options) *LSM {
-	lsm := &LSM{option: opt}
+	if opt.Logger == nil {
+		opt.Logger = utils.DefaultLogger()
+	}
+	// 低于NumLevelZeroTables时l0不会被压缩到下一层, 限流无法解除
+	if opt.NumLevelZeroTablesSlowdown <= 0 {
+		opt.NumLevelZeroTablesSlowdown = 2 * opt.NumLevelZeroTables
+	} else if opt.NumLevelZeroTablesSlowdown < opt.NumLevelZeroTables {
+		opt.NumLevelZeroTablesSlowdown = opt.NumLevelZeroTables
+	}
+	if opt.NumLevelZeroTablesStall <= 0 {
+		opt.NumLevelZeroTablesStall = 3 * opt.NumLevelZeroTables
+	}
+	if opt.NumLevelZeroTablesStall < opt.NumLevelZeroTablesSlowdown {
+		opt.NumLevelZeroTablesStall = opt.NumLevelZeroTablesSlowdown
+	}
+	lsm := &LSM{option: opt, metrics: newMetrics(opt.MaxLevelNum)}
 	// 初始化levelManager
 	lsm.levels = lsm.initLevelManager(opt)
 	// 启动DB恢复过程加载wal，如果没有恢复内容则创建新的内存表
 	lsm.memTable, lsm.immutables = lsm.recovery()
 	// 初始化closer 用于资源回收的信号控制
 	lsm.closer = utils.NewCloser()
+	lsm.flushCh = make(chan struct{}, 1)
+	lsm.flushed = sync.NewCond(&lsm.lock)
+	lsm.closer.Add(1)
+	go lsm.runFlusher()
 	return lsm
 }
 
@@ -87,30 +147,154 @@ func (lsm *LSM) Set(entry *utils.Entry) (err error) {
 	// 优雅关闭
 	lsm.closer.Add(1)
 	defer lsm.closer.Done()
+	rotated, err := lsm.set(entry)
+	if rotated {
+		// 刷盘与其限速都在后台进行, 不阻塞持有写锁的调用方
+		lsm.triggerFlush()
+	}
+	return err
+}
+
+// set 写入当前memtable, 返回是否因为写满而切换了memtable
+func (lsm *LSM) set(entry *utils.Entry) (rotated bool, err error) {
+	lsm.lock.Lock()
+	defer lsm.lock.Unlock()
 	// 检查当前memtable是否写满，是的话创建新的memtable,并将当前内存表写到immutables中
-	// 否则写入当前memtable中
-	if int64(lsm.memTable.wal.Size())+
+	// 否则写入当前memtable中; immutable积压过多时等待后台刷盘, 等待期间释放lock, 读取不受影响
+	for int64(lsm.memTable.wal.Size())+
 		int64(utils.EstimateWalCodecSize(entry)) > lsm.option.MemTableSize {
-		lsm.Rotate()
+		if len(lsm.immutables) < maxImmutables || lsm.stopped {
+			lsm.rotate()
+			rotated = true
+			break
+		}
+		lsm.flushed.Wait()
 	}
 
+	walSize := lsm.memTable.wal.Size()
 	if err = lsm.memTable.set(entry); err != nil {
-		return err
+		return rotated, err
 	}
-	// 检查是否存在immutable需要刷盘，
-	for _, immutable := range lsm.immutables {
-		if err = lsm.levels.flush(immutable); err != nil {
+	atomic.AddInt64(&lsm.metrics.walBytes, int64(lsm.memTable.wal.Size()-walSize))
+	return rotated, nil
+}
+
+// writeSlowdownDelay l0的sst数量超过NumLevelZeroTablesSlowdown时每批写入的延迟
+const writeSlowdownDelay = time.Millisecond
+
+// ThrottleWrites 在写入一批数据之前调用, l0的sst数量达到NumLevelZeroTablesSlowdown时延迟写入,
+// 达到NumLevelZeroTablesStall时阻塞直到压缩使其回落, 避免读放大失控. 返回限流的原因, 没有限流时返回空字符串
+func (lsm *LSM) ThrottleWrites() string {
+	if !lsm.levels.strategy().throttlesL0() {
+		return ""
+	}
+	l0 := lsm.levels.levels[0]
+	switch n := l0.numTables(); {
+	case n >= lsm.option.NumLevelZeroTablesStall:
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for l0.numTables() >= lsm.option.NumLevelZeroTablesStall {
+			// 压缩协程可能因为冲突放弃了本轮压缩, 反复唤醒直到l0回落
+			lsm.levels.triggerCompaction()
+			select {
+			case <-ticker.C:
+			case <-lsm.closer.CloseSignal:
+				return "l0 stall"
+			}
+		}
+		return "l0 stall"
+	case n >= lsm.option.NumLevelZeroTablesSlowdown:
+		lsm.levels.triggerCompaction()
+		time.Sleep(writeSlowdownDelay)
+		return "l0 slowdown"
+	}
+	return ""
+}
+
+// Flush 将当前memtable连同所有immutable刷到L0, 空的memtable不会被刷盘
+func (lsm *LSM) Flush() error {
+	lsm.closer.Add(1)
+	defer lsm.closer.Done()
+	lsm.lock.Lock()
+	if lsm.memTable.wal.Size() > 0 {
+		lsm.rotate()
+	}
+	lsm.lock.Unlock()
+	return lsm.flushImmutables()
+}
+
+// triggerFlush 唤醒后台刷盘, 已经有未处理的通知时直接返回
+func (lsm *LSM) triggerFlush() {
+	select {
+	case lsm.flushCh <- struct{}{}:
+	default:
+	}
+}
+
+// 刷盘失败后的重试间隔, 每次失败翻倍直到上限
+const (
+	flushRetryMinBackoff = 10 * time.Millisecond
+	flushRetryMaxBackoff = time.Second
+)
+
+// runFlusher 后台将切换出的immutable刷到L0, 失败时保留immutable并按退避间隔重试,
+// 否则immutable积压满之后写入会一直等待
+func (lsm *LSM) runFlusher() {
+	defer lsm.closer.Done()
+	var (
+		retry   <-chan time.Time
+		backoff = flushRetryMinBackoff
+	)
+	for {
+		select {
+		case <-lsm.flushCh:
+		case <-retry:
+		case <-lsm.closer.CloseSignal:
+			// 关闭后未刷盘的immutable在下次打开时从wal恢复
+			lsm.lock.Lock()
+			lsm.stopped = true
+			lsm.flushed.Broadcast()
+			lsm.lock.Unlock()
+			return
+		}
+		if err := lsm.flushImmutables(); err != nil {
+			lsm.option.Logger.Error("failed to flush memtable", "err", err, "retry", backoff)
+			lsm.levels.listener().OnBackgroundError("flush", err)
+			retry = time.After(backoff)
+			if backoff *= 2; backoff > flushRetryMaxBackoff {
+				backoff = flushRetryMaxBackoff
+			}
+			continue
+		}
+		retry, backoff = nil, flushRetryMinBackoff
+	}
+}
+
+// flushImmutables 按顺序将immutable刷到L0, 刷盘期间不持有lsm.lock, 读写不会被阻塞.
+// sst加入L0之后才把immutable移出队列, 读取在任意时刻都能看到这部分数据
+func (lsm *LSM) flushImmutables() error {
+	lsm.flushLock.Lock()
+	defer lsm.flushLock.Unlock()
+	for {
+		lsm.lock.RLock()
+		if len(lsm.immutables) == 0 {
+			lsm.lock.RUnlock()
+			return nil
+		}
+		immutable := lsm.immutables[0]
+		lsm.lock.RUnlock()
+		if err := lsm.levels.flush(immutable); err != nil {
 			return err
 		}
+		lsm.lock.Lock()
+		lsm.immutables = lsm.immutables[1:]
+		lsm.flushed.Broadcast()
+		lsm.lock.Unlock()
 		// TODO 这里问题很大，应该是用引用计数的方式回收
-		err = immutable.close()
-		utils.Panic(err)
-	}
-	if len(lsm.immutables) != 0 {
-		// TODO 将lsm的immutables队列置空，这里可以优化一下节省内存空间，还可以限制一下immut table的大小为固定值
-		lsm.immutables = make([]*memTable, 0)
+		if err := immutable.close(); err != nil {
+			return err
+		}
 	}
-	return err
 }
 
 // Get _
@@ -124,13 +308,15 @@ func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 		entry *utils.Entry
 		err   error
 	)
+	// 内存表被刷盘后跳表依然可读, 因此只需要在锁内拿到当前的内存表
+	mt, immutables := lsm.memTables()
 	// 从内存表中查询,先查活跃表，在查不变表
-	if entry, err = lsm.memTable.Get(key); entry != nil && entry.Value != nil {
+	if entry, err = mt.Get(key); entry != nil && entry.Value != nil {
 		return entry, err
 	}
 
-	for i := len(lsm.immutables) - 1; i >= 0; i-- {
-		if entry, err = lsm.immutables[i].Get(key); entry != nil && entry.Value != nil {
+	for i := len(immutables) - 1; i >= 0; i-- {
+		if entry, err = immutables[i].Get(key); entry != nil && entry.Value != nil {
 			return entry, err
 		}
 	}
@@ -139,18 +325,78 @@ func (lsm *LSM) Get(key []byte) (*utils.Entry, error) {
 }
 
 func (lsm *LSM) MemSize() int64 {
-	return lsm.memTable.Size()
+	mt, _ := lsm.memTables()
+	return mt.Size()
 }
 
 func (lsm *LSM) MemTableIsNil() bool {
-	return lsm.memTable == nil
+	mt, _ := lsm.memTables()
+	return mt == nil
 }
 
 func (lsm *LSM) GetSkipListFromMemTable() *utils.Skiplist {
-	return lsm.memTable.sl
+	mt, _ := lsm.memTables()
+	return mt.sl
 }
 
 func (lsm *LSM) Rotate() {
+	lsm.lock.Lock()
+	defer lsm.lock.Unlock()
+	lsm.rotate()
+}
+
+func (lsm *LSM) rotate() {
 	lsm.immutables = append(lsm.immutables, lsm.memTable)
 	lsm.memTable = lsm.NewMemtable()
 }
+
+// MaxVersion 返回内存表与sst中最大的版本号, 重新打开时新的写入从它之后分配版本
+func (lsm *LSM) MaxVersion() uint64 {
+	lsm.lock.RLock()
+	max := lsm.memTable.maxVersion
+	for _, imm := range lsm.immutables {
+		if imm.maxVersion > max {
+			max = imm.maxVersion
+		}
+	}
+	lsm.lock.RUnlock()
+	if v := lsm.levels.maxVersion(); v > max {
+		max = v
+	}
+	return max
+}
+
+// memTables 返回当前的活跃表与不变表
+func (lsm *LSM) memTables() (*memTable, []*memTable) {
+	lsm.lock.RLock()
+	defer lsm.lock.RUnlock()
+	return lsm.memTable, lsm.immutables
+}
+
+// LevelsInfo 返回每一层sst的分布情况
+func (lsm *LSM) LevelsInfo() []LevelInfo {
+	return lsm.levels.levelsInfo()
+}
+
+// CompactionState 返回当前正在进行的压缩
+func (lsm *LSM) CompactionState() CompactionState {
+	return lsm.levels.compactState.state()
+}
+
+// CacheInfo 返回index与block缓存的命中情况
+func (lsm *LSM) CacheInfo() []CacheInfo {
+	return []CacheInfo{
+		cacheInfo("index", lsm.levels.cache.indexs),
+		cacheInfo("block", lsm.levels.cache.blocks),
+	}
+}
+
+// KeySplits 返回按sst边界切分key空间的分割点, 只包含带有prefix前缀的key
+func (lsm *LSM) KeySplits(prefix []byte) [][]byte {
+	return lsm.levels.keySplits(prefix)
+}
+
+// TriggerCompact 立即执行一轮压缩，返回是否有压缩任务被执行
+func (lsm *LSM) TriggerCompact() bool {
+	return lsm.levels.runOnce(0)
+}
@@ -17,7 +17,9 @@ package lsm
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"testing"
 	"time"
 
@@ -39,6 +41,7 @@ var (
 		NumLevelZeroTables:  15,
 		MaxLevelNum:         7,
 		NumCompactors:       3,
+		Logger:              utils.NopLogger(),
 	}
 )
 
@@ -46,6 +49,7 @@ var (
 func TestBase(t *testing.T) {
 	clearDir()
 	lsm := buildLSM()
+	defer lsm.Close()
 	test := func() {
 		// 基准测试
 		baseTest(t, lsm, 128)
@@ -65,6 +69,7 @@ func TestClose(t *testing.T) {
 		// 重启后可正常工作才算成功
 		lsm = buildLSM()
 		baseTest(t, lsm, 128)
+		utils.Err(lsm.Close())
 	}
 	// 运行N次测试多个sst的影响
 	runTest(1, test)
@@ -74,6 +79,7 @@ func TestClose(t *testing.T) {
 func TestHitStorage(t *testing.T) {
 	clearDir()
 	lsm := buildLSM()
+	defer lsm.Close()
 	e := utils.BuildEntry()
 	lsm.Set(e)
 	// 命中内存表
@@ -109,6 +115,7 @@ func TestHitStorage(t *testing.T) {
 func TestPsarameter(t *testing.T) {
 	clearDir()
 	lsm := buildLSM()
+	defer lsm.Close()
 	testNil := func() {
 		utils.CondPanic(lsm.Set(nil) != utils.ErrEmptyKey, fmt.Errorf("[testNil] lsm.Set(nil) != err"))
 		_, err := lsm.Get(nil)
@@ -122,6 +129,7 @@ func TestPsarameter(t *testing.T) {
 func TestCompact(t *testing.T) {
 	clearDir()
 	lsm := buildLSM()
+	defer lsm.Close()
 	ok := false
 	l0TOLMax := func() {
 		// 正常触发即可
@@ -221,6 +229,192 @@ func TestCompact(t *testing.T) {
 	runTest(1, l0TOLMax, l0ToL0, nextCompact, maxToMax, parallerCompact)
 }
 
+// TestCompactTriggeredByFlush l0积压后压缩由flush触发, 不需要等待定时器
+func TestCompactTriggeredByFlush(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	lsm.StartCompacter()
+	defer lsm.Close()
+	for lsm.levels.levels[0].numTables() < opt.NumLevelZeroTables {
+		utils.Err(lsm.Set(utils.BuildEntry()))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for lsm.Metrics().NumCompactions == 0 {
+		utils.CondPanic(time.Now().After(deadline), fmt.Errorf("[TestCompactTriggeredByFlush] no compaction after flush"))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestThrottleWrites l0的sst超过阻塞阈值时写入会等待压缩完成
+func TestThrottleWrites(t *testing.T) {
+	clearDir()
+	topt := *opt
+	topt.NumLevelZeroTablesSlowdown = opt.NumLevelZeroTables
+	topt.NumLevelZeroTablesStall = opt.NumLevelZeroTables + 1
+	c := make(chan map[uint32]int64, 16)
+	topt.DiscardStatsCh = &c
+	lsm := NewLSM(&topt)
+	defer lsm.Close()
+	utils.CondPanic(lsm.ThrottleWrites() != "", fmt.Errorf("[TestThrottleWrites] throttled without l0 tables"))
+	for lsm.levels.levels[0].numTables() < topt.NumLevelZeroTablesStall {
+		utils.Err(lsm.Set(utils.BuildEntry()))
+	}
+
+	reason := make(chan string, 1)
+	go func() { reason <- lsm.ThrottleWrites() }()
+	select {
+	case r := <-reason:
+		t.Fatalf("writes should be stalled until compaction, got %q", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// 压缩协程启动后l0回落, 写入恢复
+	lsm.StartCompacter()
+	select {
+	case r := <-reason:
+		utils.CondPanic(r != "l0 stall", fmt.Errorf("[TestThrottleWrites] reason = %q", r))
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes still stalled after compaction")
+	}
+}
+
+// TestTableStats sst的索引中记录最老数据的时间、墓碑个数与带过期时间的数据量
+func TestTableStats(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	now := uint64(time.Now().Unix())
+	for i := 0; i < 10; i++ {
+		e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%02d", i)), math.MaxUint32), []byte("val"))
+		switch {
+		case i < 4:
+			e.Value, e.Meta = nil, utils.BitDelete
+		case i < 7:
+			e.ExpiresAt = now - 10
+		}
+		utils.Err(lsm.Set(e))
+	}
+	utils.Err(lsm.Flush())
+	tbl := lsm.levels.levels[0].tables[0]
+	idx := tbl.ss.Indexs()
+	utils.CondPanic(idx.TombstoneCount != 4, fmt.Errorf("[TestTableStats] tombstones = %d", idx.TombstoneCount))
+	utils.CondPanic(idx.TtlDataSize == 0, fmt.Errorf("[TestTableStats] ttl data size is zero"))
+	utils.CondPanic(idx.MinExpiresAt != 0 || idx.MaxExpiresAt != now-10, fmt.Errorf("[TestTableStats] expires at [%d, %d]", idx.MinExpiresAt, idx.MaxExpiresAt))
+	utils.CondPanic(idx.OldestEntryTime < now, fmt.Errorf("[TestTableStats] oldest entry time = %d", idx.OldestEntryTime))
+	utils.CondPanic(tbl.expiredDataSize(now) != idx.TtlDataSize, fmt.Errorf("[TestTableStats] expired data size = %d", tbl.expiredDataSize(now)))
+	utils.CondPanic(tbl.garbageRatio(now) < 0.4, fmt.Errorf("[TestTableStats] garbage ratio = %f", tbl.garbageRatio(now)))
+
+	// 压缩产生的sst继承输入中最老的时间, 启用冷数据压缩后最后一层丢弃墓碑与过期的数据
+	lsm.option.CompactionTableAge = 2 * time.Hour
+	old := now - 3600
+	idx.OldestEntryTime = old
+	utils.Err(lsm.CompactRange(nil, nil))
+	for _, tbl := range lsm.levels.lastLevel().tables {
+		utils.CondPanic(tbl.oldestEntryTime() != old, fmt.Errorf("[TestTableStats] oldest entry time = %d", tbl.oldestEntryTime()))
+		utils.CondPanic(tbl.ss.Indexs().TombstoneCount != 0, fmt.Errorf("[TestTableStats] tombstones kept in the last level"))
+	}
+	for i := 0; i < 7; i++ {
+		_, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%02d", i)), math.MaxUint32))
+		utils.CondPanic(err != utils.ErrKeyNotFound, fmt.Errorf("[TestTableStats] key%02d: %v", i, err))
+	}
+}
+
+// TestColdTableCompaction 没有超过目标大小的level中墓碑过多或过老的sst也会被压缩到最后一层
+func TestColdTableCompaction(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), math.MaxUint32) }
+	for i := 0; i < 100; i++ {
+		utils.Err(lsm.Set(utils.NewEntry(key(i), []byte("val"))))
+	}
+	waitFlushed(lsm)
+	utils.Err(lsm.Flatten(1))
+	// 墓碑留在l1, 最后一层仍有旧值
+	for i := 0; i < 80; i++ {
+		e := utils.NewEntry(key(i), nil)
+		e.Meta = utils.BitDelete
+		utils.Err(lsm.Set(e))
+	}
+	utils.Err(lsm.Flush())
+	utils.Err(lsm.levels.compactManual(0, 1, nil, nil, 1))
+	l1, last := lsm.levels.levels[1], lsm.levels.lastLevel()
+	utils.CondPanic(l1.numTables() == 0, fmt.Errorf("[TestColdTableCompaction] no tombstones in l1"))
+	utils.CondPanic(lsm.levels.runOnce(1), fmt.Errorf("[TestColdTableCompaction] compacted without cold tables"))
+
+	lsm.option.CompactionGarbageRatio = 0.5
+	for lsm.levels.runOnce(1) {
+	}
+	utils.CondPanic(l1.numTables() != 0, fmt.Errorf("[TestColdTableCompaction] l1 tables = %d", l1.numTables()))
+	var keys uint32
+	for _, tbl := range last.tables {
+		keys += tbl.ss.Indexs().KeyCount
+	}
+	utils.CondPanic(keys != 20, fmt.Errorf("[TestColdTableCompaction] keys in the last level = %d", keys))
+	lsm.option.CompactionGarbageRatio = 0
+
+	// 最后一层的sst按创建时间原地重写
+	lsm.option.CompactionTableAge = time.Hour
+	fid := last.tables[0].fid
+	created := time.Now().Add(-2 * time.Hour)
+	last.tables[0].ss.SetCreatedAt(&created)
+	utils.CondPanic(!lsm.levels.runOnce(1), fmt.Errorf("[TestColdTableCompaction] old table not compacted"))
+	utils.CondPanic(last.tables[0].fid == fid, fmt.Errorf("[TestColdTableCompaction] old table not rewritten"))
+	utils.CondPanic(lsm.levels.runOnce(1), fmt.Errorf("[TestColdTableCompaction] rewritten table compacted again"))
+	for i := 0; i < 100; i++ {
+		_, err := lsm.Get(key(i))
+		utils.CondPanic((i < 80) != (err == utils.ErrKeyNotFound), fmt.Errorf("[TestColdTableCompaction] key%03d: %v", i, err))
+	}
+}
+
+// TestRateLimiter flush与压缩写入的sst分别按高低优先级限速, 压缩速度随积压的数据量调整
+func TestRateLimiter(t *testing.T) {
+	clearDir()
+	ropt := *opt
+	ropt.RateLimiter = utils.NewRateLimiter(1<<30, true)
+	c := make(chan map[uint32]int64, 16)
+	ropt.DiscardStatsCh = &c
+	lsm := NewLSM(&ropt)
+	defer lsm.Close()
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 50; j++ {
+			utils.Err(lsm.Set(utils.BuildEntry()))
+		}
+		utils.Err(lsm.Flush())
+	}
+	utils.Err(lsm.CompactRange(nil, nil))
+	m := lsm.Metrics()
+	var compacted int64
+	for _, l := range m.Levels {
+		compacted += l.CompactionBytesWritten
+	}
+	high, low := ropt.RateLimiter.TotalBytes(utils.IOPriorityHigh), ropt.RateLimiter.TotalBytes(utils.IOPriorityLow)
+	utils.CondPanic(high != m.FlushBytesWritten, fmt.Errorf("[TestRateLimiter] high = %d, flushed = %d", high, m.FlushBytesWritten))
+	utils.CondPanic(compacted == 0 || low != compacted, fmt.Errorf("[TestRateLimiter] low = %d, compacted = %d", low, compacted))
+
+	// 没有等待压缩的数据时自动调整到最低速度
+	lsm.levels.runOnce(1)
+	utils.CondPanic(ropt.RateLimiter.BytesPerSecond() != (1<<30)/20, fmt.Errorf("[TestRateLimiter] rate = %d", ropt.RateLimiter.BytesPerSecond()))
+}
+
+// TestRateLimitPerBlock sst按block分多次请求限速配额, 总数等于sst的大小
+func TestRateLimitPerBlock(t *testing.T) {
+	bopt := *opt
+	bopt.BlockSize = 256
+	builder := newTableBuiler(&bopt)
+	for i := 0; i < 100; i++ {
+		builder.add(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), 1), []byte("value")), false)
+	}
+	bd := builder.done()
+	var requests, total int
+	dst := make([]byte, bd.size)
+	written := bd.copyTo(dst, func(n int) {
+		requests++
+		total += n
+	})
+	utils.CondPanic(written != bd.size || total != bd.size, fmt.Errorf("[TestRateLimitPerBlock] written %d, requested %d, size %d", written, total, bd.size))
+	utils.CondPanic(requests != len(bd.blockList)+1 || len(bd.blockList) < 2, fmt.Errorf("[TestRateLimitPerBlock] %d requests for %d blocks", requests, len(bd.blockList)))
+}
+
 // 正确性测试
 func baseTest(t *testing.T, lsm *LSM, n int) {
 	// 用来跟踪调试的
@@ -239,6 +433,7 @@ func baseTest(t *testing.T, lsm *LSM, n int) {
 		lsm.Set(ee)
 		// caseList = append(caseList, ee)
 	}
+	waitFlushed(lsm)
 	// 从levels中进行GET
 	v, err := lsm.Get(e.Key)
 	utils.Panic(err)
@@ -322,6 +517,20 @@ func tricky(tables []*table) {
 		table.ss.SetCreatedAt(&t)
 	}
 }
+
+// waitFlushed 等待后台刷盘处理完所有切换出的immutable
+func waitFlushed(lsm *LSM) {
+	for {
+		if _, imms := lsm.memTables(); len(imms) == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// immutable移出队列之后才删除wal, 等待正在进行的刷盘结束
+	lsm.flushLock.Lock()
+	lsm.flushLock.Unlock()
+}
+
 func clearDir() {
 	_, err := os.Stat(opt.WorkDir)
 	if err == nil {
@@ -329,3 +538,185 @@ func clearDir() {
 	}
 	os.Mkdir(opt.WorkDir, os.ModePerm)
 }
+
+// TestCompactAcrossBlocks 压缩的输入跨越多个block时, 每个key的value都要与写入的一致
+func TestCompactAcrossBlocks(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), math.MaxUint32) }
+	val := func(i, round int) []byte { return []byte(fmt.Sprintf("val%04d-%d", i, round)) }
+	for i := 0; i < 500; i++ {
+		utils.Err(lsm.Set(utils.NewEntry(key(i), val(i, 0))))
+	}
+	utils.Err(lsm.CompactRange(nil, nil))
+	last := lsm.levels.lastLevel()
+	utils.CondPanic(len(last.tables[0].ss.Indexs().GetOffsets()) < 2, fmt.Errorf("[TestCompactAcrossBlocks] only one block per table"))
+
+	// 第二次压缩读取多个block的sst
+	for i := 0; i < 500; i += 7 {
+		utils.Err(lsm.Set(utils.NewEntry(key(i), val(i, 1))))
+	}
+	utils.Err(lsm.CompactRange(nil, nil))
+	for i := 0; i < 500; i++ {
+		want := val(i, 0)
+		if i%7 == 0 {
+			want = val(i, 1)
+		}
+		e, err := lsm.Get(key(i))
+		utils.Panic(err)
+		utils.CondPanic(!bytes.Equal(e.Value, want), fmt.Errorf("[TestCompactAcrossBlocks] key%04d = %s, want %s", i, e.Value, want))
+	}
+}
+
+// TestReplaceTablesSorted replaceTables之后level中的sst按最小key有序, 查找与重合检查依赖这个顺序
+func TestReplaceTablesSorted(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	for _, prefix := range []string{"c", "a", "b"} {
+		for i := 0; i < 10; i++ {
+			utils.Err(lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("%s%02d", prefix, i)), math.MaxUint32), []byte("val"))))
+		}
+		utils.Err(lsm.Flush())
+	}
+	l0, l1 := lsm.levels.levels[0], lsm.levels.levels[1]
+	utils.Err(l1.replaceTables(nil, l0.tables))
+	for i := 1; i < len(l1.tables); i++ {
+		utils.CondPanic(utils.CompareKeys(l1.tables[i-1].ss.MinKey(), l1.tables[i].ss.MinKey()) >= 0,
+			fmt.Errorf("[TestReplaceTablesSorted] table %d is out of order", i))
+	}
+	_, err := lsm.levels.levels[1].Get(utils.KeyWithTs([]byte("b05"), math.MaxUint32))
+	utils.Panic(err)
+}
+
+// TestTableSeekBlockBoundary seek的key大于前一个block中所有的key时, 应该定位到下一个block的第一个entry
+func TestTableSeekBlockBoundary(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	for i := 0; i < 500; i++ {
+		utils.Err(lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), math.MaxUint32), []byte("val"))))
+	}
+	utils.Err(lsm.CompactRange(nil, nil))
+	tbl := lsm.levels.lastLevel().tables[0]
+	offsets := tbl.ss.Indexs().GetOffsets()
+	utils.CondPanic(len(offsets) < 2, fmt.Errorf("[TestTableSeekBlockBoundary] only one block"))
+	it := tbl.NewIterator(&utils.Options{IsAsc: true})
+	defer it.Close()
+	for _, ko := range offsets[1:] {
+		// 不带版本的seek key小于该block中这个key的所有版本
+		userKey := utils.ParseKey(ko.GetKey())
+		it.Seek(utils.KeyWithTs(userKey, math.MaxUint64))
+		utils.CondPanic(!it.Valid(), fmt.Errorf("[TestTableSeekBlockBoundary] seek %s: not valid", userKey))
+		got := utils.ParseKey(it.Item().Entry().Key)
+		utils.CondPanic(!bytes.Equal(got, userKey), fmt.Errorf("[TestTableSeekBlockBoundary] seek %s: got %s", userKey, got))
+	}
+}
+
+// TestConcatIteratorOrder 升序遍历一层中的多个sst时按key从小到大依次读取每个sst
+func TestConcatIteratorOrder(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	for _, prefix := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			utils.Err(lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("%s%02d", prefix, i)), math.MaxUint32), []byte("val"))))
+		}
+		utils.Err(lsm.Flush())
+	}
+	l1 := lsm.levels.levels[1]
+	utils.Err(l1.replaceTables(nil, lsm.levels.levels[0].tables))
+	check := func(it utils.Iterator, from string) {
+		defer it.Close()
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			keys = append(keys, string(utils.ParseKey(it.Item().Entry().Key)))
+		}
+		utils.CondPanic(len(keys) == 0 || keys[0] != from, fmt.Errorf("[TestConcatIteratorOrder] first key = %v", keys))
+		utils.CondPanic(!sort.StringsAreSorted(keys), fmt.Errorf("[TestConcatIteratorOrder] keys out of order: %v", keys))
+	}
+	it := NewConcatIterator(l1.tables, &utils.Options{IsAsc: true})
+	it.Rewind()
+	check(it, "a00")
+	it = NewConcatIterator(l1.tables, &utils.Options{IsAsc: true})
+	it.Seek(utils.KeyWithTs([]byte("b05"), math.MaxUint64))
+	check(it, "b05")
+}
+
+// TestSearchL0Newest 同一个key出现在多个l0的sst中时, 读到最新flush的value
+func TestSearchL0Newest(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	defer lsm.Close()
+	key := utils.KeyWithTs([]byte("key"), math.MaxUint32)
+	for _, val := range []string{"old", "new"} {
+		utils.Err(lsm.Set(utils.NewEntry(key, []byte(val))))
+		utils.Err(lsm.Flush())
+	}
+	utils.CondPanic(lsm.levels.levels[0].numTables() != 2, fmt.Errorf("[TestSearchL0Newest] want 2 l0 tables"))
+	e, err := lsm.Get(key)
+	utils.Panic(err)
+	utils.CondPanic(string(e.Value) != "new", fmt.Errorf("[TestSearchL0Newest] got %s, want new", e.Value))
+}
+
+// TestLevelSize flush与重启后每层记录的大小等于其中sst大小之和
+func TestLevelSize(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	check := func(stage string) {
+		lh := lsm.levels.levels[0]
+		var sum int64
+		for _, t := range lh.tables {
+			sum += t.Size()
+		}
+		utils.CondPanic(sum == 0 || lh.totalSize != sum, fmt.Errorf("[TestLevelSize] %s: size %d, tables %d", stage, lh.totalSize, sum))
+	}
+	for i := 0; i < 3; i++ {
+		utils.Err(lsm.Set(utils.BuildEntry()))
+		utils.Err(lsm.Flush())
+	}
+	check("flush")
+	utils.Err(lsm.Close())
+	lsm = buildLSM()
+	defer lsm.Close()
+	check("reopen")
+}
+
+// TestMultiVersion 同一个key的多个版本分布在内存表与sst中时读到最新的版本, 压缩只保留最新的版本, 重启后最大版本不变
+func TestMultiVersion(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	key := []byte("key")
+	for v := uint64(1); v <= 3; v++ {
+		utils.Err(lsm.Set(utils.NewEntry(utils.KeyWithTs(key, v), []byte(fmt.Sprintf("val%d", v)))))
+		if v < 3 {
+			utils.Err(lsm.Flush())
+		}
+	}
+	check := func(stage string) {
+		utils.CondPanic(lsm.MaxVersion() != 3, fmt.Errorf("[TestMultiVersion] %s: max version = %d", stage, lsm.MaxVersion()))
+		e, err := lsm.Get(utils.KeyWithTs(key, math.MaxUint64))
+		utils.Panic(err)
+		utils.CondPanic(string(e.Value) != "val3", fmt.Errorf("[TestMultiVersion] %s: got %s", stage, e.Value))
+	}
+	check("memtable")
+
+	utils.Err(lsm.Flush())
+	utils.Err(lsm.CompactRange(nil, nil))
+	check("compaction")
+	var versions []uint64
+	for _, tbl := range lsm.levels.lastLevel().tables {
+		it := tbl.NewIterator(&utils.Options{IsAsc: true})
+		for it.Rewind(); it.Valid(); it.Next() {
+			versions = append(versions, utils.ParseTs(it.Item().Entry().Key))
+		}
+		utils.Err(it.Close())
+	}
+	utils.CondPanic(len(versions) != 1 || versions[0] != 3, fmt.Errorf("[TestMultiVersion] versions after compaction = %v", versions))
+
+	utils.Err(lsm.Close())
+	lsm = buildLSM()
+	defer lsm.Close()
+	check("reopen")
+}
@@ -70,3 +70,27 @@ func helpTestManifestFileCorruption(t *testing.T, off int64, errorContent string
 	lsm := buildLSM()
 	require.NoError(t, lsm.Close())
 }
+
+// TestManifestMissingTable manifest 引用的 sst 丢失时, 错误信息中需要包含丢失的文件
+func TestManifestMissingTable(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	baseTest(t, lsm, 128)
+	require.NoError(t, lsm.Close())
+
+	missing, orphaned := lsm.levels.manifestFile.GetManifest().Diff(utils.LoadIDMap(opt.WorkDir))
+	require.Empty(t, missing)
+	require.Empty(t, orphaned)
+
+	var id uint64
+	for id = range utils.LoadIDMap(opt.WorkDir) {
+		break
+	}
+	require.NoError(t, os.Remove(utils.FileNameSSTable(opt.WorkDir, id)))
+	defer func() {
+		err := recover()
+		require.NotNil(t, err)
+		require.Contains(t, err.(error).Error(), utils.FileNameSSTable(opt.WorkDir, id))
+	}()
+	buildLSM()
+}
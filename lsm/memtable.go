@@ -50,11 +50,12 @@ func (lsm *LSM) NewMemtable() *memTable {
 		MaxSz:    int(lsm.option.MemTableSize), //TODO wal 要设置多大比较合理？ 姑且跟sst一样大
 		FID:      newFid,
 		FileName: mtFilePath(lsm.option.WorkDir, newFid),
+		Logger:   lsm.option.Logger,
 	}
 	return &memTable{wal: file.OpenWalFile(fileOpt), sl: utils.NewSkiplist(int64(1 << 20)), lsm: lsm}
 }
 
-// Close
+// close 内存表已经刷盘, 关闭并删除wal
 func (m *memTable) close() error {
 	if err := m.wal.Close(); err != nil {
 		return err
@@ -63,11 +64,22 @@ func (m *memTable) close() error {
 	return nil
 }
 
+// release 关闭时内存表还没有刷盘, 保留wal在重启时恢复, 空的wal直接删除
+func (m *memTable) release() error {
+	if m.wal.Size() == 0 {
+		return m.close()
+	}
+	return m.wal.Release()
+}
+
 func (m *memTable) set(entry *utils.Entry) error {
 	// 写到wal 日志中，防止崩溃
 	if err := m.wal.Write(entry); err != nil {
 		return err
 	}
+	if ts := utils.ParseTs(entry.Key); ts > m.maxVersion {
+		m.maxVersion = ts
+	}
 	// 写到memtable中
 	m.sl.Add(entry)
 	return nil
@@ -149,6 +161,7 @@ func (lsm *LSM) openMemTable(fid uint64) (*memTable, error) {
 		MaxSz:    int(lsm.option.MemTableSize),
 		FID:      fid,
 		FileName: mtFilePath(lsm.option.WorkDir, fid),
+		Logger:   lsm.option.Logger,
 	}
 	s := utils.NewSkiplist(int64(1 << 20))
 	mt := &memTable{
@@ -0,0 +1,122 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics lsm自打开以来的累计计数
+type Metrics struct {
+	WalBytesWritten        int64
+	NumFlushes             int64
+	FlushDuration          time.Duration
+	FlushBytesWritten      int64
+	NumCompactions         int64
+	CompactionDuration     time.Duration
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// Levels 按压缩的目标层统计的读写字节数
+	Levels []LevelMetrics
+	// BloomUseful 布隆过滤器判定不存在而跳过的sst查询次数
+	BloomUseful int64
+	// BloomUseless 布隆过滤器判定可能存在但sst中没有该key的次数
+	BloomUseless int64
+}
+
+// LevelMetrics 以该层为目标层的压缩读写的字节数
+type LevelMetrics struct {
+	Level                  int
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+}
+
+// metrics 在写入、flush与压缩路径上原子更新
+type metrics struct {
+	walBytes       int64
+	numFlushes     int64
+	flushNanos     int64
+	flushBytes     int64
+	numCompactions int64
+	compactNanos   int64
+	compactRead    int64
+	compactWritten int64
+	bloomUseful    int64
+	bloomUseless   int64
+	levels         []levelMetrics
+}
+
+type levelMetrics struct {
+	read    int64
+	written int64
+}
+
+func newMetrics(maxLevelNum int) *metrics {
+	return &metrics{levels: make([]levelMetrics, maxLevelNum)}
+}
+
+func (m *metrics) addFlush(dur time.Duration, bytes int64) {
+	atomic.AddInt64(&m.numFlushes, 1)
+	atomic.AddInt64(&m.flushNanos, int64(dur))
+	atomic.AddInt64(&m.flushBytes, bytes)
+}
+
+func (m *metrics) addCompaction(level int, dur time.Duration, read, written int64) {
+	atomic.AddInt64(&m.numCompactions, 1)
+	atomic.AddInt64(&m.compactNanos, int64(dur))
+	atomic.AddInt64(&m.compactRead, read)
+	atomic.AddInt64(&m.compactWritten, written)
+	if level >= 0 && level < len(m.levels) {
+		atomic.AddInt64(&m.levels[level].read, read)
+		atomic.AddInt64(&m.levels[level].written, written)
+	}
+}
+
+// Metrics 返回累计计数的快照
+func (lsm *LSM) Metrics() Metrics {
+	m := lsm.metrics
+	levels := make([]LevelMetrics, len(m.levels))
+	for i := range m.levels {
+		levels[i] = LevelMetrics{
+			Level:                  i,
+			CompactionBytesRead:    atomic.LoadInt64(&m.levels[i].read),
+			CompactionBytesWritten: atomic.LoadInt64(&m.levels[i].written),
+		}
+	}
+	return Metrics{
+		WalBytesWritten:        atomic.LoadInt64(&m.walBytes),
+		NumFlushes:             atomic.LoadInt64(&m.numFlushes),
+		FlushDuration:          time.Duration(atomic.LoadInt64(&m.flushNanos)),
+		FlushBytesWritten:      atomic.LoadInt64(&m.flushBytes),
+		NumCompactions:         atomic.LoadInt64(&m.numCompactions),
+		CompactionDuration:     time.Duration(atomic.LoadInt64(&m.compactNanos)),
+		CompactionBytesRead:    atomic.LoadInt64(&m.compactRead),
+		CompactionBytesWritten: atomic.LoadInt64(&m.compactWritten),
+		Levels:                 levels,
+		BloomUseful:            atomic.LoadInt64(&m.bloomUseful),
+		BloomUseless:           atomic.LoadInt64(&m.bloomUseless),
+	}
+}
+
+// MemTablesInfo 返回活跃内存表与不变表的大小, 大小按wal文件中已写入的字节计算
+func (lsm *LSM) MemTablesInfo() (memSize int64, numImmutables int, immutablesSize int64) {
+	mt, imms := lsm.memTables()
+	memSize = int64(mt.wal.Size())
+	for _, imm := range imms {
+		immutablesSize += int64(imm.wal.Size())
+	}
+	return memSize, len(imms), immutablesSize
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hardcore-os/corekv/file"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// corruptTableExt 校验失败的sst会被重命名为该后缀, 保留现场但不再被加载
+const corruptTableExt = ".corrupt"
+
+// RepairReport 离线修复的结果
+type RepairReport struct {
+	Levels          [][]uint64 // 每一层放置的sst
+	Corrupted       []uint64   // 校验失败被移走的sst
+	SalvagedWals    []uint64   // 被转换为L0 sst的wal
+	SalvagedEntries int
+}
+
+type repairTable struct {
+	fid        uint64
+	minKey     []byte
+	maxKey     []byte
+	maxVersion uint64
+}
+
+// Repair 在manifest丢失或损坏时, 根据目录中的sst和wal离线重建manifest, 调用时不能有打开该目录的lsm
+// 每个sst都会被完整校验, 随后按新旧和key范围放置到各层, wal中的数据会被写成新的L0 sst
+func Repair(opt *Options) (*RepairReport, error) {
+	report := &RepairReport{Levels: make([][]uint64, opt.MaxLevelNum)}
+	var (
+		tables []*repairTable
+		maxFID uint64
+	)
+	ids := make([]uint64, 0)
+	for id := range utils.LoadIDMap(opt.WorkDir) {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if id > maxFID {
+			maxFID = id
+		}
+		path := utils.FileNameSSTable(opt.WorkDir, id)
+		rt, err := checkTable(path)
+		if err != nil {
+			if err := os.Rename(path, path+corruptTableExt); err != nil {
+				return nil, err
+			}
+			report.Corrupted = append(report.Corrupted, id)
+			continue
+		}
+		rt.fid = id
+		tables = append(tables, rt)
+	}
+
+	wals, err := listWals(opt.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fid := range wals {
+		if fid > maxFID {
+			maxFID = fid
+		}
+	}
+	// wal中的数据一定比所有sst都新, 因此使用更大的fid
+	if opt.Logger == nil {
+		opt.Logger = utils.DefaultLogger()
+	}
+	lm := &levelManager{opt: opt}
+	for _, walFid := range wals {
+		entries, err := readWal(mtFilePath(opt.WorkDir, walFid))
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		maxFID++
+		rt, err := buildRepairTable(lm, maxFID, entries)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, rt)
+		report.SalvagedWals = append(report.SalvagedWals, walFid)
+		report.SalvagedEntries += len(entries)
+	}
+
+	levels := placeTables(tables, opt.MaxLevelNum)
+	for _, rt := range tables {
+		report.Levels[levels[rt.fid]] = append(report.Levels[levels[rt.fid]], rt.fid)
+	}
+	if err := file.RewriteManifest(opt.WorkDir, levels); err != nil {
+		return nil, err
+	}
+	// manifest写成功之后才能删除wal
+	for _, walFid := range wals {
+		if err := os.Remove(mtFilePath(opt.WorkDir, walFid)); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// checkTable 完整校验一个sst, 返回其key范围与最大版本
+func checkTable(path string) (*repairTable, error) {
+	ts, err := InspectTable(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if ts.IndexChecksum != nil {
+		return nil, ts.IndexChecksum
+	}
+	if len(ts.Blocks) == 0 {
+		return nil, errors.New("sst has no block")
+	}
+	for _, b := range ts.Blocks {
+		if b.Checksum != nil {
+			return nil, b.Checksum
+		}
+	}
+	return &repairTable{minKey: ts.MinKey, maxKey: ts.MaxKey, maxVersion: ts.MaxVersion}, nil
+}
+
+// placeTables 从旧到新依次放置sst, 新的sst必须位于所有与之key范围重叠的旧sst之上
+// 没有重叠时放到最底层; 版本号相同时以fid近似新旧
+func placeTables(tables []*repairTable, maxLevelNum int) map[uint64]int {
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].maxVersion != tables[j].maxVersion {
+			return tables[i].maxVersion < tables[j].maxVersion
+		}
+		return tables[i].fid < tables[j].fid
+	})
+	levels := make(map[uint64]int, len(tables))
+	for i, t := range tables {
+		level := maxLevelNum - 1
+		for _, older := range tables[:i] {
+			if !keyRangeOverlap(t, older) {
+				continue
+			}
+			if l := levels[older.fid] - 1; l < level {
+				level = l
+			}
+		}
+		if level < 0 {
+			level = 0
+		}
+		levels[t.fid] = level
+	}
+	return levels
+}
+
+func keyRangeOverlap(a, b *repairTable) bool {
+	return utils.CompareKeys(a.minKey, b.maxKey) <= 0 && utils.CompareKeys(b.minKey, a.maxKey) <= 0
+}
+
+func listWals(dir string) ([]uint64, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var fids []uint64
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), walFileExt) {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), walFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		fids = append(fids, fid)
+	}
+	sort.Slice(fids, func(i, j int) bool { return fids[i] < fids[j] })
+	return fids, nil
+}
+
+// readWal 读出wal中所有校验通过的entry, 按key排序, 同一个key只保留最后写入的
+func readWal(path string) ([]*utils.Entry, error) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Size() == 0 {
+		return nil, err
+	}
+	wf := file.OpenWalFile(&file.Options{FileName: path, Flag: os.O_RDONLY})
+	defer wf.Release()
+	var entries []*utils.Entry
+	if _, err := wf.Iterate(true, 0, func(e *utils.Entry, _ *utils.ValuePtr) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return utils.CompareKeys(entries[i].Key, entries[j].Key) < 0
+	})
+	out := entries[:0]
+	for _, e := range entries {
+		if n := len(out); n > 0 && utils.CompareKeys(out[n-1].Key, e.Key) == 0 {
+			out[n-1] = e
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func buildRepairTable(lm *levelManager, fid uint64, entries []*utils.Entry) (*repairTable, error) {
+	builder := newTableBuiler(lm.opt)
+	for _, e := range entries {
+		builder.add(e, false)
+	}
+	t, err := builder.flush(lm, utils.FileNameSSTable(lm.opt.WorkDir, fid))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.ss.Close(); err != nil {
+		return nil, err
+	}
+	return &repairTable{
+		fid:        fid,
+		minKey:     entries[0].Key,
+		maxKey:     entries[len(entries)-1].Key,
+		maxVersion: builder.maxVersion,
+	}, nil
+}
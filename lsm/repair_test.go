@@ -0,0 +1,71 @@
+package lsm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// TestRepair 模拟manifest损坏后的离线修复
+func TestRepair(t *testing.T) {
+	clearDir()
+	lsm := buildLSM()
+	n := 200
+	key := func(i int) []byte { return utils.KeyWithTs([]byte(fmt.Sprintf("key%04d", i)), 1) }
+	for i := 0; i < n; i++ {
+		require.NoError(t, lsm.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("value%d", i)))))
+	}
+	// 覆盖写一部分key, 修复后需要读到新值
+	for i := 0; i < n; i += 10 {
+		require.NoError(t, lsm.Set(utils.NewEntry(key(i), []byte(fmt.Sprintf("new%d", i)))))
+	}
+	waitFlushed(lsm)
+	require.NotEmpty(t, lsm.levels.levels[0].tables)
+	require.NotZero(t, lsm.memTable.sl.MemSize())
+
+	// 模拟崩溃后manifest损坏
+	manifest := filepath.Join(opt.WorkDir, utils.ManifestFilename)
+	require.NoError(t, os.WriteFile(manifest, []byte("garbage"), 0666))
+	// 破坏一个sst
+	bad := lsm.levels.levels[0].tables[0].fid
+	badPath := utils.FileNameSSTable(opt.WorkDir, bad)
+	badKeys := map[string]bool{}
+	_, err := InspectTable(badPath, func(e *utils.Entry) error {
+		badKeys[string(utils.ParseKey(e.Key))] = true
+		return nil
+	})
+	require.NoError(t, err)
+	f, err := os.OpenFile(badPath, os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 4)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	report, err := Repair(opt)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{bad}, report.Corrupted)
+	require.NotEmpty(t, report.SalvagedWals)
+	require.NotZero(t, report.SalvagedEntries)
+	_, err = os.Stat(badPath + corruptTableExt)
+	require.NoError(t, err)
+
+	lsm = buildLSM()
+	defer lsm.Close()
+	// 除了被破坏的sst中的key, 其余key都能读到最新的值
+	for i := 0; i < n; i++ {
+		if badKeys[string(utils.ParseKey(key(i)))] {
+			continue
+		}
+		e, err := lsm.Get(key(i))
+		require.NoError(t, err)
+		want := fmt.Sprintf("value%d", i)
+		if i%10 == 0 {
+			want = fmt.Sprintf("new%d", i)
+		}
+		require.Equal(t, want, string(e.Value))
+	}
+}
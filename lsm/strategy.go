@@ -0,0 +1,125 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import "fmt"
+
+// CompactionStyle 压缩策略, 决定每一层的目标大小、压缩的优先级以及参与压缩的sst
+type CompactionStyle int
+
+const (
+	// LeveledCompaction 分层压缩, 每层的大小是上一层的LevelSizeMultiplier倍,
+	// 读放大与空间放大较小, 写放大较大, 是默认的压缩策略
+	LeveledCompaction CompactionStyle = iota
+	// TieredCompaction 分级(universal)压缩, 参数见Options.TieredOptions
+	TieredCompaction
+	// FIFOCompaction 先进先出压缩, 参数见Options.FIFOOptions
+	FIFOCompaction
+)
+
+func (s CompactionStyle) String() string {
+	switch s {
+	case LeveledCompaction:
+		return "leveled"
+	case TieredCompaction:
+		return "tiered"
+	case FIFOCompaction:
+		return "fifo"
+	}
+	return fmt.Sprintf("CompactionStyle(%d)", int(s))
+}
+
+// compactionStrategy 每种压缩策略的实现
+type compactionStrategy interface {
+	// targets 计算每一层的目标大小与新sst的大小
+	targets(lm *levelManager) targets
+	// priorities 返回编号为id的压缩协程需要依次尝试的压缩, 按优先级排序
+	priorities(lm *levelManager, id int) []compactionPriority
+	// fill 选择目标level与参与压缩的sst, 并登记到compactState, 返回false表示放弃本次压缩
+	fill(lm *levelManager, cd *compactDef) bool
+	// throttlesL0 l0的sst积压时是否需要限制写入
+	throttlesL0() bool
+}
+
+// newCompactionStrategy 根据Options.CompactionStyle创建压缩策略
+func newCompactionStrategy(opt *Options) compactionStrategy {
+	switch opt.CompactionStyle {
+	case TieredCompaction:
+		return newTieredStrategy(opt.TieredOptions)
+	case FIFOCompaction:
+		return &fifoStrategy{opt: opt.FIFOOptions, internalPrefix: opt.InternalKeyPrefix}
+	}
+	return leveledStrategy{}
+}
+
+// strategy 返回打开时创建的压缩策略
+func (lm *levelManager) strategy() compactionStrategy {
+	return lm.compaction
+}
+
+type leveledStrategy struct{}
+
+func (leveledStrategy) targets(lm *levelManager) targets {
+	return lm.levelTargets()
+}
+
+func (leveledStrategy) throttlesL0() bool { return true }
+
+func (leveledStrategy) priorities(lm *levelManager, id int) []compactionPriority {
+	prios := lm.pickCompactLevels()
+	if id == 0 {
+		// 0号协程 总是倾向于压缩l0层
+		prios = moveL0toFront(prios)
+	}
+	out := prios[:0]
+	for _, p := range prios {
+		if id == 0 && p.level == 0 {
+			// 对于l0 无论得分多少都要运行
+		} else if p.adjusted < 1.0 {
+			// 对于其他level 如果等分小于 则不执行
+			break
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+func (leveledStrategy) fill(lm *levelManager, cd *compactDef) bool {
+	// 如果是第0层 对齐单独填充处理
+	if cd.thisLevel.levelNum == 0 {
+		cd.nextLevel = lm.levels[cd.t.baseLevel]
+		return lm.fillTablesL0(cd)
+	}
+	cd.nextLevel = cd.thisLevel
+	// 如果不是最后一层，则压缩到下一层即可
+	if !cd.thisLevel.isLastLevel() {
+		cd.nextLevel = lm.levels[cd.thisLevel.levelNum+1]
+	}
+	return lm.fillTables(cd)
+}
+
+// uniformTargets 不区分每层目标大小的策略使用, l0的sst由flush产生, 其他层的sst统一使用BaseTableSize
+func uniformTargets(lm *levelManager) targets {
+	t := targets{
+		baseLevel: 1,
+		targetSz:  make([]int64, len(lm.levels)),
+		fileSz:    make([]int64, len(lm.levels)),
+	}
+	t.fileSz[0] = lm.opt.MemTableSize
+	for i := 1; i < len(lm.levels); i++ {
+		t.fileSz[i] = lm.opt.BaseTableSize
+	}
+	return t
+}
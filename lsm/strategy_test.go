@@ -0,0 +1,216 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+// writeAmp 用相同的随机覆盖写负载测试压缩策略, 每次flush后同步执行压缩直到没有可执行的压缩,
+// 校验所有key读到最新的值并返回写放大
+func writeAmp(t *testing.T, style CompactionStyle) float64 {
+	clearDir()
+	wopt := *opt
+	wopt.NumLevelZeroTables = 4
+	wopt.CompactionStyle = style
+	c := make(chan map[uint32]int64, 16)
+	wopt.DiscardStatsCh = &c
+	lsm := NewLSM(&wopt)
+	defer lsm.Close()
+
+	rnd := rand.New(rand.NewSource(1))
+	latest := make(map[string]string)
+	var flushes int64
+	for i := 0; i < 20000; i++ {
+		key, val := fmt.Sprintf("key%05d", rnd.Intn(5000)), fmt.Sprintf("val%d", i)
+		latest[key] = val
+		require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(key), math.MaxUint32), []byte(val))))
+		if n := lsm.Metrics().NumFlushes; n != flushes {
+			flushes = n
+			for lsm.levels.runOnce(1) {
+			}
+		}
+	}
+	for key, val := range latest {
+		e, err := lsm.Get(utils.KeyWithTs([]byte(key), math.MaxUint32))
+		require.NoError(t, err)
+		require.Equal(t, val, string(e.Value), key)
+	}
+
+	m := lsm.Metrics()
+	written := m.FlushBytesWritten
+	for _, l := range m.Levels {
+		written += l.CompactionBytesWritten
+	}
+	return float64(written) / float64(m.FlushBytesWritten)
+}
+
+func TestCompactionStrategyWriteAmp(t *testing.T) {
+	leveled := writeAmp(t, LeveledCompaction)
+	tiered := writeAmp(t, TieredCompaction)
+	t.Logf("write amplification: leveled=%.2f tiered=%.2f", leveled, tiered)
+	require.Less(t, tiered, leveled)
+}
+
+// TestTieredRuns 分级压缩后每个level仍是互不重合的sorted run
+func TestTieredRuns(t *testing.T) {
+	clearDir()
+	topt := *opt
+	topt.NumLevelZeroTables = 2
+	topt.CompactionStyle = TieredCompaction
+	topt.TieredOptions = TieredOptions{SizeRatio: 1}
+	c := make(chan map[uint32]int64, 16)
+	topt.DiscardStatsCh = &c
+	lsm := NewLSM(&topt)
+	defer lsm.Close()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := utils.KeyWithTs([]byte(fmt.Sprintf("key%03d", i)), math.MaxUint32)
+			require.NoError(t, lsm.Set(utils.NewEntry(key, []byte(fmt.Sprintf("val%d", round)))))
+		}
+		require.NoError(t, lsm.Flush())
+		for lsm.levels.runOnce(1) {
+		}
+	}
+	for _, l := range lsm.levels.levels[1:] {
+		for i := 1; i < len(l.tables); i++ {
+			require.Less(t, utils.CompareKeys(l.tables[i-1].ss.MaxKey(), l.tables[i].ss.MinKey()), 0)
+		}
+	}
+	require.Less(t, lsm.levels.levels[0].numTables(), topt.NumLevelZeroTables)
+}
+
+// TestFIFOCompaction 过期的sst与超过总大小的最老的sst被直接删除, 不写出新的sst
+func TestFIFOCompaction(t *testing.T) {
+	clearDir()
+	fopt := *opt
+	fopt.NumLevelZeroTables = 2
+	c := make(chan map[uint32]int64, 16)
+	fopt.DiscardStatsCh = &c
+	fopt.CompactionStyle = FIFOCompaction
+	lsm := NewLSM(&fopt)
+	defer lsm.Close()
+
+	// 每个批次的value都是指向以批次号为fid的vlog文件的值指针
+	write := func(batch int, expiresAt uint64) {
+		for i := 0; i < 20; i++ {
+			vp := utils.ValuePtr{Len: 10, Offset: uint32(i * 10), Fid: uint32(batch)}
+			e := utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%02d%03d", batch, i)), math.MaxUint32), vp.Encode())
+			e.Meta = utils.BitValuePointer
+			e.ExpiresAt = expiresAt
+			require.NoError(t, lsm.Set(e))
+		}
+		require.NoError(t, lsm.Flush())
+	}
+	discarded := func() map[uint32]int64 {
+		total := make(map[uint32]int64)
+		for {
+			select {
+			case stats := <-c:
+				for fid, n := range stats {
+					total[fid] += n
+				}
+			default:
+				return total
+			}
+		}
+	}
+	get := func(batch int) error {
+		_, err := lsm.Get(utils.KeyWithTs([]byte(fmt.Sprintf("key%02d%03d", batch, 0)), math.MaxUint32))
+		return err
+	}
+	now := uint64(time.Now().Unix())
+	write(0, now-1)
+	write(1, 0)
+	write(2, now-1)
+	write(3, now+3600)
+	l0 := lsm.levels.levels[0]
+	require.Equal(t, 4, l0.numTables())
+	require.Equal(t, "", lsm.ThrottleWrites())
+
+	// 只有全部过期的sst被删除
+	for lsm.levels.runOnce(0) {
+	}
+	require.Equal(t, 2, l0.numTables())
+	require.NoError(t, get(1))
+	require.NoError(t, get(3))
+	for _, l := range lsm.Metrics().Levels {
+		require.Zero(t, l.CompactionBytesWritten)
+	}
+	// 被删除的sst引用的vlog数据计入discard stats
+	require.Equal(t, map[uint32]int64{0: 200, 2: 200}, discarded())
+
+	// 超过总大小时从最老的sst开始删除
+	for batch := 4; batch < 8; batch++ {
+		write(batch, 0)
+	}
+	fifo := lsm.levels.strategy().(*fifoStrategy)
+	fifo.opt.MaxTableFilesSize = 3 * l0.tables[0].Size()
+	for lsm.levels.runOnce(0) {
+	}
+	require.LessOrEqual(t, l0.getTotalSize(), fifo.opt.MaxTableFilesSize)
+	require.Equal(t, 3, l0.numTables())
+	for batch := 1; batch < 5; batch++ {
+		require.Equal(t, utils.ErrKeyNotFound, get(batch))
+	}
+	for batch := 5; batch < 8; batch++ {
+		require.NoError(t, get(batch))
+	}
+	require.Equal(t, map[uint32]int64{1: 200, 3: 200, 4: 200}, discarded())
+	ssts, err := filepath.Glob(filepath.Join(fopt.WorkDir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, ssts, 3)
+}
+
+// TestFIFOKeepsInternalKeys 超过总大小时不删除可能包含内部key的sst
+func TestFIFOKeepsInternalKeys(t *testing.T) {
+	clearDir()
+	fopt := *opt
+	c := make(chan map[uint32]int64, 16)
+	fopt.DiscardStatsCh = &c
+	fopt.CompactionStyle = FIFOCompaction
+	fopt.InternalKeyPrefix = []byte("!corekv!")
+	lsm := NewLSM(&fopt)
+	defer lsm.Close()
+
+	internal := utils.KeyWithTs([]byte("!corekv!repl"), 1)
+	require.NoError(t, lsm.Set(utils.NewEntry(internal, []byte("state"))))
+	require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte("key"), 1), []byte("value"))))
+	require.NoError(t, lsm.Flush())
+	for batch := 0; batch < 3; batch++ {
+		for i := 0; i < 20; i++ {
+			require.NoError(t, lsm.Set(utils.NewEntry(utils.KeyWithTs([]byte(fmt.Sprintf("key%02d%03d", batch, i)), 1), []byte("value"))))
+		}
+		require.NoError(t, lsm.Flush())
+	}
+	l0 := lsm.levels.levels[0]
+	require.Equal(t, 4, l0.numTables())
+	fifo := lsm.levels.strategy().(*fifoStrategy)
+	fifo.opt.MaxTableFilesSize = 1
+	for lsm.levels.runOnce(0) {
+	}
+	require.Equal(t, 1, l0.numTables())
+	e, err := lsm.Get(utils.KeyWithTs([]byte("!corekv!repl"), math.MaxUint64))
+	require.NoError(t, err)
+	require.Equal(t, "state", string(e.Value))
+}
@@ -51,7 +51,7 @@ func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table
 	// 对builder存在的情况 把buf flush到磁盘
 	if builder != nil {
 		if t, err = builder.flush(lm, tableName); err != nil {
-			utils.Err(err)
+			lm.opt.Logger.Error("failed to flush table", "table", tableName, "err", err)
 			return nil
 		}
 	} else {
@@ -61,13 +61,14 @@ func openTable(lm *levelManager, tableName string, builder *tableBuilder) *table
 			FileName: tableName,
 			Dir:      lm.opt.WorkDir,
 			Flag:     os.O_CREATE | os.O_RDWR,
-			MaxSz:    int(sstSize)})
+			MaxSz:    int(sstSize),
+			Logger:   lm.opt.Logger})
 	}
 	// 先要引用一下，否则后面使用迭代器会导致引用状态错误
 	t.IncrRef()
 	//  初始化sst文件，把index加载进来
 	if err := t.ss.Init(); err != nil {
-		utils.Err(err)
+		lm.opt.Logger.Error("failed to init table", "table", tableName, "err", err)
 		return nil
 	}
 
@@ -91,10 +92,18 @@ func (t *table) Serach(key []byte, maxVs *uint64) (entry *utils.Entry, err error
 	idx := t.ss.Indexs()
 	// 检查key是否存在
 	bloomFilter := utils.Filter(idx.BloomFilter)
-	if t.ss.HasBloomFilter() && !bloomFilter.MayContainKey(key) {
+	hasBloom := t.ss.HasBloomFilter()
+	if hasBloom && !bloomFilter.MayContainKey(key) {
+		atomic.AddInt64(&t.lm.lsm.metrics.bloomUseful, 1)
 		return nil, utils.ErrKeyNotFound
 	}
-	iter := t.NewIterator(&utils.Options{})
+	// 过滤器判定可能存在但实际没有找到时记为一次无效的检查
+	defer func() {
+		if hasBloom && err == utils.ErrKeyNotFound {
+			atomic.AddInt64(&t.lm.lsm.metrics.bloomUseless, 1)
+		}
+	}()
+	iter := t.NewIterator(&utils.Options{IsAsc: true})
 	defer iter.Close()
 
 	// Seek 找到第一个>=key的entry, 存储于iter.Item().Entry()中
@@ -146,21 +155,31 @@ func (t *table) block(idx int) (*block, error) {
 
 	var ko pb.BlockOffset
 	utils.CondPanic(!t.offsets(&ko, idx), fmt.Errorf("block t.offset id=%d", idx))
-	b = &block{
-		offset: int(ko.GetOffset()), // ko是pb结构, ko.GetOffset()是该block在内存映射文件中的起始地址
-	}
-
-	var err error
-	if b.data, err = t.read(b.offset, int(ko.GetLen())); err != nil {
+	data, err := t.read(int(ko.GetOffset()), int(ko.GetLen()))
+	if err != nil {
 		return nil, errors.Wrapf(err,
 			"failed to read from sstable: %d at offset: %d, len: %d",
-			t.ss.FID(), b.offset, ko.GetLen())
+			t.ss.FID(), ko.GetOffset(), ko.GetLen())
+	}
+	if b, err = decodeBlock(int(ko.GetOffset()), data); err != nil {
+		return nil, err
 	}
 
+	t.lm.cache.blocks.Set(key, b)
+
+	return b, nil
+}
+
+// decodeBlock 解析从sst中读出的block数据并校验checksum, offset是该block在sst文件中的起始地址
+func decodeBlock(offset int, data []byte) (*block, error) {
+	b := &block{offset: offset, data: data}
 	readPos := len(b.data) - 4 // First read checksum length.
+	if readPos < 0 {
+		return nil, errors.New("block is too small")
+	}
 	b.chkLen = int(utils.BytesToU32(b.data[readPos : readPos+4]))
 
-	if b.chkLen > len(b.data) {
+	if b.chkLen > readPos {
 		return nil, errors.New("invalid checksum length. Either the data is " +
 			"corrupted or the table options are incorrectly set")
 	}
@@ -170,21 +189,21 @@ func (t *table) block(idx int) (*block, error) {
 
 	b.data = b.data[:readPos] // 这样一来data存储的是kv_data+entry_offsets+entry_offsets_len
 
-	if err = b.verifyCheckSum(); err != nil {
+	if err := b.verifyCheckSum(); err != nil {
 		return nil, err
 	}
 
 	readPos -= 4
 	numEntries := int(utils.BytesToU32(b.data[readPos : readPos+4]))
 	entriesIndexStart := readPos - (numEntries * 4)
+	if entriesIndexStart < 0 {
+		return nil, errors.Errorf("invalid number of entries: %d", numEntries)
+	}
 	entriesIndexEnd := entriesIndexStart + numEntries*4
 
 	b.entryOffsets = utils.BytesToU32Slice(b.data[entriesIndexStart:entriesIndexEnd])
 
 	b.entriesIndexStart = entriesIndexStart
-
-	t.lm.cache.blocks.Set(key, b)
-
 	return b, nil
 }
 
@@ -222,7 +241,13 @@ func (t *table) NewIterator(options *utils.Options) utils.Iterator {
 		bi:  &blockIterator{},
 	}
 }
+
+// Next 升序时移动到下一个entry, 降序时移动到上一个entry
 func (it *tableIterator) Next() {
+	if !it.opt.IsAsc {
+		it.prev()
+		return
+	}
 	it.err = nil
 
 	if it.blockPos >= len(it.t.ss.Indexs().GetOffsets()) {
@@ -241,6 +266,7 @@ func (it *tableIterator) Next() {
 		it.bi.setBlock(block)
 		it.bi.seekToFirst()
 		it.err = it.bi.Error()
+		it.it = it.bi.it
 		return
 	}
 
@@ -253,6 +279,37 @@ func (it *tableIterator) Next() {
 	}
 	it.it = it.bi.it
 }
+func (it *tableIterator) prev() {
+	it.err = nil
+	if it.blockPos < 0 {
+		it.err = io.EOF
+		return
+	}
+
+	if len(it.bi.data) == 0 {
+		block, err := it.t.block(it.blockPos)
+		if err != nil {
+			it.err = err
+			return
+		}
+		it.bi.tableID = it.t.fid
+		it.bi.blockID = it.blockPos
+		it.bi.setBlock(block)
+		it.bi.seekToLast()
+		it.err = it.bi.Error()
+		it.it = it.bi.it
+		return
+	}
+
+	it.bi.prev()
+	if !it.bi.Valid() {
+		it.blockPos--
+		it.bi.data = nil
+		it.prev()
+		return
+	}
+	it.it = it.bi.it
+}
 func (it *tableIterator) Valid() bool {
 	return it.err != io.EOF // 如果没有的时候 则是EOF
 }
@@ -310,13 +367,34 @@ func (it *tableIterator) seekToLast() {
 	it.err = it.bi.Error()
 }
 
-// Seek 找到第一个>=key的entry(这里是整体比较, 若键部分相同, 则比较时间戳), 存储于tableIterator.it中
+// Seek 升序时定位到第一个>=key的entry, 降序时定位到最后一个<=key的entry
+func (it *tableIterator) Seek(key []byte) {
+	if !it.opt.IsAsc {
+		it.seekForPrev(key)
+		return
+	}
+	it.seek(key)
+}
+
+// seekForPrev 降序时定位到最后一个<=key的entry
+func (it *tableIterator) seekForPrev(key []byte) {
+	it.seek(key)
+	if !it.Valid() {
+		it.seekToLast()
+		return
+	}
+	if utils.CompareKeys(it.it.Entry().Key, key) > 0 {
+		it.prev()
+	}
+}
+
+// seek 找到第一个>=key的entry(这里是整体比较, 若键部分相同, 则比较时间戳), 存储于tableIterator.it中
 // 二分法搜索 offsets
 // 如果idx == 0 说明key只能在第一个block中 block[0].MinKey <= key
 // 否则 block[0].MinKey > key
 // 如果在 idx-1 的block中未找到key 那才可能在 idx 中
 // 如果都没有，则当前key不在此table
-func (it *tableIterator) Seek(key []byte) {
+func (it *tableIterator) seek(key []byte) {
 	var ko pb.BlockOffset // ko.GetKey()是该datablock中最小的key
 	idx := sort.Search(len(it.t.ss.Indexs().GetOffsets()), func(idx int) bool {
 		utils.CondPanic(!it.t.offsets(&ko, idx), fmt.Errorf("tableutils.Seek idx < 0 || idx > len(index.GetOffsets()"))
@@ -329,6 +407,10 @@ func (it *tableIterator) Seek(key []byte) {
 		return
 	}
 	it.seekHelper(idx-1, key)
+	// key大于idx-1个block中所有的key时, 第一个>=key的entry是idx个block的第一个
+	if it.err == io.EOF && idx < len(it.t.ss.Indexs().GetOffsets()) {
+		it.seekHelper(idx, key)
+	}
 }
 
 func (it *tableIterator) seekHelper(blockIdx int, key []byte) {
@@ -356,6 +438,21 @@ func (t *table) offsets(ko *pb.BlockOffset, i int) bool {
 	return true
 }
 
+// info 返回sst的基本信息, key会被拷贝, sst关闭后依然可以使用
+func (t *table) info(level int) TableInfo {
+	idx := t.ss.Indexs()
+	return TableInfo{
+		ID:            t.fid,
+		Level:         level,
+		Size:          t.Size(),
+		KeyCount:      idx.GetKeyCount(),
+		MaxVersion:    idx.GetMaxVersion(),
+		StaleDataSize: idx.GetStaleDataSize(),
+		MinKey:        utils.SafeCopy(nil, t.ss.MinKey()),
+		MaxKey:        utils.SafeCopy(nil, t.ss.MaxKey()),
+	}
+}
+
 // Size is its file size in bytes
 func (t *table) Size() int64 { return int64(t.ss.Size()) }
 
@@ -370,6 +467,49 @@ func (t *table) Delete() error {
 // StaleDataSize is the amount of stale data (that can be dropped by a compaction )in this SST.
 func (t *table) StaleDataSize() uint32 { return t.ss.Indexs().StaleDataSize }
 
+// expired sst中所有entry都已在now之前过期
+func (t *table) expired(now uint64) bool {
+	idx := t.ss.Indexs()
+	return idx.GetMinExpiresAt() > 0 && idx.GetMaxExpiresAt() <= now
+}
+
+// oldestEntryTime sst中最老的数据写入的时间, 没有记录时使用文件的创建时间
+func (t *table) oldestEntryTime() uint64 {
+	if ts := t.ss.Indexs().GetOldestEntryTime(); ts > 0 {
+		return ts
+	}
+	return uint64(t.GetCreatedAt().Unix())
+}
+
+// expiredDataSize 假设带过期时间的entry的过期时间在[MinExpiresAt, MaxExpiresAt]之间均匀分布, 估算now时已过期的字节数.
+// 有不过期的entry时MinExpiresAt为0, 只能在全部过期之后计入
+func (t *table) expiredDataSize(now uint64) uint64 {
+	idx := t.ss.Indexs()
+	lo, hi, size := idx.GetMinExpiresAt(), idx.GetMaxExpiresAt(), idx.GetTtlDataSize()
+	switch {
+	case size == 0:
+		return 0
+	case now >= hi:
+		return size
+	case lo == 0 || now <= lo:
+		return 0
+	}
+	return size * (now - lo) / (hi - lo)
+}
+
+// garbageRatio 墓碑占key的比例与估算的已过期数据占sst大小的比例之和
+func (t *table) garbageRatio(now uint64) float64 {
+	idx := t.ss.Indexs()
+	var ratio float64
+	if n := idx.GetKeyCount(); n > 0 {
+		ratio += float64(idx.GetTombstoneCount()) / float64(n)
+	}
+	if sz := t.Size(); sz > 0 {
+		ratio += float64(t.expiredDataSize(now)) / float64(sz)
+	}
+	return ratio
+}
+
 // DecrRef decrements the refcount and possibly deletes the table
 func (t *table) DecrRef() error {
 	newRef := atomic.AddInt32(&t.ref, -1)
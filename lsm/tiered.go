@@ -0,0 +1,152 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lsm
+
+import "sort"
+
+// TieredOptions 分级压缩的参数, 为0的字段使用默认值
+type TieredOptions struct {
+	// SizeRatio 较老的run不超过较新的run的(100+SizeRatio)%时合并两者, 默认100
+	SizeRatio int
+	// MaxSizeAmplificationPercent 较新的run的总大小达到最老的run的该百分比时, 把次老的run合并到最老的run, 默认200
+	MaxSizeAmplificationPercent int
+}
+
+// newTieredStrategy 分级(universal)压缩, l0的每个sst与每个非空的level各是一个sorted run.
+// l0的sst数量达到NumLevelZeroTables时整体写成一个新的run, 之后大小相近的相邻run两两合并.
+// 写放大远小于分层压缩, 代价是更大的读放大与空间放大, 适合写多读少的负载
+func newTieredStrategy(opt TieredOptions) *tieredStrategy {
+	if opt.SizeRatio <= 0 {
+		opt.SizeRatio = 100
+	}
+	if opt.MaxSizeAmplificationPercent <= 0 {
+		opt.MaxSizeAmplificationPercent = 200
+	}
+	return &tieredStrategy{opt: opt}
+}
+
+type tieredStrategy struct {
+	opt TieredOptions
+}
+
+// targets 分级压缩没有每层的目标大小
+func (s *tieredStrategy) targets(lm *levelManager) targets {
+	return uniformTargets(lm)
+}
+
+func (s *tieredStrategy) throttlesL0() bool { return true }
+
+func (s *tieredStrategy) priorities(lm *levelManager, id int) []compactionPriority {
+	t := s.targets(lm)
+	var prios []compactionPriority
+	add := func(level int, score float64) {
+		for _, p := range prios {
+			if p.level == level {
+				return
+			}
+		}
+		prios = append(prios, compactionPriority{level: level, score: score, adjusted: score, t: t})
+	}
+
+	levels, sizes := s.runs(lm)
+	// 大小相近的相邻run两两合并
+	for i := 0; i+1 < len(levels); i++ {
+		if sizes[i+1]*100 <= sizes[i]*int64(100+s.opt.SizeRatio) {
+			add(levels[i], float64(sizes[i])/float64(sizes[i+1]))
+		}
+	}
+	// 较新的数据过多时向最老的run合并, 限制空间放大
+	if n := len(levels); n >= 2 {
+		var newer int64
+		for _, sz := range sizes[:n-1] {
+			newer += sz
+		}
+		if amp := newer * 100 / sizes[n-1]; amp >= int64(s.opt.MaxSizeAmplificationPercent) {
+			add(levels[n-2], float64(amp)/float64(s.opt.MaxSizeAmplificationPercent))
+		}
+	}
+	sort.Slice(prios, func(i, j int) bool {
+		return prios[i].adjusted > prios[j].adjusted
+	})
+
+	// l0积压会阻塞写入, 总是最先处理
+	if n := lm.levels[0].numTables(); n >= lm.opt.NumLevelZeroTables {
+		score := float64(n) / float64(lm.opt.NumLevelZeroTables)
+		prios = append([]compactionPriority{{level: 0, score: score, adjusted: score, t: t}}, prios...)
+	}
+	return prios
+}
+
+// fill 整层参与压缩, 保证每个level仍然是一个sorted run, 并且较新的run总是在较老的run之上
+func (s *tieredStrategy) fill(lm *levelManager, cd *compactDef) bool {
+	next := s.nextRun(lm, cd.thisLevel.levelNum)
+	if cd.thisLevel.levelNum == 0 {
+		next = s.flushTarget(lm)
+	}
+	if next < 0 {
+		return false
+	}
+	cd.nextLevel = lm.levels[next]
+	cd.lockLevels()
+	defer cd.unlockLevels()
+
+	if len(cd.thisLevel.tables) == 0 {
+		return false
+	}
+	cd.top = append([]*table{}, cd.thisLevel.tables...)
+	cd.bot = append([]*table{}, cd.nextLevel.tables...)
+	cd.thisRange = getKeyRange(cd.top...)
+	cd.nextRange = cd.thisRange
+	if len(cd.bot) > 0 {
+		cd.nextRange = getKeyRange(cd.bot...)
+	}
+	for _, t := range cd.top {
+		cd.thisSize += t.Size()
+	}
+	return lm.compactState.compareAndAdd(thisAndNextLevelRLocked{}, *cd)
+}
+
+// runs 由新到老返回l0之下非空的level及其大小
+func (s *tieredStrategy) runs(lm *levelManager) (levels []int, sizes []int64) {
+	for i := 1; i < len(lm.levels); i++ {
+		if lm.levels[i].numTables() > 0 {
+			levels = append(levels, i)
+			sizes = append(sizes, lm.levels[i].getTotalSize())
+		}
+	}
+	return levels, sizes
+}
+
+// nextRun 返回level之下第一个非空的level, 没有时返回-1
+func (s *tieredStrategy) nextRun(lm *levelManager, level int) int {
+	for i := level + 1; i < len(lm.levels); i++ {
+		if lm.levels[i].numTables() > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// flushTarget l0写成的新run放在最新的run之上的空level, l1已经有数据时只能与l1合并
+func (s *tieredStrategy) flushTarget(lm *levelManager) int {
+	next := s.nextRun(lm, 0)
+	switch next {
+	case -1:
+		return len(lm.levels) - 1
+	case 1:
+		return 1
+	}
+	return next - 1
+}
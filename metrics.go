@@ -0,0 +1,147 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/hardcore-os/corekv/lsm"
+	"github.com/hardcore-os/corekv/utils/metrics"
+)
+
+// dbMetrics 导出给Prometheus的指标, lsm与缓存的计数在输出时读取, 需要在lsm初始化之后创建
+type dbMetrics struct {
+	reg           *metrics.Registry
+	getLatency    *metrics.Histogram
+	setLatency    *metrics.Histogram
+	vlogGCRuns    *metrics.Counter
+	vlogGCBytes   *metrics.Counter
+	writeStalls   *metrics.Counter
+	pendingWrites int64 // doWrites中等待写入的请求数
+
+	// 每次输出前取一次的lsm快照, 只在Registry.WriteTo中读写
+	snap metricsSnapshot
+}
+
+type metricsSnapshot struct {
+	lsm           lsm.Metrics
+	levels        []lsm.LevelInfo
+	caches        []lsm.CacheInfo
+	memSize       int64
+	numImmutables int
+}
+
+func newDBMetrics(db *DB) *dbMetrics {
+	reg := metrics.NewRegistry()
+	m := &dbMetrics{
+		reg:         reg,
+		getLatency:  reg.Histogram("corekv_get_latency_seconds", "Latency of DB.Get.", nil, nil),
+		setLatency:  reg.Histogram("corekv_set_latency_seconds", "Latency of DB.Set and DB.Del.", nil, nil),
+		vlogGCRuns:  reg.Counter("corekv_vlog_gc_runs_total", "Number of value log files rewritten by gc.", nil),
+		vlogGCBytes: reg.Counter("corekv_vlog_gc_reclaimed_bytes_total", "Bytes of value log reclaimed by gc.", nil),
+		writeStalls: reg.Counter("corekv_write_stalls_total", "Number of times writes were delayed or blocked by pending writes or too many L0 tables.", nil),
+	}
+	reg.OnScrape(func() {
+		s := &m.snap
+		s.lsm = db.lsm.Metrics()
+		s.levels = db.lsm.LevelsInfo()
+		s.caches = db.lsm.CacheInfo()
+		s.memSize, s.numImmutables, _ = db.lsm.MemTablesInfo()
+	})
+	reg.GaugeFunc("corekv_pending_writes", "Write requests waiting to be committed.", nil, func() float64 {
+		return float64(atomic.LoadInt64(&m.pendingWrites))
+	})
+
+	counter := func(name, help string, fn func() int64) {
+		reg.CounterFunc(name, help, nil, func() float64 { return float64(fn()) })
+	}
+	counter("corekv_gets_total", "Number of DB.Get calls.", func() int64 { return atomic.LoadInt64(&db.stats.numGets) })
+	counter("corekv_sets_total", "Number of user keys written.", func() int64 { return atomic.LoadInt64(&db.stats.numSets) })
+	counter("corekv_deletes_total", "Number of user keys deleted.", func() int64 { return atomic.LoadInt64(&db.stats.numDeletes) })
+	counter("corekv_read_bytes_total", "User key and value bytes returned by DB.Get.", func() int64 { return atomic.LoadInt64(&db.stats.bytesRead) })
+	counter("corekv_written_bytes_total", "User key and value bytes written.", func() int64 { return atomic.LoadInt64(&db.stats.bytesWritten) })
+	counter("corekv_vlog_written_bytes_total", "Bytes appended to the value log.", func() int64 { return atomic.LoadInt64(&db.vlog.bytesWritten) })
+	counter("corekv_wal_written_bytes_total", "Bytes appended to the wal.", func() int64 { return m.snap.lsm.WalBytesWritten })
+	counter("corekv_flushes_total", "Number of memtable flushes.", func() int64 { return m.snap.lsm.NumFlushes })
+	counter("corekv_flush_written_bytes_total", "Bytes of sst written by flushes.", func() int64 { return m.snap.lsm.FlushBytesWritten })
+	counter("corekv_compactions_total", "Number of compactions.", func() int64 { return m.snap.lsm.NumCompactions })
+	counter("corekv_bloom_filter_useful_total", "Table lookups skipped by the bloom filter.", func() int64 { return m.snap.lsm.BloomUseful })
+	counter("corekv_bloom_filter_useless_total", "Table lookups the bloom filter let through but found nothing.", func() int64 { return m.snap.lsm.BloomUseless })
+
+	for _, name := range []string{"block", "index"} {
+		name := name
+		labels := metrics.Labels{"cache": name}
+		reg.CounterFunc("corekv_cache_hits_total", "Cache hits.", labels, func() float64 {
+			return float64(m.snap.cacheInfo(name).Hits)
+		})
+		reg.CounterFunc("corekv_cache_misses_total", "Cache misses.", labels, func() float64 {
+			return float64(m.snap.cacheInfo(name).Misses)
+		})
+	}
+
+	for level := range db.lsm.Metrics().Levels {
+		level := level
+		labels := metrics.Labels{"level": strconv.Itoa(level)}
+		reg.CounterFunc("corekv_compaction_read_bytes_total", "Bytes read by compactions into this level.", labels, func() float64 {
+			return float64(m.snap.lsm.Levels[level].CompactionBytesRead)
+		})
+		reg.CounterFunc("corekv_compaction_written_bytes_total", "Bytes written by compactions into this level.", labels, func() float64 {
+			return float64(m.snap.lsm.Levels[level].CompactionBytesWritten)
+		})
+		reg.GaugeFunc("corekv_level_size_bytes", "Total sst size of the level.", labels, func() float64 {
+			return float64(m.snap.levels[level].Size)
+		})
+		reg.GaugeFunc("corekv_level_tables", "Number of sst in the level.", labels, func() float64 {
+			return float64(m.snap.levels[level].NumTables)
+		})
+	}
+	reg.GaugeFunc("corekv_memtable_size_bytes", "Wal bytes of the active memtable.", nil, func() float64 {
+		return float64(m.snap.memSize)
+	})
+	reg.GaugeFunc("corekv_immutable_memtables", "Number of memtables waiting to be flushed.", nil, func() float64 {
+		return float64(m.snap.numImmutables)
+	})
+	return m
+}
+
+func (s *metricsSnapshot) cacheInfo(name string) lsm.CacheInfo {
+	for _, c := range s.caches {
+		if c.Name == name {
+			return c
+		}
+	}
+	return lsm.CacheInfo{Name: name}
+}
+
+func observeSince(h *metrics.Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// MetricsHandler 返回以Prometheus文本格式输出指标的http.Handler
+//
+//	http.Handle("/metrics", db.MetricsHandler())
+func (db *DB) MetricsHandler() http.Handler {
+	return db.metrics.reg
+}
+
+// WriteMetrics 以Prometheus文本格式将指标写入w
+func (db *DB) WriteMetrics(w io.Writer) error {
+	_, err := db.metrics.reg.WriteTo(w)
+	return err
+}
@@ -0,0 +1,70 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	clearDir()
+	mopt := *opt
+	mopt.ValueLogMaxEntries = 1000
+	db := Open(&mopt)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))))
+	}
+	require.NoError(t, db.Flush())
+	for i := 0; i < 5; i++ {
+		_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+	}
+
+	srv := httptest.NewServer(db.MetricsHandler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	lines := map[string]bool{}
+	for _, l := range strings.Split(string(body), "\n") {
+		lines[l] = true
+	}
+	for _, l := range []string{
+		"# TYPE corekv_get_latency_seconds histogram",
+		"corekv_get_latency_seconds_count 5",
+		"corekv_set_latency_seconds_count 20",
+		"corekv_gets_total 5",
+		"corekv_sets_total 20",
+		"corekv_flushes_total 1",
+		`corekv_level_tables{level="0"} 1`,
+		"# TYPE corekv_cache_hits_total counter",
+		"# TYPE corekv_compaction_written_bytes_total counter",
+		"corekv_vlog_gc_runs_total 0",
+		"corekv_write_stalls_total 0",
+	} {
+		require.True(t, lines[l], "missing %q in\n%s", l, body)
+	}
+}
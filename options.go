@@ -14,7 +14,12 @@
 
 package corekv
 
-import "github.com/hardcore-os/corekv/utils"
+import (
+	"time"
+
+	"github.com/hardcore-os/corekv/lsm"
+	"github.com/hardcore-os/corekv/utils"
+)
 
 // Options corekv 总的配置文件
 type Options struct {
@@ -29,6 +34,31 @@ type Options struct {
 	ValueLogMaxEntries  uint32
 	LogRotatesToFlush   int32
 	MaxTableSize        int64
+	// ReplicationLogSize 作为leader时在内存中保留的最近提交批次数, 0表示不作为leader
+	ReplicationLogSize int
+	// EventListener 接收flush、压缩、vlog gc等后台任务的事件, 为nil时不回调
+	EventListener EventListener
+	// CompactionFilter 在压缩时删除或改写key, 为nil时压缩只丢弃过期的key
+	CompactionFilter CompactionFilter
+	// Logger 为nil时使用utils.DefaultLogger, 测试中可以用utils.NopLogger静默
+	Logger utils.Logger
+	// NumLevelZeroTablesSlowdown l0的sst数量达到该值时延迟写入, 0表示默认值30, 不小于15
+	NumLevelZeroTablesSlowdown int
+	// NumLevelZeroTablesStall l0的sst数量达到该值时阻塞写入直到压缩完成, 0表示默认值45
+	NumLevelZeroTablesStall int
+	// CompactionStyle 默认为lsm.LeveledCompaction, 也可以使用lsm.TieredCompaction减少写放大,
+	// 或者对带过期时间的时序数据使用lsm.FIFOCompaction直接删除过期的sst
+	CompactionStyle lsm.CompactionStyle
+	// TieredOptions 与 FIFOOptions 分别是lsm.TieredCompaction与lsm.FIFOCompaction的参数
+	TieredOptions lsm.TieredOptions
+	FIFOOptions   lsm.FIFOOptions
+	// CompactionTableAge 与 CompactionGarbageRatio 见lsm.Options, 使过老或墓碑与过期数据过多的sst被压缩, 0表示不启用,
+	// 启用后没有旧版本的墓碑与过期的数据在压缩时被丢弃
+	CompactionTableAge     time.Duration
+	CompactionGarbageRatio float64
+	// RateLimiter 限制flush、压缩与vlog gc的写入速度, flush优先于后两者且不受自动调整的影响, 为nil时不限速.
+	// flush在后台进行, 限速不会阻塞写入, 直到积压的immutable过多
+	RateLimiter *utils.RateLimiter
 }
 
 // NewDefaultOptions 返回默认的options
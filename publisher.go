@@ -0,0 +1,177 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// subscriberCapacity 订阅者缓冲的批次数, 缓冲满时该订阅者被断开
+const subscriberCapacity = 1000
+
+// publisher 将已经写入lsm的数据按提交顺序分发给订阅者
+type publisher struct {
+	sync.Mutex
+	subscribers map[uint64]*subscriber
+	nextID      uint64
+	numSubs     int32
+	closer      *utils.Closer
+}
+
+type subscriber struct {
+	id       uint64
+	prefixes [][]byte
+	sendCh   chan *pb.KVList
+	dropped  chan struct{} // 订阅者处理不过来被断开时关闭
+}
+
+func newPublisher() *publisher {
+	return &publisher{
+		subscribers: make(map[uint64]*subscriber),
+		closer:      utils.NewCloser(),
+	}
+}
+
+// hasSubscribers 写入路径上的快速判断, 没有订阅者时不需要构造kv
+func (p *publisher) hasSubscribers() bool {
+	return atomic.LoadInt32(&p.numSubs) > 0
+}
+
+// entriesToKVs 在写入lsm之前拷贝entry, 之后entry的value可能被替换为值指针
+func entriesToKVs(entries []*utils.Entry) []*pb.KV {
+	kvs := make([]*pb.KV, 0, len(entries))
+	for _, e := range entries {
+		if bytes.HasPrefix(e.Key, corekvPrefix) {
+			continue
+		}
+		kvs = append(kvs, &pb.KV{
+			Key:       utils.SafeCopy(nil, utils.ParseKey(e.Key)),
+			Value:     utils.SafeCopy(nil, e.Value),
+			Meta:      []byte{e.Meta &^ utils.BitValuePointer},
+			Version:   utils.ParseTs(e.Key),
+			ExpiresAt: e.ExpiresAt,
+		})
+	}
+	return kvs
+}
+
+// send 在写入路径上持有db.writeLock调用, 保证订阅者看到的顺序就是提交顺序.
+// 投递不会阻塞写入, 缓冲已满的订阅者会被断开
+func (p *publisher) send(kvs []*pb.KV) {
+	if len(kvs) == 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	for _, s := range p.subscribers {
+		list := &pb.KVList{}
+		for _, kv := range kvs {
+			if s.match(kv.Key) {
+				list.Kv = append(list.Kv, kv)
+			}
+		}
+		if len(list.Kv) == 0 {
+			continue
+		}
+		select {
+		case s.sendCh <- list:
+		default:
+			p.remove(s)
+			close(s.dropped)
+		}
+	}
+}
+
+func (s *subscriber) match(key []byte) bool {
+	for _, prefix := range s.prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *publisher) subscribe(prefixes [][]byte) *subscriber {
+	p.Lock()
+	defer p.Unlock()
+	s := &subscriber{
+		id:       p.nextID,
+		prefixes: prefixes,
+		sendCh:   make(chan *pb.KVList, subscriberCapacity),
+		dropped:  make(chan struct{}),
+	}
+	p.nextID++
+	p.subscribers[s.id] = s
+	atomic.AddInt32(&p.numSubs, 1)
+	return s
+}
+
+func (p *publisher) unsubscribe(s *subscriber) {
+	p.Lock()
+	defer p.Unlock()
+	p.remove(s)
+}
+
+// remove 调用方需要持有锁, 订阅者可能已经因为处理不过来被移除
+func (p *publisher) remove(s *subscriber) {
+	if _, ok := p.subscribers[s.id]; !ok {
+		return
+	}
+	delete(p.subscribers, s.id)
+	atomic.AddInt32(&p.numSubs, -1)
+}
+
+func (p *publisher) close() {
+	p.closer.Close()
+}
+
+// Subscribe 订阅带有指定前缀的key的写入, 每次提交的写入按提交顺序以KVList的形式交给fn
+// 删除操作的KV带有BitDelete标记; fn返回的错误或ctx的错误会结束订阅并返回, DB关闭时返回nil.
+// fn处理不过来使缓冲的批次达到subscriberCapacity时订阅被断开, 返回utils.ErrSubscriberTooSlow
+func (db *DB) Subscribe(ctx context.Context, prefixes [][]byte, fn func(kv *pb.KVList) error) error {
+	if fn == nil {
+		return errors.New("callback must be set")
+	}
+	if len(prefixes) == 0 {
+		return errors.New("at least one prefix is required")
+	}
+	copied := make([][]byte, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		copied = append(copied, utils.SafeCopy(nil, prefix))
+	}
+	s := db.pub.subscribe(copied)
+	defer db.pub.unsubscribe(s)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.pub.closer.CloseSignal:
+			return nil
+		case <-s.dropped:
+			return utils.ErrSubscriberTooSlow
+		case list := <-s.sendCh:
+			if err := fn(list); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	clearDir()
+	sopt := *opt
+	sopt.ValueLogMaxEntries = 1000
+	db := Open(&sopt)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var (
+		wg     sync.WaitGroup
+		got    []*pb.KV
+		subErr error
+	)
+	n := 50
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		subErr = db.Subscribe(ctx, [][]byte{[]byte("user/"), []byte("order/")}, func(list *pb.KVList) error {
+			got = append(got, list.Kv...)
+			// 收到全部写入之后结束订阅
+			if len(got) == n+2 {
+				cancel()
+			}
+			return nil
+		})
+	}()
+	// 等待订阅生效
+	for !db.pub.hasSubscribers() {
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("user/%03d", i)), []byte(fmt.Sprintf("v%d", i)))))
+		// 不匹配前缀的写入不会被投递
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("other/%03d", i)), []byte("x"))))
+	}
+	require.NoError(t, db.Del([]byte("user/000")))
+	// 批量写入路径
+	require.NoError(t, db.batchSet([]*utils.Entry{
+		utils.NewEntry(utils.KeyWithTs([]byte("order/1"), 1), []byte("o1")),
+	}))
+	wg.Wait()
+	require.Equal(t, context.Canceled, subErr)
+
+	require.Len(t, got, n+2)
+	for i := 0; i < n; i++ {
+		require.Equal(t, fmt.Sprintf("user/%03d", i), string(got[i].Key))
+		require.Equal(t, fmt.Sprintf("v%d", i), string(got[i].Value))
+	}
+	require.Equal(t, "user/000", string(got[n].Key))
+	require.Equal(t, utils.BitDelete, got[n].Meta[0]&utils.BitDelete)
+	require.Equal(t, "order/1", string(got[n+1].Key))
+	require.Equal(t, uint64(1), got[n+1].Version)
+	require.False(t, db.pub.hasSubscribers())
+}
+
+// TestSlowSubscriber 处理不过来的订阅者被断开, 不会阻塞写入
+func TestSlowSubscriber(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	defer db.Close()
+
+	release := make(chan struct{})
+	subErr := make(chan error, 1)
+	go func() {
+		subErr <- db.Subscribe(context.Background(), [][]byte{[]byte("key")}, func(*pb.KVList) error {
+			<-release
+			return nil
+		})
+	}()
+	for !db.pub.hasSubscribers() {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < subscriberCapacity+10; i++ {
+			require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%d", i)), []byte("val"))))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("writes blocked by a slow subscriber")
+	}
+	require.False(t, db.pub.hasSubscribers())
+	close(release)
+	require.Equal(t, utils.ErrSubscriberTooSlow, <-subErr)
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// KV 以corekv作为raft的状态机, 日志中的每一项是编码后的WriteBatch
+// raft日志不落盘, 因此打开时WorkDir必须为空, 重启后的数据由leader通过快照补齐
+type KV struct {
+	sync.RWMutex
+	opt *corekv.Options
+	db  *corekv.DB
+}
+
+// NewKV 在opt.WorkDir上打开一个新的DB, WorkDir不存在时创建, 已经有数据时返回错误
+func NewKV(opt *corekv.Options) (*KV, error) {
+	if err := os.MkdirAll(opt.WorkDir, 0755); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(opt.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) > 0 {
+		return nil, errors.Errorf("raft: work dir %s is not empty", opt.WorkDir)
+	}
+	return &KV{opt: opt, db: corekv.Open(opt)}, nil
+}
+
+// Apply 通过DB的批量写入路径应用一个WriteBatch
+func (kv *KV) Apply(data []byte) error {
+	wb, err := corekv.UnmarshalWriteBatch(data)
+	if err != nil {
+		return err
+	}
+	kv.RLock()
+	defer kv.RUnlock()
+	return kv.db.Write(wb)
+}
+
+// Snapshot 用迭代器导出当前所有数据, 格式与DB.Backup相同
+func (kv *KV) Snapshot(w io.Writer) error {
+	kv.RLock()
+	defer kv.RUnlock()
+	_, err := kv.db.Backup(w, 0)
+	return err
+}
+
+// Restore 清空DB后导入快照
+func (kv *KV) Restore(r io.Reader) error {
+	kv.Lock()
+	defer kv.Unlock()
+	if err := kv.db.Close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(kv.opt.WorkDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(kv.opt.WorkDir, 0755); err != nil {
+		return err
+	}
+	kv.db = corekv.Open(kv.opt)
+	return kv.db.Load(r)
+}
+
+// Get 读取本节点已经应用的数据, follower上可能读到旧值
+func (kv *KV) Get(key []byte) (*utils.Entry, error) {
+	kv.RLock()
+	defer kv.RUnlock()
+	return kv.db.Get(key)
+}
+
+// Close _
+func (kv *KV) Close() error {
+	kv.Lock()
+	defer kv.Unlock()
+	return kv.db.Close()
+}
+
+// Store 一个raft节点与其corekv状态机的组合
+type Store struct {
+	*Node
+	kv *KV
+}
+
+// NewStore 打开状态机并启动raft节点
+func NewStore(cfg Config, trans Transport, opt *corekv.Options) (*Store, error) {
+	kv, err := NewKV(opt)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Node: NewNode(cfg, trans, kv), kv: kv}, nil
+}
+
+// Write 将wb作为一条日志提交, 返回时wb已经应用到本节点
+func (s *Store) Write(ctx context.Context, wb *corekv.WriteBatch) error {
+	data, err := wb.Marshal()
+	if err != nil {
+		return err
+	}
+	return s.Propose(ctx, data)
+}
+
+// Get _
+func (s *Store) Get(key []byte) (*utils.Entry, error) {
+	return s.kv.Get(key)
+}
+
+// Close 先停止raft节点, 再关闭DB
+func (s *Store) Close() error {
+	s.Node.Close()
+	return s.kv.Close()
+}
@@ -0,0 +1,710 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package raft 一个精简的raft实现, 将corekv作为状态机复制到多个节点
+// raft的term、投票与日志目前只保存在内存中, 节点需要以空的状态机启动, 落后的数据通过快照从leader获取.
+// term与votedFor不落盘, 重启的节点从term 0开始, 可能在同一个term中投出第二票,
+// 同一个term可能选出两个leader, 因此不能依赖它提供重启前后的安全性
+package raft
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotLeader 只有leader能够接受写入
+	ErrNotLeader = errors.New("raft: not leader")
+	// ErrProposalDropped 写入所在的日志被新的leader覆盖, 或者被快照跳过, 无法确定是否生效
+	ErrProposalDropped = errors.New("raft: proposal dropped")
+	// ErrClosed 节点已经关闭
+	ErrClosed = errors.New("raft: node closed")
+)
+
+// StateMachine 被复制的状态机, Apply按日志顺序串行调用
+// Snapshot与Restore同样在应用日志的goroutine中调用, 期间不会有Apply
+type StateMachine interface {
+	Apply(data []byte) error
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// Config 节点配置
+type Config struct {
+	ID    string
+	Peers []string // 集群中所有节点的id, 包括自己
+	// ElectionTimeout 选举超时的下限, 实际超时在[ElectionTimeout, 2*ElectionTimeout)之间随机
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold 已应用但未压缩的日志达到该数量时生成快照并截断日志, 0表示不做快照
+	SnapshotThreshold uint64
+	// SnapshotDir 快照写入该目录下的文件而不是保存在内存中, 为空时使用os.TempDir
+	SnapshotDir string
+}
+
+// State 节点角色
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Status 节点的当前状态
+type Status struct {
+	ID            string
+	State         State
+	Term          uint64
+	Leader        string
+	CommitIndex   uint64
+	AppliedIndex  uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+}
+
+type proposal struct {
+	term uint64
+	ch   chan error
+}
+
+// Node 一个raft节点
+type Node struct {
+	mu    sync.Mutex
+	cfg   Config
+	trans Transport
+	fsm   StateMachine
+
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+
+	// log[0]是快照位置的占位项, 真实日志从log[1]开始
+	log      []Entry
+	snapshot string // 快照文件的路径, 为空表示还没有快照
+
+	commitIndex  uint64
+	lastApplied  uint64
+	restoreSnap  bool // 收到了leader的快照, 等待应用goroutine恢复状态机
+	nextIndex    map[string]uint64
+	matchIndex   map[string]uint64
+	inflight     map[string]bool
+	proposals    map[uint64]*proposal
+	lastBeat     time.Time
+	electionTime time.Time
+
+	applyCond *sync.Cond
+	closed    bool
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewNode 创建并启动节点
+func NewNode(cfg Config, trans Transport, fsm StateMachine) *Node {
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = 300 * time.Millisecond
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = cfg.ElectionTimeout / 5
+	}
+	n := &Node{
+		cfg:        cfg,
+		trans:      trans,
+		fsm:        fsm,
+		log:        []Entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		proposals:  make(map[uint64]*proposal),
+		closeCh:    make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionTimer()
+	n.wg.Add(2)
+	go n.ticker()
+	go n.applier()
+	return n
+}
+
+// Close 停止节点, 未完成的写入返回ErrClosed
+func (n *Node) Close() {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	close(n.closeCh)
+	for idx, p := range n.proposals {
+		p.ch <- ErrClosed
+		delete(n.proposals, idx)
+	}
+	n.applyCond.Broadcast()
+	n.mu.Unlock()
+	n.wg.Wait()
+	// 重启后不会再使用快照
+	if n.snapshot != "" {
+		os.Remove(n.snapshot)
+	}
+}
+
+// Status 返回节点的当前状态
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.cfg.ID,
+		State:         n.state,
+		Term:          n.term,
+		Leader:        n.leader,
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		LastIndex:     n.lastIndex(),
+		SnapshotIndex: n.log[0].Index,
+	}
+}
+
+// Propose 追加一条日志, 等待它被多数派提交并应用到本节点的状态机, 返回状态机Apply的结果
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	if n.state != Leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	idx := n.appendLocal(data)
+	p := &proposal{term: n.term, ch: make(chan error, 1)}
+	n.proposals[idx] = p
+	n.broadcastAppend()
+	n.mu.Unlock()
+
+	select {
+	case err := <-p.ch:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.proposals, idx)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) entry(idx uint64) Entry {
+	return n.log[idx-n.log[0].Index]
+}
+
+func (n *Node) majority() int {
+	return len(n.cfg.Peers)/2 + 1
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionTime = time.Now().Add(timeout)
+}
+
+// appendLocal leader追加一条本地日志, 返回其index
+func (n *Node) appendLocal(data []byte) uint64 {
+	idx := n.lastIndex() + 1
+	n.log = append(n.log, Entry{Index: idx, Term: n.term, Data: data})
+	n.matchIndex[n.cfg.ID] = idx
+	// 单节点集群不需要等待其他节点
+	n.advanceCommit()
+	return idx
+}
+
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+	}
+	n.state = Follower
+}
+
+func (n *Node) becomeLeader() {
+	n.state = Leader
+	n.leader = n.cfg.ID
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	// 追加一条当前term的空日志, 之前term的日志随它一起提交
+	n.appendLocal(nil)
+	n.broadcastAppend()
+}
+
+func (n *Node) ticker() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.cfg.HeartbeatInterval / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-n.closeCh:
+			return
+		case <-t.C:
+		}
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.state == Leader:
+			if now.Sub(n.lastBeat) >= n.cfg.HeartbeatInterval {
+				n.broadcastAppend()
+			}
+		case now.After(n.electionTime):
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) startElection() {
+	n.state = Candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.resetElectionTimer()
+	req := &RequestVoteRequest{
+		Term:         n.term,
+		Candidate:    n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[len(n.log)-1].Term,
+	}
+	votes := 1
+	if votes >= n.majority() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		go func(peer string) {
+			resp, err := n.trans.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.state != Candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.majority() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// broadcastAppend 向所有follower发送日志或心跳, 调用时持有锁
+func (n *Node) broadcastAppend() {
+	n.lastBeat = time.Now()
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID || n.inflight[peer] {
+			continue
+		}
+		n.inflight[peer] = true
+		go n.replicate(peer, n.term)
+	}
+}
+
+// replicate 持续向peer发送日志, 直到peer跟上或者请求失败
+func (n *Node) replicate(peer string, term uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer func() { n.inflight[peer] = false }()
+	for !n.closed && n.state == Leader && n.term == term {
+		next := n.nextIndex[peer]
+		if next <= n.log[0].Index {
+			if !n.sendSnapshot(peer) {
+				return
+			}
+			continue
+		}
+		req := &AppendEntriesRequest{
+			Term:         n.term,
+			Leader:       n.cfg.ID,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  n.entry(next - 1).Term,
+			Entries:      append([]Entry(nil), n.log[next-n.log[0].Index:]...),
+			LeaderCommit: n.commitIndex,
+		}
+		n.mu.Unlock()
+		resp, err := n.trans.AppendEntries(peer, req)
+		n.mu.Lock()
+		if err != nil {
+			return
+		}
+		if resp.Term > n.term {
+			n.becomeFollower(resp.Term)
+			return
+		}
+		if n.state != Leader || n.term != req.Term {
+			return
+		}
+		if !resp.Success {
+			n.nextIndex[peer] = resp.ConflictIndex
+			if n.nextIndex[peer] < 1 {
+				n.nextIndex[peer] = 1
+			}
+			continue
+		}
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+		// 发送期间又有新的日志, 继续发送; 否则等待下一次心跳
+		if n.nextIndex[peer] > n.lastIndex() {
+			return
+		}
+	}
+}
+
+// sendSnapshot 发送快照, 调用时持有锁, 发送期间释放锁
+func (n *Node) sendSnapshot(peer string) bool {
+	// 之后的快照会替换这个文件, 已经打开的文件依然可读
+	f, err := os.Open(n.snapshot)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	req := &InstallSnapshotRequest{
+		Term:              n.term,
+		Leader:            n.cfg.ID,
+		LastIncludedIndex: n.log[0].Index,
+		LastIncludedTerm:  n.log[0].Term,
+		Data:              f,
+	}
+	n.mu.Unlock()
+	resp, err := n.trans.InstallSnapshot(peer, req)
+	n.mu.Lock()
+	if err != nil {
+		return false
+	}
+	if resp.Term > n.term {
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.state != Leader || n.term != req.Term {
+		return false
+	}
+	if req.LastIncludedIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = req.LastIncludedIndex
+	}
+	n.nextIndex[peer] = req.LastIncludedIndex + 1
+	return true
+}
+
+// advanceCommit leader只根据当前term的日志推进commitIndex
+func (n *Node) advanceCommit() {
+	for idx := n.lastIndex(); idx > n.commitIndex && idx > n.log[0].Index; idx-- {
+		if n.entry(idx).Term != n.term {
+			break
+		}
+		count := 0
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= idx {
+				count++
+			}
+		}
+		if count >= n.majority() {
+			n.commitIndex = idx
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// HandleRequestVote _
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	if req.Term > n.term {
+		n.becomeFollower(req.Term)
+	}
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return resp, nil
+	}
+	// 候选者的日志至少要和自己一样新
+	lastTerm := n.log[len(n.log)-1].Term
+	if req.LastLogTerm < lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex < n.lastIndex()) {
+		return resp, nil
+	}
+	n.votedFor = req.Candidate
+	n.resetElectionTimer()
+	resp.Granted = true
+	return resp, nil
+}
+
+// HandleAppendEntries _
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	resp := &AppendEntriesResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	n.becomeFollower(req.Term)
+	n.leader = req.Leader
+	n.resetElectionTimer()
+	resp.Term = n.term
+
+	// 已经包含在快照中的日志一定是一致的, 直接跳过
+	entries := req.Entries
+	prevIndex, prevTerm := req.PrevLogIndex, req.PrevLogTerm
+	if base := n.log[0]; prevIndex < base.Index {
+		skip := base.Index - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prevIndex, prevTerm = base.Index, base.Term
+	}
+	if prevIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if term := n.entry(prevIndex).Term; term != prevTerm {
+		// 跳过整个冲突的term, 减少来回的次数
+		idx := prevIndex
+		for idx > n.log[0].Index+1 && n.entry(idx-1).Term == term {
+			idx--
+		}
+		resp.ConflictIndex = idx
+		return resp, nil
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			// 删除冲突及之后的日志
+			n.log = n.log[:e.Index-n.log[0].Index]
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+	if req.LeaderCommit > n.commitIndex {
+		last := prevIndex + uint64(len(entries))
+		n.commitIndex = req.LeaderCommit
+		if last < n.commitIndex {
+			n.commitIndex = last
+		}
+		n.applyCond.Broadcast()
+	}
+	resp.Success = true
+	return resp, nil
+}
+
+// HandleInstallSnapshot _
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	// 在锁外把快照写入文件, 没有用到时删除
+	path, err := n.writeSnapshot(func(w io.Writer) error {
+		_, err := io.Copy(w, req.Data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(path)
+		}
+	}()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, ErrClosed
+	}
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	n.becomeFollower(req.Term)
+	n.leader = req.Leader
+	n.resetElectionTimer()
+	resp.Term = n.term
+	// 快照中的日志已经提交过了, 不需要再恢复
+	if req.LastIncludedIndex <= n.commitIndex {
+		return resp, nil
+	}
+	base := Entry{Index: req.LastIncludedIndex, Term: req.LastIncludedTerm}
+	if idx := req.LastIncludedIndex; idx <= n.lastIndex() && n.entry(idx).Term == req.LastIncludedTerm {
+		n.log = append([]Entry{base}, n.log[idx-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{base}
+	}
+	n.setSnapshot(path)
+	installed = true
+	n.commitIndex = req.LastIncludedIndex
+	n.restoreSnap = true
+	n.applyCond.Broadcast()
+	return resp, nil
+}
+
+// applier 按顺序把已提交的日志应用到状态机
+func (n *Node) applier() {
+	defer n.wg.Done()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.closed && !n.restoreSnap && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			return
+		}
+		if n.restoreSnap {
+			n.restore()
+			continue
+		}
+		entries := append([]Entry(nil), n.log[n.lastApplied+1-n.log[0].Index:n.commitIndex+1-n.log[0].Index]...)
+		n.mu.Unlock()
+		for _, e := range entries {
+			var err error
+			if e.Data != nil {
+				err = n.fsm.Apply(e.Data)
+			}
+			n.mu.Lock()
+			n.lastApplied = e.Index
+			if p, ok := n.proposals[e.Index]; ok {
+				delete(n.proposals, e.Index)
+				if p.term != e.Term {
+					err = ErrProposalDropped
+				}
+				p.ch <- err
+			}
+			n.mu.Unlock()
+		}
+		n.mu.Lock()
+		n.maybeCompact()
+	}
+}
+
+// restore 用leader的快照恢复状态机, 调用时持有锁
+func (n *Node) restore() {
+	idx := n.log[0].Index
+	n.restoreSnap = false
+	// 在锁内打开, 恢复期间快照文件被替换也不影响读取
+	f, err := os.Open(n.snapshot)
+	if err == nil {
+		n.mu.Unlock()
+		err = n.fsm.Restore(f)
+		f.Close()
+		n.mu.Lock()
+	}
+	if err != nil {
+		panic(errors.Wrap(err, "raft: restore snapshot"))
+	}
+	if idx > n.lastApplied {
+		n.lastApplied = idx
+	}
+	// 被快照跳过的写入无法确定结果
+	for i, p := range n.proposals {
+		if i <= idx {
+			p.ch <- ErrProposalDropped
+			delete(n.proposals, i)
+		}
+	}
+}
+
+// maybeCompact 已应用的日志足够多时生成快照并截断日志, 调用时持有锁
+func (n *Node) maybeCompact() {
+	if n.cfg.SnapshotThreshold == 0 || n.restoreSnap || n.lastApplied-n.log[0].Index < n.cfg.SnapshotThreshold {
+		return
+	}
+	idx := n.lastApplied
+	n.mu.Unlock()
+	// 只有应用goroutine会修改状态机, 此时状态机恰好处于idx
+	path, err := n.writeSnapshot(n.fsm.Snapshot)
+	n.mu.Lock()
+	if err != nil {
+		panic(errors.Wrap(err, "raft: snapshot state machine"))
+	}
+	if idx <= n.log[0].Index || idx > n.lastIndex() {
+		os.Remove(path)
+		return
+	}
+	base := Entry{Index: idx, Term: n.entry(idx).Term}
+	n.log = append([]Entry{base}, n.log[idx-n.log[0].Index+1:]...)
+	n.setSnapshot(path)
+}
+
+// writeSnapshot 将fn写出的快照保存到SnapshotDir下的新文件中, 返回文件路径
+func (n *Node) writeSnapshot(fn func(w io.Writer) error) (string, error) {
+	f, err := ioutil.TempFile(n.cfg.SnapshotDir, "raft-"+n.cfg.ID+"-*.snap")
+	if err != nil {
+		return "", err
+	}
+	if err = fn(f); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// setSnapshot 替换当前的快照文件, 调用时持有锁
+func (n *Node) setSnapshot(path string) {
+	if n.snapshot != "" {
+		os.Remove(n.snapshot)
+	}
+	n.snapshot = path
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv"
+	"github.com/stretchr/testify/require"
+)
+
+type cluster struct {
+	t      *testing.T
+	trans  *InmemTransport
+	stores map[string]*Store
+}
+
+func newCluster(t *testing.T, ids ...string) *cluster {
+	c := &cluster{t: t, trans: NewInmemTransport(), stores: make(map[string]*Store)}
+	for _, id := range ids {
+		cfg := Config{
+			ID:                id,
+			Peers:             ids,
+			ElectionTimeout:   150 * time.Millisecond,
+			HeartbeatInterval: 30 * time.Millisecond,
+			SnapshotThreshold: 20,
+			SnapshotDir:       t.TempDir(),
+		}
+		opt := &corekv.Options{
+			WorkDir:            t.TempDir(),
+			SSTableMaxSz:       1 << 10,
+			MemTableSize:       1 << 10,
+			ValueLogFileSize:   1 << 20,
+			ValueLogMaxEntries: 1000,
+			MaxBatchCount:      10,
+			MaxBatchSize:       1 << 20,
+		}
+		s, err := NewStore(cfg, c.trans.For(id), opt)
+		require.NoError(t, err)
+		c.trans.Register(id, s.Node)
+		c.stores[id] = s
+	}
+	return c
+}
+
+func (c *cluster) close() {
+	for _, s := range c.stores {
+		require.NoError(c.t, s.Close())
+	}
+}
+
+// leader 等待除了excluded之外的节点选出唯一的leader
+func (c *cluster) leader(excluded string) *Store {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Store
+		for id, s := range c.stores {
+			if id != excluded && s.Status().State == Leader {
+				leaders = append(leaders, s)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+// write 向leader写入key[from, to), 遇到leader切换时重试, 每个key最多重试5秒
+func (c *cluster) write(excluded string, from, to int, value string) {
+	for i := from; i < to; i++ {
+		wb := corekv.NewWriteBatch()
+		wb.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(value))
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			err := c.leader(excluded).Write(ctx, wb)
+			cancel()
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.t.Fatalf("write key%03d: %v", i, err)
+			}
+		}
+	}
+}
+
+// waitApplied 等待节点的数据与预期一致
+func (c *cluster) waitApplied(s *Store, n int, value string) {
+	require.Eventually(c.t, func() bool {
+		for i := 0; i < n; i++ {
+			e, err := s.Get([]byte(fmt.Sprintf("key%03d", i)))
+			if err != nil || string(e.Value) != value {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestRaftReplication(t *testing.T) {
+	c := newCluster(t, "n1", "n2", "n3")
+	defer c.close()
+
+	c.write("", 0, 10, "v1")
+	for _, s := range c.stores {
+		c.waitApplied(s, 10, "v1")
+	}
+
+	// 删除同样通过日志复制
+	wb := corekv.NewWriteBatch()
+	wb.Delete([]byte("key000"))
+	require.NoError(t, c.leader("").Write(context.Background(), wb))
+	for _, s := range c.stores {
+		require.Eventually(t, func() bool {
+			_, err := s.Get([]byte("key000"))
+			return err != nil
+		}, 5*time.Second, 20*time.Millisecond)
+	}
+
+	// 非leader拒绝写入
+	for _, s := range c.stores {
+		if s.Status().State != Leader {
+			require.Equal(t, ErrNotLeader, s.Write(context.Background(), wb))
+			break
+		}
+	}
+}
+
+func TestRaftSnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, "n1", "n2", "n3")
+	defer c.close()
+
+	leader := c.leader("")
+	var follower *Store
+	for _, s := range c.stores {
+		if s != leader {
+			follower = s
+			break
+		}
+	}
+	// 断开的follower错过的日志在leader上被快照截断, 重连后只能通过快照追上
+	c.trans.Disconnect(follower.Status().ID)
+	c.write(follower.Status().ID, 0, 50, "v1")
+	require.Greater(t, leader.Status().SnapshotIndex, follower.Status().LastIndex)
+
+	c.trans.Connect(follower.Status().ID)
+	c.waitApplied(follower, 50, "v1")
+	require.Greater(t, follower.Status().SnapshotIndex, uint64(0))
+	// 快照保存在文件中, 只保留最新的一个
+	snaps, err := filepath.Glob(filepath.Join(leader.cfg.SnapshotDir, "*.snap"))
+	require.NoError(t, err)
+	require.Len(t, snaps, 1)
+
+	// 快照之后的日志正常复制
+	c.write("", 50, 60, "v2")
+	for _, s := range c.stores {
+		c.waitApplied(s, 50, "v1")
+	}
+	for i := 50; i < 60; i++ {
+		e, err := follower.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, "v2", string(e.Value))
+	}
+}
+
+func TestRaftLeaderFailover(t *testing.T) {
+	c := newCluster(t, "n1", "n2", "n3")
+	defer c.close()
+
+	c.write("", 0, 5, "v1")
+	old := c.leader("")
+	oldID, oldTerm := old.Status().ID, old.Status().Term
+	c.trans.Disconnect(oldID)
+
+	// 剩下的两个节点在更高的任期选出新的leader并继续提交
+	leader := c.leader(oldID)
+	require.Greater(t, leader.Status().Term, oldTerm)
+	c.write(oldID, 0, 5, "v2")
+
+	// 旧leader恢复后成为follower并应用新的数据
+	c.trans.Connect(oldID)
+	c.waitApplied(old, 5, "v2")
+	require.Eventually(t, func() bool {
+		return old.Status().State == Follower
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+// TestNewKVNonEmptyDir raft日志不落盘, 不能在已有数据的目录上启动状态机
+func TestNewKVNonEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "MANIFEST"), []byte("x"), 0666))
+	_, err := NewKV(&corekv.Options{WorkDir: dir})
+	require.Error(t, err)
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raft
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Entry raft日志中的一项, Data为空的是leader上任时追加的空日志
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+// RequestVoteRequest _
+type RequestVoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+// RequestVoteResponse _
+type RequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// AppendEntriesRequest _
+type AppendEntriesRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// AppendEntriesResponse 失败时ConflictIndex为leader下一次尝试的位置
+type AppendEntriesResponse struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+// InstallSnapshotRequest 快照以流的形式发送, 接收方在返回之前读完Data
+type InstallSnapshotRequest struct {
+	Term              uint64
+	Leader            string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Data              io.Reader
+}
+
+// InstallSnapshotResponse _
+type InstallSnapshotResponse struct {
+	Term uint64
+}
+
+// Handler 处理来自其他节点的rpc, 由Node实现
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) (*RequestVoteResponse, error)
+	HandleAppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	HandleInstallSnapshot(req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Transport 向target节点发送rpc
+type Transport interface {
+	RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// ErrUnreachable 目标节点不存在或者被断开
+var ErrUnreachable = errors.New("raft: node unreachable")
+
+// InmemTransport 进程内的transport, 所有节点共享一个实例, 用于测试
+// 可以断开某个节点来模拟网络分区
+type InmemTransport struct {
+	sync.RWMutex
+	handlers     map[string]Handler
+	disconnected map[string]bool
+}
+
+// NewInmemTransport _
+func NewInmemTransport() *InmemTransport {
+	return &InmemTransport{
+		handlers:     make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Register 注册节点, 之后发往id的rpc由h处理
+func (t *InmemTransport) Register(id string, h Handler) {
+	t.Lock()
+	defer t.Unlock()
+	t.handlers[id] = h
+}
+
+// Disconnect 断开节点, 该节点发出和收到的rpc都会失败
+func (t *InmemTransport) Disconnect(id string) {
+	t.Lock()
+	defer t.Unlock()
+	t.disconnected[id] = true
+}
+
+// Connect 恢复被断开的节点
+func (t *InmemTransport) Connect(id string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.disconnected, id)
+}
+
+// For 返回以id的身份发送rpc的Transport
+func (t *InmemTransport) For(id string) Transport {
+	return &inmemSender{t: t, from: id}
+}
+
+func (t *InmemTransport) route(from, to string) (Handler, error) {
+	t.RLock()
+	defer t.RUnlock()
+	h, ok := t.handlers[to]
+	if !ok || t.disconnected[from] || t.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return h, nil
+}
+
+type inmemSender struct {
+	t    *InmemTransport
+	from string
+}
+
+func (s *inmemSender) RequestVote(target string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	h, err := s.t.route(s.from, target)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleRequestVote(req)
+}
+
+func (s *inmemSender) AppendEntries(target string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	h, err := s.t.route(s.from, target)
+	if err != nil {
+		return nil, err
+	}
+	// 接收方不能与发送方共享日志数据
+	cp := *req
+	cp.Entries = append([]Entry(nil), req.Entries...)
+	return h.HandleAppendEntries(&cp)
+}
+
+func (s *inmemSender) InstallSnapshot(target string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	h, err := s.t.route(s.from, target)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleInstallSnapshot(req)
+}
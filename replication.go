@@ -0,0 +1,392 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+// 复制协议:
+// follower 连上leader后先发送握手 | epoch(8B) | seq(8B) |, 表示已经应用到leader epoch的第seq个批次
+// leader 随后持续发送帧 | kind(1B) | seq(8B) | len(4B) | pb.KVList |
+// follower 的进度与批次数据在同一次写入中持久化到replStateKey, 断线重连后从该进度继续
+const (
+	replHello        byte = iota + 1 // 第一帧, seq字段为leader的epoch
+	replSnapshot                     // 全量数据的一部分, follower的进度无法继续时发送
+	replSnapshotDone                 // 全量数据结束, seq为快照对应的批次号
+	replBatch                        // 一个提交批次
+)
+
+var replStateKey = []byte("!corekv!repl")
+
+type replEntry struct {
+	seq uint64
+	kvs []*pb.KV
+}
+
+// replLog leader的提交日志, 每个写入批次分配一个递增的序号
+type replLog struct {
+	sync.Mutex
+	epoch     uint64 // 每次Open都不同, follower据此判断序号是否还有意义
+	seq       uint64
+	entries   []replEntry
+	notify    chan struct{} // 有新的批次时关闭并替换
+	capacity  int           // 内存中保留的最近批次数, 落后更多的follower需要重新拉取快照
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newReplLog(capacity int) *replLog {
+	return &replLog{
+		epoch:    uint64(time.Now().UnixNano()),
+		notify:   make(chan struct{}),
+		capacity: capacity,
+		closed:   make(chan struct{}),
+	}
+}
+
+// enabled 配置了ReplicationLogSize才会记录批次, 从Open开始记录保证快照与批次之间没有遗漏
+func (l *replLog) enabled() bool {
+	return l.capacity > 0
+}
+
+func (l *replLog) append(kvs []*pb.KV) {
+	if !l.enabled() {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.seq++
+	l.entries = append(l.entries, replEntry{seq: l.seq, kvs: kvs})
+	if n := len(l.entries); n > l.capacity {
+		l.entries = append([]replEntry(nil), l.entries[n-l.capacity:]...)
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// canResume 判断从seq之后继续是否还能拿到完整的批次
+func (l *replLog) canResume(seq uint64) bool {
+	l.Lock()
+	defer l.Unlock()
+	if seq > l.seq {
+		return false
+	}
+	return seq == l.seq || (len(l.entries) > 0 && seq+1 >= l.entries[0].seq)
+}
+
+// after 返回序号大于seq的批次; 没有新批次时返回用于等待的channel
+func (l *replLog) after(seq uint64) ([]replEntry, <-chan struct{}, error) {
+	l.Lock()
+	defer l.Unlock()
+	if seq == l.seq {
+		return nil, l.notify, nil
+	}
+	if seq > l.seq || len(l.entries) == 0 || seq+1 < l.entries[0].seq {
+		return nil, nil, errors.Errorf("replication log no longer holds batch %d", seq+1)
+	}
+	idx := int(seq + 1 - l.entries[0].seq)
+	return append([]replEntry(nil), l.entries[idx:]...), nil, nil
+}
+
+func (l *replLog) lastSeq() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.seq
+}
+
+func (l *replLog) close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// ServeReplica 作为leader向conn上的follower持续发送提交的写入, 直到出错、ctx结束或DB关闭
+// 需要配置Options.ReplicationLogSize; conn实现了io.Closer时, ctx结束会关闭conn
+func (db *DB) ServeReplica(ctx context.Context, conn io.ReadWriter) error {
+	if !db.repl.enabled() {
+		return errors.New("replication is disabled, set Options.ReplicationLogSize")
+	}
+	defer closeOnDone(ctx, conn)()
+
+	var hs [16]byte
+	if _, err := io.ReadFull(conn, hs[:]); err != nil {
+		return replErr(ctx, err)
+	}
+	epoch, seq := binary.BigEndian.Uint64(hs[:8]), binary.BigEndian.Uint64(hs[8:])
+	w := bufio.NewWriter(conn)
+	if err := writeReplFrame(w, replHello, db.repl.epoch, nil); err != nil {
+		return replErr(ctx, err)
+	}
+	if epoch != db.repl.epoch || !db.repl.canResume(seq) {
+		var err error
+		if seq, err = db.sendSnapshot(w); err != nil {
+			return replErr(ctx, err)
+		}
+	}
+	for {
+		entries, notify, err := db.repl.after(seq)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := writeReplFrame(w, replBatch, e.seq, &pb.KVList{Kv: e.kvs}); err != nil {
+				return replErr(ctx, err)
+			}
+			seq = e.seq
+		}
+		if err := w.Flush(); err != nil {
+			return replErr(ctx, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-db.repl.closed:
+			return nil
+		}
+	}
+}
+
+// sendSnapshot 发送全量数据, 返回快照对应的批次号
+// 快照开始之后提交的批次可能已经包含在快照中, 重复应用是幂等的
+func (db *DB) sendSnapshot(w *bufio.Writer) (uint64, error) {
+	seq := db.repl.lastSeq()
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	list := &pb.KVList{}
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item == nil {
+			continue
+		}
+		list.Kv = append(list.Kv, entryToKV(item.Entry()))
+		if len(list.Kv) >= backupBatchSize {
+			if err := writeReplFrame(w, replSnapshot, seq, list); err != nil {
+				return 0, err
+			}
+			list.Kv = list.Kv[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if len(list.Kv) > 0 {
+		if err := writeReplFrame(w, replSnapshot, seq, list); err != nil {
+			return 0, err
+		}
+	}
+	return seq, writeReplFrame(w, replSnapshotDone, seq, nil)
+}
+
+// Follow 作为follower从conn读取leader的写入并通过自身的写入路径应用, 直到出错、ctx结束或连接断开
+// 调用之后DB进入只读模式, 客户端写入返回ErrReplicaReadOnly, 直到调用Promote
+// 断线后再次调用Follow会从持久化的进度继续
+func (db *DB) Follow(ctx context.Context, conn io.ReadWriter) error {
+	atomic.StoreInt32(&db.replica, 1)
+	defer closeOnDone(ctx, conn)()
+
+	epoch, applied, err := db.ReplicationState()
+	if err != nil {
+		return err
+	}
+	var hs [16]byte
+	binary.BigEndian.PutUint64(hs[:8], epoch)
+	binary.BigEndian.PutUint64(hs[8:], applied)
+	if _, err := conn.Write(hs[:]); err != nil {
+		return replErr(ctx, err)
+	}
+
+	r := bufio.NewReader(conn)
+	kind, leaderEpoch, _, err := readReplFrame(r)
+	if err != nil {
+		return replErr(ctx, err)
+	}
+	if kind != replHello {
+		return errors.Errorf("unexpected replication frame %d, want hello", kind)
+	}
+	// leader只在握手之后发送快照, 快照中的key写入时分配更大的版本
+	// 快照结束后版本不大于snapshotTs的本地key都不在快照中, 需要删除
+	snapshotTs := atomic.LoadUint64(&db.version)
+	for {
+		kind, seq, list, err := readReplFrame(r)
+		if err != nil {
+			return replErr(ctx, err)
+		}
+		switch kind {
+		case replSnapshot:
+			entries := make([]*utils.Entry, 0, len(list.Kv))
+			for _, kv := range list.Kv {
+				entries = append(entries, kvToEntry(kv))
+			}
+			if err := db.writeEntries(entries); err != nil {
+				return err
+			}
+		case replSnapshotDone:
+			if err := db.dropBefore(snapshotTs); err != nil {
+				return err
+			}
+			if err := db.writeEntries([]*utils.Entry{replStateEntry(leaderEpoch, seq)}); err != nil {
+				return err
+			}
+			applied = seq
+		case replBatch:
+			if seq != applied+1 {
+				return errors.Errorf("replication gap: expect batch %d, got %d", applied+1, seq)
+			}
+			entries := make([]*utils.Entry, 0, len(list.Kv)+1)
+			for _, kv := range list.Kv {
+				entries = append(entries, kvToEntry(kv))
+			}
+			// 进度放在最后一批中, 中途失败时重放整个批次是幂等的
+			entries = append(entries, replStateEntry(leaderEpoch, seq))
+			if err := db.writeEntries(entries); err != nil {
+				return err
+			}
+			applied = seq
+		default:
+			return errors.Errorf("unexpected replication frame %d", kind)
+		}
+	}
+}
+
+// Promote 退出follower模式, 重新接受客户端写入
+func (db *DB) Promote() {
+	atomic.StoreInt32(&db.replica, 0)
+}
+
+func (db *DB) isReplica() bool {
+	return atomic.LoadInt32(&db.replica) == 1
+}
+
+// ReplicationState 返回follower持久化的复制进度: leader的epoch与已经应用的批次号
+func (db *DB) ReplicationState() (epoch, seq uint64, err error) {
+	e, err := db.Get(replStateKey)
+	if err == utils.ErrKeyNotFound {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(e.Value) != 16 {
+		return 0, 0, errors.Errorf("invalid replication state of %d bytes", len(e.Value))
+	}
+	return binary.BigEndian.Uint64(e.Value[:8]), binary.BigEndian.Uint64(e.Value[8:]), nil
+}
+
+func replStateEntry(epoch, seq uint64) *utils.Entry {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], epoch)
+	binary.BigEndian.PutUint64(buf[8:], seq)
+	return utils.NewEntry(utils.KeyWithTs(replStateKey, 0), buf)
+}
+
+// dropBefore 删除最新版本不大于readTs的本地key, 即快照中不存在的key
+func (db *DB) dropBefore(readTs uint64) error {
+	var tombstones []*utils.Entry
+	iter := db.NewIterator(&utils.Options{IsAsc: true})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		e := iter.Item().Entry()
+		if e.Version > readTs {
+			continue
+		}
+		tombstones = append(tombstones, &utils.Entry{Key: utils.KeyWithTs(utils.SafeCopy(nil, utils.ParseKey(e.Key)), 0), Meta: utils.BitDelete})
+		if len(tombstones) >= backupBatchSize {
+			if err := db.writeEntries(tombstones); err != nil {
+				return err
+			}
+			tombstones = nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return db.writeEntries(tombstones)
+}
+
+func writeReplFrame(w io.Writer, kind byte, seq uint64, list *pb.KVList) error {
+	var hdr [9]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint64(hdr[1:], seq)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if list == nil {
+		list = &pb.KVList{}
+	}
+	buf, err := list.Marshal()
+	if err != nil {
+		return err
+	}
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(buf)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func readReplFrame(r io.Reader) (byte, uint64, *pb.KVList, error) {
+	var hdr [9]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	list, err := readKVList(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return hdr[0], binary.BigEndian.Uint64(hdr[1:]), list, nil
+}
+
+// closeOnDone ctx结束时关闭conn, 让阻塞在读写上的调用返回
+func closeOnDone(ctx context.Context, conn io.ReadWriter) (stop func()) {
+	c, ok := conn.(io.Closer)
+	if !ok {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// replErr ctx结束导致的连接错误统一返回ctx的错误
+func replErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	clearDir()
+	lopt := *opt
+	lopt.ValueLogMaxEntries = 1000
+	lopt.ReplicationLogSize = 100
+	leader := Open(&lopt)
+	defer leader.Close()
+
+	fopt := lopt
+	fopt.ReplicationLogSize = 0
+	fopt.WorkDir = t.TempDir()
+	follower := Open(&fopt)
+	defer follower.Close()
+
+	set := func(i int, value string) {
+		require.NoError(t, leader.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte(value))))
+	}
+	// 连接之前的数据通过快照同步, follower上多余的key会被删除
+	for i := 0; i < 20; i++ {
+		set(i, "old")
+	}
+	require.NoError(t, follower.Set(utils.NewEntry([]byte("stale"), []byte("x"))))
+	// 快照中存在的key以快照中的值为准, 不会因为本地有旧版本而被删除
+	require.NoError(t, follower.Set(utils.NewEntry([]byte("key001"), []byte("x"))))
+
+	connect := func() (context.CancelFunc, chan error, chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		lc, fc := net.Pipe()
+		lerr, ferr := make(chan error, 1), make(chan error, 1)
+		go func() { lerr <- leader.ServeReplica(ctx, lc) }()
+		go func() { ferr <- follower.Follow(ctx, fc) }()
+		return cancel, lerr, ferr
+	}
+	waitFor := func(key, value string) {
+		require.Eventually(t, func() bool {
+			e, err := follower.Get([]byte(key))
+			if value == "" {
+				return err == utils.ErrKeyNotFound
+			}
+			return err == nil && string(e.Value) == value
+		}, 5*time.Second, 10*time.Millisecond, "key %s", key)
+	}
+
+	cancel, lerr, ferr := connect()
+	for i := 10; i < 30; i++ {
+		set(i, "new")
+	}
+	require.NoError(t, leader.Del([]byte("key000")))
+	waitFor("key000", "")
+	waitFor("key005", "old")
+	waitFor("key029", "new")
+	waitFor("stale", "")
+	waitFor("key001", "old")
+	// follower 拒绝客户端写入
+	require.Equal(t, utils.ErrReplicaReadOnly, follower.Set(utils.NewEntry([]byte("a"), []byte("b"))))
+
+	// 断线期间leader继续写入, 重连后从持久化的进度继续
+	cancel()
+	require.Equal(t, context.Canceled, <-lerr)
+	require.Equal(t, context.Canceled, <-ferr)
+	epoch, seq, err := follower.ReplicationState()
+	require.NoError(t, err)
+	require.Equal(t, leader.repl.epoch, epoch)
+	require.Equal(t, leader.repl.lastSeq(), seq)
+	for i := 30; i < 40; i++ {
+		set(i, "after")
+	}
+
+	cancel, lerr, ferr = connect()
+	defer cancel()
+	waitFor("key039", "after")
+	waitFor("key010", "new")
+	_, seq, err = follower.ReplicationState()
+	require.NoError(t, err)
+	require.Equal(t, leader.repl.lastSeq(), seq)
+
+	follower.Promote()
+	require.NoError(t, follower.Set(utils.NewEntry([]byte("a"), []byte("b"))))
+}
+
+// TestReplicationLogOrder 并发的Set与Write提交到复制日志的顺序与写入lsm的顺序一致
+func TestReplicationLogOrder(t *testing.T) {
+	clearDir()
+	lopt := *opt
+	lopt.ReplicationLogSize = 10000
+	db := Open(&lopt)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				value := []byte(fmt.Sprintf("%d-%d", g, i))
+				if g%2 == 0 {
+					require.NoError(t, db.Set(utils.NewEntry([]byte("key"), value)))
+					continue
+				}
+				wb := NewWriteBatch()
+				wb.Set([]byte("key"), value)
+				require.NoError(t, db.Write(wb))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	entries, _, err := db.repl.after(0)
+	require.NoError(t, err)
+	require.Len(t, entries, 200)
+	var last []byte
+	for _, e := range entries {
+		for _, kv := range e.kvs {
+			last = kv.Value
+		}
+	}
+	got, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, string(got.Value), string(last))
+}
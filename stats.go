@@ -14,34 +14,139 @@
 
 package corekv
 
-import "github.com/hardcore-os/corekv/utils"
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
 
+	"github.com/hardcore-os/corekv/utils"
+)
+
+// Stats DB.Info返回的统计信息快照
 type Stats struct {
-	closer   *utils.Closer
-	EntryNum int64 // 存储多少个kv数据
+	EntryNum int64 // 各sst索引中记录的key数量之和, 包含旧版本与墓碑, 不含内存表中的数据
+
+	Levels         []LevelStats
+	MemTableSize   int64 // 活跃内存表已写入wal的字节数
+	NumImmutables  int
+	ImmutablesSize int64
+	VlogSize       int64
+	VlogDiscard    int64 // vlog中可以被gc回收的字节数
+
+	// 用户操作, 字节数按用户key与value的长度计算
+	NumGets      int64
+	NumSets      int64
+	NumDeletes   int64
+	BytesRead    int64
+	BytesWritten int64
+
+	WalBytesWritten        int64
+	VlogBytesWritten       int64
+	NumFlushes             int64
+	FlushDuration          time.Duration
+	FlushBytesWritten      int64
+	NumCompactions         int64
+	CompactionDuration     time.Duration
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	// WriteAmp 写入wal、vlog、flush与压缩的字节数之和与用户写入字节数的比值
+	WriteAmp float64
+}
+
+// LevelStats 单层的统计
+type LevelStats struct {
+	Level     int
+	NumTables int
+	Size      int64
+	StaleSize int64
+	KeyCount  int64
+}
+
+// stats 在读写路径上原子更新的计数器
+type stats struct {
+	numGets      int64
+	numSets      int64
+	numDeletes   int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+func newStats(opt *Options) *stats {
+	return &stats{}
+}
+
+func (s *stats) recordGet(key []byte, e *utils.Entry) {
+	atomic.AddInt64(&s.numGets, 1)
+	if e != nil {
+		atomic.AddInt64(&s.bytesRead, int64(len(key)+len(e.Value)))
+	}
 }
 
-// Close
-func (s *Stats) close() error {
-	return nil
+// writeCounts 一批写入的统计
+type writeCounts struct {
+	sets, dels, size int64
 }
 
-// StartStats
-func (s *Stats) StartStats() {
-	defer s.closer.Done()
-	for {
-		select {
-		case <-s.closer.CloseSignal:
-			return
+// countWrites 在value被替换为值指针之前调用, entry的key为内部key
+func countWrites(entries []*utils.Entry) writeCounts {
+	var c writeCounts
+	for _, e := range entries {
+		if bytes.HasPrefix(e.Key, corekvPrefix) {
+			continue
+		}
+		if e.IsTombstone() {
+			c.dels++
+		} else {
+			c.sets++
 		}
-		// stats logic...
+		c.size += int64(len(utils.ParseKey(e.Key)) + len(e.Value))
 	}
+	return c
 }
 
-// NewStats
-func newStats(opt *Options) *Stats {
-	s := &Stats{}
-	s.closer = utils.NewCloser()
-	s.EntryNum = 1 // 这里直接写
-	return s
+// recordWrites 写入lsm成功之后调用, 失败的写入不计入统计
+func (s *stats) recordWrites(c writeCounts) {
+	atomic.AddInt64(&s.numSets, c.sets)
+	atomic.AddInt64(&s.numDeletes, c.dels)
+	atomic.AddInt64(&s.bytesWritten, c.size)
+}
+
+// Info 返回当前的统计信息
+func (db *DB) Info() *Stats {
+	st := &Stats{
+		NumGets:          atomic.LoadInt64(&db.stats.numGets),
+		NumSets:          atomic.LoadInt64(&db.stats.numSets),
+		NumDeletes:       atomic.LoadInt64(&db.stats.numDeletes),
+		BytesRead:        atomic.LoadInt64(&db.stats.bytesRead),
+		BytesWritten:     atomic.LoadInt64(&db.stats.bytesWritten),
+		VlogBytesWritten: atomic.LoadInt64(&db.vlog.bytesWritten),
+	}
+	for _, l := range db.lsm.LevelsInfo() {
+		ls := LevelStats{Level: l.Level, NumTables: l.NumTables, Size: l.Size, StaleSize: l.StaleSize}
+		for _, t := range l.Tables {
+			ls.KeyCount += int64(t.KeyCount)
+		}
+		st.EntryNum += ls.KeyCount
+		st.Levels = append(st.Levels, ls)
+	}
+	st.MemTableSize, st.NumImmutables, st.ImmutablesSize = db.lsm.MemTablesInfo()
+	for _, f := range db.VlogFiles() {
+		st.VlogSize += f.Size
+		st.VlogDiscard += f.Discard
+	}
+
+	m := db.lsm.Metrics()
+	st.WalBytesWritten = m.WalBytesWritten
+	st.NumFlushes = m.NumFlushes
+	st.FlushDuration = m.FlushDuration
+	st.FlushBytesWritten = m.FlushBytesWritten
+	st.NumCompactions = m.NumCompactions
+	st.CompactionDuration = m.CompactionDuration
+	st.CompactionBytesRead = m.CompactionBytesRead
+	st.CompactionBytesWritten = m.CompactionBytesWritten
+	if st.BytesWritten > 0 {
+		physical := st.WalBytesWritten + st.VlogBytesWritten + st.FlushBytesWritten + st.CompactionBytesWritten
+		st.WriteAmp = float64(physical) / float64(st.BytesWritten)
+	}
+	return st
 }
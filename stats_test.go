@@ -0,0 +1,61 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfo(t *testing.T) {
+	clearDir()
+	sopt := *opt
+	sopt.ValueLogMaxEntries = 1000
+	db := Open(&sopt)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Set(utils.NewEntry([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))))
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Del([]byte(fmt.Sprintf("key%03d", i))))
+	}
+	for i := 0; i < 20; i++ {
+		_, _ = db.Get([]byte(fmt.Sprintf("key%03d", i)))
+	}
+
+	st := db.Info()
+	require.EqualValues(t, 100, st.NumSets)
+	require.EqualValues(t, 10, st.NumDeletes)
+	require.EqualValues(t, 20, st.NumGets)
+	// 前10个key已删除, 只有10次命中计入读取字节
+	require.EqualValues(t, 10*len("key000value"), st.BytesRead)
+	require.EqualValues(t, 100*len("key000value")+10*len("key000"), st.BytesWritten)
+	require.NotZero(t, st.WalBytesWritten)
+	require.NotZero(t, st.VlogBytesWritten)
+	require.NotZero(t, st.VlogSize)
+
+	require.NoError(t, db.Flush())
+	st = db.Info()
+	require.NotZero(t, st.NumFlushes)
+	require.NotZero(t, st.FlushBytesWritten)
+	require.NotEmpty(t, st.Levels)
+	require.NotZero(t, st.Levels[0].NumTables)
+	require.EqualValues(t, 110, st.EntryNum)
+	require.Greater(t, st.WriteAmp, 1.0)
+}
@@ -0,0 +1,226 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package corekv
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamBatchSize 每次调用Send时KVList的目标大小
+	streamBatchSize = 4 << 20
+	defaultStreamGo = 8
+)
+
+// Stream 以sst的边界将key空间切分成多段, 由多个goroutine各自持有迭代器并发扫描
+// 扫描结果经KeyToList转换后合并成批, 由单个goroutine串行调用Send
+type Stream struct {
+	// Prefix 只扫描带有该前缀的key
+	Prefix []byte
+	// NumGo 并发扫描的goroutine数量
+	NumGo int
+	// ChooseKey 返回false的key会被跳过, 为nil时选择全部key
+	ChooseKey func(e *utils.Entry) bool
+	// KeyToList 将迭代器当前所在的key转换为KVList, 不能移动迭代器; 返回nil表示跳过该key
+	// 为nil时使用ToList
+	KeyToList func(key []byte, itr utils.Iterator) (*pb.KVList, error)
+	// Send 接收合并后的批次, 每个KV都带有产生它的stream_id; 同一时刻只会有一个Send在执行
+	Send func(list *pb.KVList) error
+
+	db           *DB
+	nextStreamID uint32
+}
+
+// NewStream 创建一个全库扫描的Stream
+func (db *DB) NewStream() *Stream {
+	return &Stream{db: db, NumGo: defaultStreamGo}
+}
+
+// ToList 默认的KeyToList, 将迭代器当前的entry转换为一个KV
+func (st *Stream) ToList(key []byte, itr utils.Iterator) (*pb.KVList, error) {
+	return &pb.KVList{Kv: []*pb.KV{entryToKV(itr.Item().Entry())}}, nil
+}
+
+type streamRange struct {
+	start, end []byte // [start, end), end为nil表示没有上界
+}
+
+// ranges 以sst的最小key作为分割点切分key空间
+func (st *Stream) ranges() []streamRange {
+	var ranges []streamRange
+	start := st.Prefix
+	for _, split := range st.db.lsm.KeySplits(st.Prefix) {
+		if bytes.Compare(split, start) <= 0 {
+			continue
+		}
+		ranges = append(ranges, streamRange{start: start, end: split})
+		start = split
+	}
+	return append(ranges, streamRange{start: start})
+}
+
+// Orchestrate 执行扫描, 直到全部数据发送完成、出错或ctx被取消
+func (st *Stream) Orchestrate(ctx context.Context) error {
+	if st.Send == nil {
+		return errors.New("Stream.Send must be set")
+	}
+	if st.KeyToList == nil {
+		st.KeyToList = st.ToList
+	}
+	numGo := st.NumGo
+	if numGo <= 0 {
+		numGo = defaultStreamGo
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// 所有范围读取同一个版本, 扫描期间的写入不会只出现在后扫描的范围中
+	readTs := atomic.LoadUint64(&st.db.version)
+	ranges := st.ranges()
+	rangeCh := make(chan streamRange, len(ranges))
+	for _, kr := range ranges {
+		rangeCh <- kr
+	}
+	close(rangeCh)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	setErr := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	kvCh := make(chan *pb.KVList, numGo)
+	for i := 0; i < numGo; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for kr := range rangeCh {
+				if err := st.produce(ctx, kr, readTs, kvCh); err != nil {
+					setErr(err)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(kvCh)
+	}()
+
+	if err := st.streamKVs(kvCh); err != nil {
+		setErr(err)
+		// 让生产者退出
+		for range kvCh {
+		}
+	}
+	if firstErr == nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// produce 扫描一段key范围中版本不大于readTs的数据, 按批放入kvCh
+func (st *Stream) produce(ctx context.Context, kr streamRange, readTs uint64, kvCh chan<- *pb.KVList) error {
+	streamID := atomic.AddUint32(&st.nextStreamID, 1)
+	itr := st.db.newPrefixIterator(st.Prefix, kr.start, readTs)
+	defer itr.Close()
+
+	batch := &pb.KVList{}
+	var size int
+	send := func() error {
+		if len(batch.Kv) == 0 {
+			return nil
+		}
+		select {
+		case kvCh <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		batch, size = &pb.KVList{}, 0
+		return nil
+	}
+	for itr.Rewind(); itr.Valid(); itr.Next() {
+		e := itr.Item().Entry()
+		key := utils.ParseKey(e.Key)
+		if kr.end != nil && bytes.Compare(key, kr.end) >= 0 {
+			break
+		}
+		if st.ChooseKey != nil && !st.ChooseKey(e) {
+			continue
+		}
+		list, err := st.KeyToList(key, itr)
+		if err != nil {
+			return err
+		}
+		if list == nil {
+			continue
+		}
+		for _, kv := range list.Kv {
+			kv.StreamId = streamID
+			size += kv.Size()
+			batch.Kv = append(batch.Kv, kv)
+		}
+		if size >= streamBatchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := itr.Err(); err != nil {
+		return err
+	}
+	return send()
+}
+
+// streamKVs 合并各个goroutine产生的批次, 串行调用Send
+func (st *Stream) streamKVs(kvCh <-chan *pb.KVList) error {
+	batch := &pb.KVList{}
+	var size int
+	for list := range kvCh {
+		batch.Kv = append(batch.Kv, list.Kv...)
+		size += list.Size()
+		// 尽量把已经就绪的批次合并在一起发送
+	merge:
+		for size < streamBatchSize {
+			select {
+			case next, ok := <-kvCh:
+				if !ok {
+					break merge
+				}
+				batch.Kv = append(batch.Kv, next.Kv...)
+				size += next.Size()
+			default:
+				break merge
+			}
+		}
+		if err := st.Send(batch); err != nil {
+			return err
+		}
+		batch, size = &pb.KVList{}, 0
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package corekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hardcore-os/corekv/pb"
+	"github.com/hardcore-os/corekv/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	clearDir()
+	sopt := *opt
+	sopt.ValueLogMaxEntries = 1000
+	db := Open(&sopt)
+	defer db.Close()
+	n := 500
+	for i := 0; i < n; i++ {
+		prefix := "a"
+		if i%2 == 1 {
+			prefix = "b"
+		}
+		key := fmt.Sprintf("%s%04d", prefix, i)
+		require.NoError(t, db.Set(utils.NewEntry([]byte(key), []byte("value"+key))))
+	}
+	require.NoError(t, db.Del([]byte("a0000")))
+	// 数据分布在多个sst中, key空间能被切成多段
+	require.Greater(t, len(db.lsm.KeySplits(nil)), 1)
+
+	run := func(prefix string) (map[string]string, map[uint32]bool) {
+		kvs := make(map[string]string)
+		ids := make(map[uint32]bool)
+		st := db.NewStream()
+		st.Prefix = []byte(prefix)
+		st.NumGo = 4
+		st.Send = func(list *pb.KVList) error {
+			for _, kv := range list.Kv {
+				_, dup := kvs[string(kv.Key)]
+				require.False(t, dup, "duplicate key %s", kv.Key)
+				kvs[string(kv.Key)] = string(kv.Value)
+				require.NotZero(t, kv.StreamId)
+				ids[kv.StreamId] = true
+			}
+			return nil
+		}
+		require.NoError(t, st.Orchestrate(context.Background()))
+		return kvs, ids
+	}
+
+	kvs, ids := run("")
+	require.Len(t, kvs, n-1)
+	require.Greater(t, len(ids), 1)
+	for k, v := range kvs {
+		require.Equal(t, "value"+k, v)
+	}
+	_, ok := kvs["a0000"]
+	require.False(t, ok)
+
+	kvs, _ = run("b")
+	require.Len(t, kvs, n/2)
+
+	// 扫描开始之后的写入对所有范围都不可见
+	var once sync.Once
+	st := db.NewStream()
+	st.NumGo = 1
+	st.ChooseKey = func(*utils.Entry) bool {
+		once.Do(func() { require.NoError(t, db.Set(utils.NewEntry([]byte("b9999"), []byte("late")))) })
+		return true
+	}
+	kvs = make(map[string]string)
+	st.Send = func(list *pb.KVList) error {
+		for _, kv := range list.Kv {
+			kvs[string(kv.Key)] = string(kv.Value)
+		}
+		return nil
+	}
+	require.NoError(t, st.Orchestrate(context.Background()))
+	require.Len(t, kvs, n-1)
+	_, ok = kvs["b9999"]
+	require.False(t, ok)
+
+	// Send返回的错误会终止扫描
+	st = db.NewStream()
+	errSend := errors.New("send failed")
+	st.Send = func(*pb.KVList) error { return errSend }
+	require.Equal(t, errSend, st.Orchestrate(context.Background()))
+}
@@ -16,6 +16,8 @@ type Cache struct {
 	t         int32
 	threshold int32
 	data      map[uint64]*list.Element
+	hits      uint64
+	misses    uint64
 }
 
 type Options struct {
@@ -116,9 +118,23 @@ func (c *Cache) set(key, value interface{}) bool {
 }
 
 func (c *Cache) Get(key interface{}) (interface{}, bool) {
+	// get 会更新访问频次和lru顺序, 不能只加读锁
+	c.m.Lock()
+	defer c.m.Unlock()
+	v, ok := c.get(key)
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return v, ok
+}
+
+// Metrics 返回Get命中与未命中的次数
+func (c *Cache) Metrics() (hits, misses uint64) {
 	c.m.RLock()
 	defer c.m.RUnlock()
-	return c.get(key)
+	return c.hits, c.misses
 }
 
 func (c *Cache) get(key interface{}) (interface{}, bool) {
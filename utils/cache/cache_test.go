@@ -30,6 +30,17 @@ func TestCacheBasicCRUD(t *testing.T) {
 	fmt.Printf("at last: %s\n", cache)
 }
 
+func TestCacheMetrics(t *testing.T) {
+	cache := NewCache(100)
+	cache.Set("a", 1)
+	cache.Get("a")
+	cache.Get("a")
+	cache.Get("b")
+	hits, misses := cache.Metrics()
+	assert.Equal(t, uint64(2), hits)
+	assert.Equal(t, uint64(1), misses)
+}
+
 // func TestCacheSameKey(t *testing.T) {
 // 	cache := NewCache(500)
 // 	key := "one"
@@ -31,6 +31,8 @@ const (
 const (
 	ManifestFilename                  = "MANIFEST"
 	ManifestRewriteFilename           = "REWRITEMANIFEST"
+	VlogHeadFilename                  = "VHEAD"
+	VlogHeadRewriteFilename           = "REWRITEVHEAD"
 	ManifestDeletionsRewriteThreshold = 10000
 	ManifestDeletionsRatio            = 10
 	DefaultFileFlag                   = os.O_RDWR | os.O_CREATE | os.O_APPEND
@@ -91,8 +91,13 @@ func (e *Entry) Entry() *Entry {
 	return e
 }
 
+// IsTombstone Del写入的墓碑带有BitDelete标记, value为空的entry不是墓碑
+func (e *Entry) IsTombstone() bool {
+	return e.Meta&BitDelete > 0
+}
+
 func (e *Entry) IsDeletedOrExpired() bool {
-	if e.Value == nil {
+	if e.IsTombstone() {
 		return true
 	}
 
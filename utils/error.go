@@ -63,6 +63,8 @@ var (
 
 	// compact
 	ErrFillTables = errors.New("Unable to fill tables")
+	// ErrCompactionAborted is returned if a manual compaction is interrupted by Close.
+	ErrCompactionAborted = errors.New("Manual compaction aborted, lsm is closing")
 
 	ErrBlockedWrites  = errors.New("Writes are blocked, possibly due to DropAll or Close")
 	ErrTxnTooBig      = errors.New("Txn is too big to fit into one request")
@@ -77,6 +79,15 @@ var (
 	// ErrRejected is returned if a value log GC is called either while another GC is running, or
 	// after DB::Close has been called.
 	ErrRejected = errors.New("Value log GC request rejected")
+
+	// ErrReplicaReadOnly is returned when a client writes to a follower.
+	ErrReplicaReadOnly = errors.New("Writes are not allowed on a replica")
+
+	// ErrSubscriberTooSlow is returned by Subscribe when the subscriber falls too far behind the writes.
+	ErrSubscriberTooSlow = errors.New("Subscriber is too slow and was disconnected")
+
+	// ErrInternalKey is returned by servers when a client writes a key with the reserved !corekv! prefix.
+	ErrInternalKey = errors.New("Keys with the !corekv! prefix are reserved for internal use")
 )
 
 // Panic 如果err 不为nil 则panicc
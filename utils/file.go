@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
@@ -132,3 +133,35 @@ func RemoveDir(dir string) {
 		panic(err)
 	}
 }
+
+// LinkOrCopy 将src的前size个字节放到dst, size<0时表示整个文件
+// 完整文件优先使用硬链接, 跨设备等无法链接的情况退化为拷贝
+func LinkOrCopy(src, dst string, size int64) error {
+	if size < 0 {
+		if err := os.Link(src, dst); err == nil {
+			return nil
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = in
+	if size >= 0 {
+		r = io.LimitReader(in, size)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Logger 分级日志, kv为交替出现的key与value, 如 logger.Info("replay", "fid", 1, "offset", 20)
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// LogLevel 日志级别
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+var defaultLogger = NewLogger(os.Stderr, LogInfo)
+
+// DefaultLogger 没有配置Logger时使用, 输出INFO及以上级别的日志到标准错误
+func DefaultLogger() Logger {
+	return defaultLogger
+}
+
+// stdLogger 基于标准库log的默认实现, 输出形如
+//
+//	2021/08/10 00:00:00.000000 INFO replay vlog fid=1 offset=20
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+// NewLogger 返回写入w的Logger, 低于level的日志会被丢弃
+func NewLogger(w io.Writer, level LogLevel) Logger {
+	return &stdLogger{l: log.New(w, "", log.LstdFlags|log.Lmicroseconds), level: level}
+}
+
+func (s *stdLogger) Debug(msg string, kv ...interface{}) { s.output(LogDebug, msg, kv) }
+func (s *stdLogger) Info(msg string, kv ...interface{})  { s.output(LogInfo, msg, kv) }
+func (s *stdLogger) Warn(msg string, kv ...interface{})  { s.output(LogWarn, msg, kv) }
+func (s *stdLogger) Error(msg string, kv ...interface{}) { s.output(LogError, msg, kv) }
+
+func (s *stdLogger) output(level LogLevel, msg string, kv []interface{}) {
+	if level < s.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(' ')
+		if i+1 == len(kv) {
+			// 落单的value没有key
+			b.WriteString("!BADKEY=")
+			b.WriteString(logValue(kv[i]))
+			break
+		}
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+		b.WriteString(logValue(kv[i+1]))
+	}
+	_ = s.l.Output(3, b.String())
+}
+
+// logValue 包含空白或引号的值加上引号, 便于日志系统解析
+func logValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case error:
+		s = v.Error()
+	default:
+		s = fmt.Sprintf("%+v", v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NopLogger 丢弃所有日志, 可以在测试中使用
+func NopLogger() Logger {
+	return nopLogger{}
+}
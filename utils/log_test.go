@@ -0,0 +1,47 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LogInfo)
+	l.Debug("dropped", "k", 1)
+	l.Info("replaying value log", "fid", 1, "offset", uint32(20))
+	l.Warn("quoted", "msg", "has space", "empty", "", "err", errors.New("boom"))
+	l.Error("odd", "k")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	// 去掉时间前缀
+	for i, line := range lines {
+		lines[i] = line[strings.Index(line, " ")+1:]
+		lines[i] = lines[i][strings.Index(lines[i], " ")+1:]
+	}
+	require.Equal(t, "INFO replaying value log fid=1 offset=20", lines[0])
+	require.Equal(t, `WARN quoted msg="has space" empty="" err=boom`, lines[1])
+	require.Equal(t, "ERROR odd !BADKEY=k", lines[2])
+
+	NopLogger().Error("nothing")
+	require.Equal(t, "DEBUG", LogDebug.String())
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics 不依赖第三方库的计数器与直方图, 以Prometheus文本格式输出
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Labels 指标的标签
+type Labels map[string]string
+
+// DefBuckets 以秒为单位的延迟直方图默认分桶, 从10us到1s
+var DefBuckets = []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// ExponentialBuckets 生成count个从start开始按factor递增的分桶
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if start <= 0 || factor <= 1 || count < 1 {
+		panic("metrics: invalid exponential buckets")
+	}
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// Registry 保存所有注册的指标, 同名指标的类型必须一致, 标签用于区分
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	names    []string
+	scrapeMu sync.Mutex // 串行化输出, 保证OnScrape取的快照只被本次输出读取
+	onScrape []func()
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	metrics []metric
+}
+
+type metric struct {
+	labels string // 已经格式化好的 k="v",k="v"
+	write  func(w *bufio.Writer, name, labels string)
+}
+
+// NewRegistry _
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) register(name, help, typ string, labels Labels, write func(w *bufio.Writer, name, labels string)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		r.families[name] = f
+		r.names = append(r.names, name)
+	}
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s registered as %s and %s", name, f.typ, typ))
+	}
+	ls := formatLabels(labels)
+	for _, m := range f.metrics {
+		if m.labels == ls {
+			panic(fmt.Sprintf("metrics: duplicate metric %s{%s}", name, ls))
+		}
+	}
+	f.metrics = append(f.metrics, metric{labels: ls, write: write})
+}
+
+// Counter 注册一个计数器
+func (r *Registry) Counter(name, help string, labels Labels) *Counter {
+	c := &Counter{}
+	r.register(name, help, typeCounter, labels, func(w *bufio.Writer, name, labels string) {
+		writeSample(w, name, labels, float64(c.Value()))
+	})
+	return c
+}
+
+// CounterFunc 注册一个由fn提供值的计数器, fn的返回值必须单调递增
+func (r *Registry) CounterFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, typeCounter, labels, func(w *bufio.Writer, name, labels string) {
+		writeSample(w, name, labels, fn())
+	})
+}
+
+// GaugeFunc 注册一个由fn提供当前值的指标
+func (r *Registry) GaugeFunc(name, help string, labels Labels, fn func() float64) {
+	r.register(name, help, typeGauge, labels, func(w *bufio.Writer, name, labels string) {
+		writeSample(w, name, labels, fn())
+	})
+}
+
+// Histogram 注册一个直方图, buckets必须升序, 为空时使用DefBuckets
+func (r *Registry) Histogram(name, help string, labels Labels, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, help, typeHistogram, labels, h.write)
+	return h
+}
+
+// OnScrape 注册每次输出前调用一次的fn, 用于一次性获取多个Func指标共用的快照
+func (r *Registry) OnScrape(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onScrape = append(r.onScrape, fn)
+}
+
+// WriteTo 以Prometheus文本格式输出所有指标
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	r.scrapeMu.Lock()
+	defer r.scrapeMu.Unlock()
+	r.mu.Lock()
+	hooks := append([]func(){}, r.onScrape...)
+	families := make([]family, 0, len(r.names))
+	for _, name := range r.names {
+		f := r.families[name]
+		families = append(families, family{name: f.name, help: f.help, typ: f.typ, metrics: append([]metric(nil), f.metrics...)})
+	}
+	r.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn()
+	}
+	cw := &countingWriter{w: out}
+	w := bufio.NewWriter(cw)
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		for _, m := range f.metrics {
+			m.write(w, f.name, m.labels)
+		}
+	}
+	err := w.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP 实现http.Handler
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = r.WriteTo(w)
+}
+
+// Counter 单调递增的计数器
+type Counter struct {
+	v int64
+}
+
+// Inc _
+func (c *Counter) Inc() { atomic.AddInt64(&c.v, 1) }
+
+// Add n不能为负数
+func (c *Counter) Add(n int64) {
+	if n < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value _
+func (c *Counter) Value() int64 { return atomic.LoadInt64(&c.v) }
+
+// Histogram 分桶统计观测值, 并发安全
+type Histogram struct {
+	upper  []float64
+	counts []uint64 // 每个分桶自己的计数, 输出时再累加
+	count  uint64
+	sum    uint64 // float64的bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	upper := append([]float64(nil), buckets...)
+	if math.IsInf(upper[len(upper)-1], 1) {
+		upper = upper[:len(upper)-1]
+	}
+	return &Histogram{upper: upper, counts: make([]uint64, len(upper)+1)}
+}
+
+// Observe 记录一次观测
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			break
+		}
+	}
+	atomic.AddUint64(&h.count, 1)
+}
+
+// Count 返回观测的次数
+func (h *Histogram) Count() uint64 { return atomic.LoadUint64(&h.count) }
+
+// Sum 返回观测值之和
+func (h *Histogram) Sum() float64 { return math.Float64frombits(atomic.LoadUint64(&h.sum)) }
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	var cum uint64
+	for i, upper := range h.upper {
+		cum += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, name+"_bucket", joinLabels(labels, `le="`+formatFloat(upper)+`"`), float64(cum))
+	}
+	cum += atomic.LoadUint64(&h.counts[len(h.upper)])
+	writeSample(w, name+"_bucket", joinLabels(labels, `le="+Inf"`), float64(cum))
+	writeSample(w, name+"_sum", labels, h.Sum())
+	writeSample(w, name+"_count", labels, float64(cum))
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatLabels 按标签名排序, 保证输出稳定
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+`="`+labelEscaper.Replace(labels[k])+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeHelp(s string) string { return helpEscaper.Replace(s) }
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("test_ops_total", "Number of ops.", Labels{"op": "get"})
+	r.Counter("test_ops_total", "Number of ops.", Labels{"op": "set"}).Add(2)
+	r.GaugeFunc("test_size_bytes", "Current size.", nil, func() float64 { return 1.5 })
+	h := r.Histogram("test_latency_seconds", "Latency.", nil, []float64{0.1, 1})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Inc()
+		}()
+	}
+	wg.Wait()
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+	expected := `# HELP test_ops_total Number of ops.
+# TYPE test_ops_total counter
+test_ops_total{op="get"} 10
+test_ops_total{op="set"} 2
+# HELP test_size_bytes Current size.
+# TYPE test_size_bytes gauge
+test_size_bytes 1.5
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 3
+test_latency_seconds_bucket{le="+Inf"} 4
+test_latency_seconds_sum 6.05
+test_latency_seconds_count 4
+`
+	require.Equal(t, expected, buf.String())
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	require.True(t, strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain"))
+	require.Equal(t, expected, rec.Body.String())
+}
+
+func TestRegistryConflicts(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("a_total", "", Labels{"k": "v"})
+	require.Panics(t, func() { r.Counter("a_total", "", Labels{"k": "v"}) })
+	require.Panics(t, func() { r.GaugeFunc("a_total", "", nil, func() float64 { return 0 }) })
+	require.Panics(t, func() { r.Counter("b_total", "", nil).Add(-1) })
+}
+
+func TestLabelEscaping(t *testing.T) {
+	require.Equal(t, `a="1",b="x\"y\\z\n"`, formatLabels(Labels{"b": "x\"y\\z\n", "a": "1"}))
+	require.Equal(t, []float64{1, 2, 4}, ExponentialBuckets(1, 2, 3))
+}
+
+func TestOnScrape(t *testing.T) {
+	r := NewRegistry()
+	var scrapes, snap int
+	r.OnScrape(func() {
+		scrapes++
+		snap = scrapes * 10
+	})
+	r.GaugeFunc("test_a", "", nil, func() float64 { return float64(snap) })
+	r.GaugeFunc("test_b", "", nil, func() float64 { return float64(snap + 1) })
+
+	for i := 1; i <= 2; i++ {
+		var buf bytes.Buffer
+		_, err := r.WriteTo(&buf)
+		require.NoError(t, err)
+		require.Equal(t, i, scrapes)
+		require.Contains(t, buf.String(), fmt.Sprintf("test_a %d\n", i*10))
+		require.Contains(t, buf.String(), fmt.Sprintf("test_b %d\n", i*10+1))
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IOPriority 限速的优先级, 配额不足时高优先级的请求先获得配额
+type IOPriority int
+
+const (
+	// IOPriorityLow 压缩与vlog gc的写入
+	IOPriorityLow IOPriority = iota
+	// IOPriorityHigh memtable刷盘, 积压会阻塞前台写入
+	IOPriorityHigh
+	numIOPriorities
+)
+
+// rateLimiterRefillPeriod 令牌桶补充配额的周期, 一个周期内最多写入速度的1/10
+const rateLimiterRefillPeriod = 100 * time.Millisecond
+
+// rateLimiterMinRatio 自动调整时速度的下限占上限的比例
+const rateLimiterMinRatio = 20
+
+// RateLimiter 限制后台任务写入速度的令牌桶, 可以在多个协程中使用, 为nil时不限速
+type RateLimiter struct {
+	sync.Mutex
+	maxRate      int64 // 每秒的字节数, 自动调整时为上限
+	rate         int64 // 低优先级的速度, 自动调整只影响低优先级
+	autoTuned    bool
+	available    int64     // 当前周期剩余的配额, 按maxRate计算
+	lowAvailable int64     // 当前周期低优先级剩余的配额, 按rate计算
+	next         time.Time // 下一次补充配额的时间
+	waiting      [numIOPriorities]int
+	total        [numIOPriorities]int64
+}
+
+// NewRateLimiter bytesPerSecond为每秒允许写入的字节数. autoTuned为true时bytesPerSecond是速度的上限,
+// 低优先级的实际速度由Tune按待压缩的数据量在上限的1/20到上限之间调整, 初始为上限; 高优先级始终按上限限速
+func NewRateLimiter(bytesPerSecond int64, autoTuned bool) *RateLimiter {
+	CondPanic(bytesPerSecond <= 0, fmt.Errorf("invalid rate limit: %d bytes per second", bytesPerSecond))
+	return &RateLimiter{
+		maxRate:   bytesPerSecond,
+		rate:      bytesPerSecond,
+		autoTuned: autoTuned,
+	}
+}
+
+// Request 阻塞直到获得n字节的配额, 超过一个周期配额的请求会分多个周期获得
+func (rl *RateLimiter) Request(n int64, pri IOPriority) {
+	if rl == nil || n <= 0 {
+		return
+	}
+	rl.Lock()
+	defer rl.Unlock()
+	rl.total[pri] += n
+	for n > 0 {
+		rl.refill()
+		// 有高优先级的请求在等待时, 低优先级的请求把配额让给它
+		available := rl.available
+		if pri == IOPriorityLow {
+			if rl.waiting[IOPriorityHigh] > 0 {
+				available = 0
+			} else if rl.lowAvailable < available {
+				available = rl.lowAvailable
+			}
+		}
+		if available > 0 {
+			take := n
+			if take > available {
+				take = available
+			}
+			rl.available -= take
+			rl.lowAvailable -= take
+			n -= take
+			continue
+		}
+		rl.waiting[pri]++
+		wait := time.Until(rl.next)
+		rl.Unlock()
+		time.Sleep(wait)
+		rl.Lock()
+		rl.waiting[pri]--
+	}
+}
+
+func (rl *RateLimiter) refill() {
+	now := time.Now()
+	if now.Before(rl.next) {
+		return
+	}
+	// 配额不跨周期累积, 避免空闲之后突发写入
+	rl.available = quota(rl.maxRate)
+	rl.lowAvailable = quota(rl.rate)
+	rl.next = now.Add(rateLimiterRefillPeriod)
+}
+
+// quota 一个周期内按rate可以写入的字节数, 至少为1
+func quota(rate int64) int64 {
+	if q := rate * int64(rateLimiterRefillPeriod) / int64(time.Second); q > 0 {
+		return q
+	}
+	return 1
+}
+
+// Tune 自动调整时按待压缩的字节数设置低优先级的速度, pending达到limit时使用上限, 越少速度越低, 把磁盘留给前台读写
+// flush积压会阻塞前台写入, 不受自动调整的影响
+func (rl *RateLimiter) Tune(pending, limit int64) {
+	if rl == nil || !rl.autoTuned || limit <= 0 {
+		return
+	}
+	rate := rl.maxRate
+	if pending < limit {
+		rate = int64(float64(rl.maxRate) * float64(pending) / float64(limit))
+	}
+	if min := rl.maxRate / rateLimiterMinRatio; rate < min {
+		rate = min
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	rl.Lock()
+	rl.rate = rate
+	rl.Unlock()
+}
+
+// BytesPerSecond 当前低优先级每秒允许写入的字节数
+func (rl *RateLimiter) BytesPerSecond() int64 {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.rate
+}
+
+// TotalBytes 该优先级累计请求的字节数
+func (rl *RateLimiter) TotalBytes(pri IOPriority) int64 {
+	rl.Lock()
+	defer rl.Unlock()
+	return rl.total[pri]
+}
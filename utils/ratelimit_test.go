@@ -0,0 +1,98 @@
+// Copyright 2021 hardcore-os Project Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License")
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *RateLimiter
+	nilLimiter.Request(1<<30, IOPriorityLow)
+
+	// 每个周期100KB, 400KB至少需要3个周期
+	rl := NewRateLimiter(1<<20, false)
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		rl.Request(8<<10, IOPriorityLow)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+	require.Equal(t, int64(400<<10), rl.TotalBytes(IOPriorityLow))
+	require.Zero(t, rl.TotalBytes(IOPriorityHigh))
+}
+
+// TestRateLimiterPriority 高优先级的请求等待配额时, 低优先级的请求拿不到配额
+func TestRateLimiterPriority(t *testing.T) {
+	rl := NewRateLimiter(200<<10, false)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var low int64
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				rl.Request(1<<10, IOPriorityLow)
+				atomic.AddInt64(&low, 1<<10)
+			}
+		}()
+	}
+	for atomic.LoadInt64(&low) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// 每个周期20KB, 100KB需要5个周期, 期间低优先级的请求最多拿到开始时所在周期剩余的配额
+	before := atomic.LoadInt64(&low)
+	rl.Request(100<<10, IOPriorityHigh)
+	require.LessOrEqual(t, atomic.LoadInt64(&low)-before, int64(20<<10))
+	close(stop)
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
+
+func TestRateLimiterTune(t *testing.T) {
+	rl := NewRateLimiter(1000, true)
+	rl.Tune(0, 100)
+	require.Equal(t, int64(50), rl.BytesPerSecond())
+	rl.Tune(40, 100)
+	require.Equal(t, int64(400), rl.BytesPerSecond())
+	rl.Tune(200, 100)
+	require.Equal(t, int64(1000), rl.BytesPerSecond())
+
+	fixed := NewRateLimiter(1000, false)
+	fixed.Tune(0, 100)
+	require.Equal(t, int64(1000), fixed.BytesPerSecond())
+}
+
+// TestRateLimiterTuneHighPriority 自动调整降低速度时flush仍按上限限速
+func TestRateLimiterTuneHighPriority(t *testing.T) {
+	rl := NewRateLimiter(1<<20, true)
+	rl.Tune(0, 100)
+	require.Equal(t, int64(1<<20/20), rl.BytesPerSecond())
+
+	// 按上限每个周期100KB, 300KB最多需要3个周期; 按调整后的速度需要约6秒
+	start := time.Now()
+	rl.Request(300<<10, IOPriorityHigh)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
@@ -478,7 +478,7 @@ func (s *Skiplist) Search(key []byte) ValueStruct {
 
 	valOffset, valSize := n.getValueOffset()
 	vs := s.arena.getVal(valOffset, valSize)
-	vs.ExpiresAt = ParseTs(nextKey)
+	vs.Version = ParseTs(nextKey)
 	return vs
 }
 
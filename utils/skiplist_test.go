@@ -185,3 +185,18 @@ func TestSkipListIterator(t *testing.T) {
 		fmt.Printf("iter key %s, value %s", iter.Item().Entry().Key, iter.Item().Entry().Value)
 	}
 }
+
+// TestSkipListSearchVersion Search返回的Version来自找到的key, ExpiresAt保持写入时的值
+func TestSkipListSearchVersion(t *testing.T) {
+	list := NewSkiplist(1000)
+	e := NewEntry(KeyWithTs([]byte("key"), 5), []byte("val"))
+	e.ExpiresAt = 100
+	list.Add(e)
+
+	vs := list.Search(KeyWithTs([]byte("key"), 10))
+	require.Equal(t, []byte("val"), vs.Value)
+	require.Equal(t, uint64(5), vs.Version)
+	require.Equal(t, uint64(100), vs.ExpiresAt)
+	// 比写入的版本更旧的读取看不到该key
+	require.Nil(t, list.Search(KeyWithTs([]byte("key"), 4)).Value)
+}
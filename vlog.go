@@ -25,6 +25,7 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -56,6 +57,7 @@ type valueLog struct {
 	db                *DB
 	writableLogOffset uint32 // read by read, written by write. Must access via atomics.
 	numEntriesWritten uint32
+	bytesWritten      int64 // 累计写入vlog的字节数, 用于统计写放大
 	opt               Options
 
 	garbageCh      chan struct{}
@@ -82,7 +84,7 @@ func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry)
 	// If no files are found, then create a new file.
 	if len(vlog.filesMap) == 0 {
 		_, err := vlog.createVlogFile(0)
-		return utils.WarpErr("Error while creating log file in valueLog.open", err)
+		return errors.Wrap(err, "Error while creating log file in valueLog.open")
 	}
 	fids := vlog.sortedFids()
 	for _, fid := range fids {
@@ -101,11 +103,17 @@ func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry)
 		}
 		var offset uint32
 		// 从head处开始重放vlog日志，而不是从第一条日志
-		// head 相当于一个快照
+		// head 相当于一个快照, head之前的文件已经全部写入lsm, 不需要重放
+		if fid < ptr.Fid {
+			if err := lf.Init(); err != nil {
+				return err
+			}
+			continue
+		}
 		if fid == ptr.Fid {
 			offset = ptr.Offset + ptr.Len
 		}
-		fmt.Printf("Replaying file id: %d at offset: %d\n", fid, offset)
+		vlog.db.logger.Info("replaying value log", "fid", fid, "offset", offset)
 		now := time.Now()
 		// 重放日志
 		if err := vlog.replayLog(lf, offset, replayFn); err != nil {
@@ -124,7 +132,7 @@ func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry)
 			}
 			return err
 		}
-		fmt.Printf("Replay took: %s\n", time.Since(now))
+		vlog.db.logger.Info("replayed value log", "fid", fid, "took", time.Since(now))
 
 		if fid < vlog.maxFid {
 			// This file has been replayed. It can now be mmapped.
@@ -144,9 +152,11 @@ func (vlog *valueLog) open(db *DB, ptr *utils.ValuePtr, replayFn utils.LogEntry)
 	vlog.writableLogOffset = uint32(lastOffset)
 
 	// head的设计起到check point的作用
+	vlog.db.Lock()
 	vlog.db.vhead = &utils.ValuePtr{Fid: vlog.maxFid, Offset: uint32(lastOffset)}
+	vlog.db.Unlock()
 	if err := vlog.populateDiscardStats(); err != nil {
-		fmt.Errorf("Failed to populate discard stats: %s\n", err)
+		vlog.db.logger.Warn("failed to populate discard stats", "err", err)
 	}
 	return nil
 }
@@ -179,9 +189,8 @@ func (vlog *valueLog) read(vp *utils.ValuePtr) ([]byte, func(), error) {
 	headerLen := h.Decode(buf)
 	kv := buf[headerLen:]
 	if uint32(len(kv)) < h.KLen+h.VLen {
-		fmt.Errorf("Invalid read: vp: %+v\n", vp)
-		return nil, nil, errors.Errorf("Invalid read: Len: %d read at:[%d:%d]",
-			len(kv), h.KLen, h.KLen+h.VLen)
+		return nil, nil, errors.Errorf("Invalid read: vp: %+v Len: %d read at:[%d:%d]",
+			vp, len(kv), h.KLen, h.KLen+h.VLen)
 	}
 	return kv[h.KLen : h.KLen+h.VLen], cb, nil
 }
@@ -210,6 +219,7 @@ func (vlog *valueLog) write(reqs []*request) error {
 		}
 		buf.Reset()
 		atomic.AddUint32(&vlog.writableLogOffset, uint32(len(data)))
+		atomic.AddInt64(&vlog.bytesWritten, int64(len(data)))
 		curlf.AddSize(vlog.writableLogOffset)
 		return nil
 	}
@@ -289,7 +299,8 @@ func (vlog *valueLog) close() error {
 	for id, f := range vlog.filesMap {
 		f.Lock.Lock() // We won’t release the lock.
 		maxFid := vlog.maxFid
-		if id == maxFid {
+		// 没有写入过的文件保持预分配的大小, 截断到0会导致重新mmap失败
+		if id == maxFid && vlog.woffset() > 0 {
 			// truncate writable log file to correct offset.
 			if truncErr := f.Truncate(int64(vlog.woffset())); truncErr != nil && err == nil {
 				err = truncErr
@@ -361,7 +372,22 @@ func (vlog *valueLog) doRunGC(lf *file.LogFile, discardRatio float64) (err error
 }
 
 //重写
-func (vlog *valueLog) rewrite(f *file.LogFile) error {
+func (vlog *valueLog) rewrite(f *file.LogFile) (err error) {
+	start := time.Now()
+	var moved int
+	var movedSize int64
+	defer func() {
+		info := ValueLogGCInfo{Fid: f.FID, MovedEntries: moved, Duration: time.Since(start), Err: err}
+		if err == nil {
+			// 回收的字节数按文件大小减去重新写入的大小估算
+			if reclaimed := f.Size() - movedSize; reclaimed > 0 {
+				info.ReclaimedBytes = reclaimed
+			}
+			vlog.db.metrics.vlogGCRuns.Inc()
+			vlog.db.metrics.vlogGCBytes.Add(info.ReclaimedBytes)
+		}
+		vlog.db.listener().OnValueLogGC(info)
+	}()
 	vlog.filesLock.RLock()
 	maxFid := vlog.maxFid
 	vlog.filesLock.RUnlock()
@@ -370,11 +396,11 @@ func (vlog *valueLog) rewrite(f *file.LogFile) error {
 	wb := make([]*utils.Entry, 0, 1000)
 	var size int64
 
-	var count, moved int
+	var count int
 	fe := func(e *utils.Entry) error {
 		count++
 		if count%100000 == 0 {
-			fmt.Printf("Processing entry %d\n", count)
+			vlog.db.logger.Debug("rewriting value log", "fid", f.FID, "entries", count)
 		}
 
 		vs, err := vlog.db.lsm.Get(e.Key)
@@ -421,13 +447,16 @@ func (vlog *valueLog) rewrite(f *file.LogFile) error {
 				size = 0
 				wb = wb[:0]
 			}
+			// 重写的数据与压缩使用相同的低优先级限速
+			vlog.db.opt.RateLimiter.Request(es, utils.IOPriorityLow)
 			wb = append(wb, ne)
 			size += es
+			movedSize += es
 		}
 		return nil
 	}
 
-	_, err := vlog.iterate(f, 0, func(e *utils.Entry, vp *utils.ValuePtr) error {
+	_, err = vlog.iterate(f, 0, func(e *utils.Entry, vp *utils.ValuePtr) error {
 		return fe(e)
 	})
 	if err != nil {
@@ -478,7 +507,6 @@ func (vlog *valueLog) rewrite(f *file.LogFile) error {
 			return err
 		}
 	}
-
 	return nil
 }
 
@@ -516,7 +544,9 @@ func (vlog *valueLog) deleteLogFile(lf *file.LogFile) error {
 	}
 	lf.Lock.Lock()
 	defer lf.Lock.Unlock()
-	utils.Err(lf.Close())
+	if err := lf.Close(); err != nil {
+		vlog.db.logger.Warn("failed to close value log", "file", lf.FileName(), "err", err)
+	}
 	return os.Remove(lf.FileName())
 }
 
@@ -609,7 +639,7 @@ func (vlog *valueLog) populateFilesMap() error {
 
 	files, err := ioutil.ReadDir(vlog.dirPath)
 	if err != nil {
-		return utils.WarpErr(fmt.Sprintf("Unable to open log dir. path[%s]", vlog.dirPath), err)
+		return errors.Wrapf(err, "Unable to open log dir. path[%s]", vlog.dirPath)
 	}
 
 	found := make(map[uint64]struct{})
@@ -620,10 +650,10 @@ func (vlog *valueLog) populateFilesMap() error {
 		fsz := len(f.Name())
 		fid, err := strconv.ParseUint(f.Name()[:fsz-5], 10, 32)
 		if err != nil {
-			return utils.WarpErr(fmt.Sprintf("Unable to parse log id. name:[%s]", f.Name()), err)
+			return errors.Wrapf(err, "Unable to parse log id. name:[%s]", f.Name())
 		}
 		if _, ok := found[fid]; ok {
-			return utils.WarpErr(fmt.Sprintf("Duplicate file found. Please delete one. name:[%s]", f.Name()), err)
+			return errors.Errorf("Duplicate file found. Please delete one. name:[%s]", f.Name())
 		}
 		found[fid] = struct{}{}
 
@@ -658,7 +688,9 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*file.LogFile, error) {
 
 	removeFile := func() {
 		// 如果处理出错 则直接删除文件
-		utils.Err(os.Remove(lf.FileName()))
+		if err := os.Remove(lf.FileName()); err != nil {
+			vlog.db.logger.Warn("failed to remove value log", "file", lf.FileName(), "err", err)
+		}
 	}
 
 	if err = lf.Bootstrap(); err != nil {
@@ -668,7 +700,7 @@ func (vlog *valueLog) createVlogFile(fid uint32) (*file.LogFile, error) {
 
 	if err = utils.SyncDir(vlog.dirPath); err != nil {
 		removeFile()
-		return nil, utils.WarpErr(fmt.Sprintf("Sync value log dir[%s]", vlog.dirPath), err)
+		return nil, errors.Wrapf(err, "Sync value log dir[%s]", vlog.dirPath)
 	}
 	vlog.filesLock.Lock()
 	vlog.filesMap[fid] = lf
@@ -724,10 +756,10 @@ func (vlog *valueLog) replayLog(lf *file.LogFile, offset uint32, replayFn utils.
 		return lf.Bootstrap()
 	}
 
-	fmt.Printf("Truncating vlog file %s to offset: %d\n", lf.FileName(), endOffset)
+	vlog.db.logger.Info("truncating value log", "file", lf.FileName(), "offset", endOffset)
 	if err := lf.Truncate(int64(endOffset)); err != nil {
-		return utils.WarpErr(
-			fmt.Sprintf("Truncation needed at offset %d. Can be done manually as well.", endOffset), err)
+		vlog.db.logger.Error("truncation needed, can be done manually as well", "file", lf.FileName(), "offset", endOffset, "err", err)
+		return err
 	}
 	return nil
 }
@@ -783,7 +815,7 @@ loop:
 			if err == utils.ErrStop {
 				break
 			}
-			return 0, utils.WarpErr(fmt.Sprintf("Iteration function %s", lf.FileName()), err)
+			return 0, errors.Wrapf(err, "Iteration function %s", lf.FileName())
 		}
 	}
 	return validEndOffset, nil
@@ -879,7 +911,7 @@ func (vlog *valueLog) populateDiscardStats() error {
 	if err := json.Unmarshal(val, &statsMap); err != nil {
 		return errors.Wrapf(err, "failed to unmarshal discard stats")
 	}
-	fmt.Printf("Value Log Discard stats: %v\n", statsMap)
+	vlog.db.logger.Debug("loaded value log discard stats", "stats", statsMap)
 	vlog.lfDiscardStats.flushChan <- statsMap
 	return nil
 }
@@ -890,7 +922,6 @@ func (vlog *valueLog) fpath(fid uint32) string {
 
 // initVLog
 func (db *DB) initVLog() {
-	vp, _ := db.getHead()
 	vlog := &valueLog{
 		dirPath:          db.opt.WorkDir,
 		filesToBeDeleted: make([]uint32, 0),
@@ -903,16 +934,69 @@ func (db *DB) initVLog() {
 	vlog.db = db
 	vlog.opt = *db.opt
 	vlog.garbageCh = make(chan struct{}, 1)
-	if err := vlog.open(db, vp, db.replayFunction()); err != nil {
+	db.vlog = vlog
+}
+
+// replayVLog 打开vlog文件并将head之后的数据重放到lsm中，必须在lsm初始化之后调用
+func (db *DB) replayVLog() {
+	vp, err := db.getHead()
+	utils.Panic(err)
+	if err := db.vlog.open(db, vp, db.replayFunction()); err != nil {
 		utils.Panic(err)
 	}
-	db.vlog = vlog
 }
 
-// getHead prints all the head pointer in the DB and return the max value.
-func (db *DB) getHead() (*utils.ValuePtr, uint64) {
+// getHead 读取最近一次持久化的head, 没有head文件时返回零值, 从头重放
+func (db *DB) getHead() (*utils.ValuePtr, error) {
 	var vptr utils.ValuePtr
-	return &vptr, 0
+	buf, err := ioutil.ReadFile(filepath.Join(db.opt.WorkDir, utils.VlogHeadFilename))
+	if os.IsNotExist(err) {
+		return &vptr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) != len(vptr.Encode()) {
+		return nil, errors.Errorf("corrupted vlog head file, size %d", len(buf))
+	}
+	vptr.Decode(buf)
+	return &vptr, nil
+}
+
+// persistHead 在memtable刷盘之前持久化head. head之前的vlog数据都已经写入lsm(wal或sst),
+// 刷盘后的sst可能被压缩丢弃旧版本与墓碑, 重放必须从这之后开始, 否则被丢弃的数据会重新出现
+func (db *DB) persistHead() error {
+	db.RLock()
+	ptr := db.vhead
+	db.RUnlock()
+	if ptr == nil || ptr.IsZero() {
+		return nil
+	}
+	return writeHeadFile(db.opt.WorkDir, ptr)
+}
+
+// writeHeadFile 先写临时文件再rename, 崩溃时不会留下写了一半的head
+func writeHeadFile(dir string, ptr *utils.ValuePtr) error {
+	rewritePath := filepath.Join(dir, utils.VlogHeadRewriteFilename)
+	fp, err := os.OpenFile(rewritePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, utils.DefaultFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(ptr.Encode()); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(rewritePath, filepath.Join(dir, utils.VlogHeadFilename)); err != nil {
+		return err
+	}
+	return utils.SyncDir(dir)
 }
 func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
 	toLSM := func(k []byte, vs utils.ValueStruct) {
@@ -936,11 +1020,6 @@ func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
 			nv = vp.Encode()
 			meta = meta | utils.BitValuePointer
 		}
-		// Update vhead. If the crash happens while replay was in progess
-		// and the head is not updated, we will end up replaying all the
-		// files starting from file zero, again.
-		db.updateHead([]*utils.ValuePtr{vp})
-
 		v := utils.ValueStruct{
 			Value:     nv,
 			Meta:      meta,
@@ -948,6 +1027,10 @@ func (db *DB) replayFunction() func(*utils.Entry, *utils.ValuePtr) error {
 		}
 		// This entry is from a rewrite or via SetEntryAt(..).
 		toLSM(nk, v)
+		// 写入lsm之后再推进head, 重放期间的刷盘持久化的head不会越过还没写入lsm的数据
+		db.Lock()
+		db.updateHead([]*utils.ValuePtr{vp})
+		db.Unlock()
 		return nil
 	}
 }
@@ -998,6 +1081,37 @@ func (vlog *valueLog) sync(fid uint32) error {
 	return err
 }
 
+// VlogFileInfo vlog文件的基本信息
+type VlogFileInfo struct {
+	Fid     uint32
+	Size    int64
+	Discard int64 // compact过程中统计的可回收字节数
+}
+
+// VlogFiles 返回当前所有的vlog文件
+func (db *DB) VlogFiles() []VlogFileInfo {
+	return db.vlog.filesInfo()
+}
+
+func (vlog *valueLog) filesInfo() []VlogFileInfo {
+	vlog.filesLock.RLock()
+	defer vlog.filesLock.RUnlock()
+	vlog.lfDiscardStats.RLock()
+	defer vlog.lfDiscardStats.RUnlock()
+	var infos []VlogFileInfo
+	for _, fid := range vlog.sortedFids() {
+		lf := vlog.filesMap[fid]
+		info := VlogFileInfo{Fid: fid, Discard: vlog.lfDiscardStats.m[fid]}
+		if fid == vlog.maxFid {
+			info.Size = int64(vlog.woffset())
+		} else {
+			info.Size = lf.Size()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 // Set
 func (v *valueLog) set(entry *utils.Entry) error {
 	return nil
@@ -1068,7 +1182,7 @@ func (vlog *valueLog) flushDiscardStats() {
 			return
 		case stats := <-vlog.lfDiscardStats.flushChan:
 			if err := process(stats); err != nil {
-				utils.Err(fmt.Errorf("unable to process discardstats with error: %s", err))
+				vlog.db.logger.Error("unable to process discard stats", "err", err)
 			}
 		}
 	}
@@ -1240,12 +1354,12 @@ func (vlog *valueLog) sample(samp *sampler, discardRatio float64) (*reason, erro
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("Fid: %d. Skipped: %5.2fMB Num iterations: %d. Data status=%+v\n",
-		samp.lf.FID, skipped, numIterations, r)
+	vlog.db.logger.Info("sampled value log for gc", "fid", samp.lf.FID, "skippedMB", fmt.Sprintf("%.2f", skipped),
+		"iterations", numIterations, "total", r.total, "discard", r.discard, "count", r.count)
 	// If we couldn't sample at least a 1000 KV pairs or at least 75% of the window size,
 	// and what we can discard is below the threshold, we should skip the rewrite.
 	if (r.count < countWindow && r.total < sizeWindowM*0.75) || r.discard < discardRatio*r.total {
-		fmt.Printf("Skipping GC on fid: %d", samp.lf.FID)
+		vlog.db.logger.Info("skipping value log gc", "fid", samp.lf.FID)
 		return nil, utils.ErrNoRewrite
 	}
 	return &r, nil
@@ -15,6 +15,8 @@ package corekv
 
 import (
 	"bytes"
+	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"testing"
@@ -33,6 +35,7 @@ var (
 		ValueThreshold:   0,
 		MaxBatchCount:    10,
 		MaxBatchSize:     1 << 20,
+		Logger:           utils.NopLogger(),
 	}
 )
 
@@ -101,6 +104,70 @@ func TestVlogBase(t *testing.T) {
 	}, readEntries)
 }
 
+// TestVlogReplay 只写入vlog而没有写入lsm的数据, 重启时重放到lsm中
+func TestVlogReplay(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	b := new(request)
+	for i := 0; i < 10; i++ {
+		b.Entries = append(b.Entries, utils.NewEntry(
+			utils.KeyWithTs([]byte(fmt.Sprintf("replaykey%d", i)), math.MaxUint32), []byte(fmt.Sprintf("val%d", i))))
+	}
+	require.NoError(t, db.vlog.write([]*request{b}))
+	require.NoError(t, db.Close())
+
+	db = Open(opt)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		e, err := db.Get([]byte(fmt.Sprintf("replaykey%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val%d", i), string(e.Value))
+	}
+}
+
+// TestVlogReplayFromHead 重启时只重放head之后的vlog, 合并已经丢弃的旧版本不会重新出现
+func TestVlogReplayFromHead(t *testing.T) {
+	clearDir()
+	db := Open(opt)
+	key := []byte("headkey")
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("old"))))
+	require.NoError(t, db.Flatten(1))
+	require.NoError(t, db.Set(utils.NewEntry(key, []byte("new"))))
+	// 新版本合并到最后一层时丢弃旧版本
+	require.NoError(t, db.Flatten(1))
+	db.RLock()
+	last := *db.vhead
+	db.RUnlock()
+	require.NoError(t, db.Close())
+
+	db = Open(opt)
+	defer db.Close()
+	vp, _ := db.getHead()
+	require.False(t, vp.Less(&last))
+	e, err := db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(e.Value))
+}
+
+// TestReopenAfterBackgroundFlush 后台刷盘记录的head可能已经包含活跃内存表中的写入, 关闭时保留这部分的wal
+func TestReopenAfterBackgroundFlush(t *testing.T) {
+	ropt := *opt
+	ropt.WorkDir = t.TempDir()
+	db := Open(&ropt)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%03d", i)) }
+	for i := 0; i < 300; i++ {
+		require.NoError(t, db.Set(utils.NewEntry(key(i), []byte("val"))))
+	}
+	require.NoError(t, db.Close())
+
+	db = Open(&ropt)
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		_, err := db.Get(key(i))
+		require.NoError(t, err, "key%03d", i)
+	}
+}
+
 func clearDir() {
 	_, err := os.Stat(opt.WorkDir)
 	if err == nil {